@@ -20,6 +20,9 @@ import (
 	"github.com/bugmaschine/gad/pkg/download"
 	"github.com/bugmaschine/gad/pkg/ffmpeg"
 	"github.com/bugmaschine/gad/pkg/logger"
+	"github.com/bugmaschine/gad/pkg/naming"
+	"github.com/bugmaschine/gad/pkg/nfo"
+	"github.com/bugmaschine/gad/pkg/retry"
 	"github.com/bugmaschine/gad/pkg/utils"
 )
 
@@ -62,25 +65,93 @@ func main() {
 		os.Exit(1)
 	}
 
+	retryPolicy := retry.NewPolicy(args.Retries)
+	slog.Debug("Retry policy", "retries", retryPolicy.Retries, "base-delay", retryPolicy.BaseDelay, "max-delay", retryPolicy.MaxDelay)
+
+	// Fail early instead of after the browser has started
+	if _, err := args.GetExtractorPriorities(); err != nil {
+		slog.Error("Failed to parse extractor priorities", "error", err)
+		os.Exit(1)
+	}
+	if _, err := args.GetVideoType(); err != nil {
+		slog.Error("Failed to parse video type", "error", err)
+		os.Exit(1)
+	}
+	if _, err := args.GetEpisodesRequest(); err != nil {
+		slog.Error("Failed to parse episode selection", "error", err)
+		os.Exit(1)
+	}
+	quality, err := args.GetQuality()
+	if err != nil {
+		slog.Error("Failed to parse quality", "error", err)
+		os.Exit(1)
+	}
+	subtitleFormat, err := args.GetSubtitleFormat()
+	if err != nil {
+		slog.Error("Failed to parse subtitle format", "error", err)
+		os.Exit(1)
+	}
+	if _, err := args.GetNamingTemplate(); err != nil {
+		slog.Error("Failed to parse naming template", "error", err)
+		os.Exit(1)
+	}
+	if _, _, err := args.GetTitleLanguage(); err != nil {
+		slog.Error("Failed to parse episode title language", "error", err)
+		os.Exit(1)
+	}
+	profile, err := args.GetProfile()
+	if err != nil {
+		slog.Error("Failed to parse post-processing profile", "error", err)
+		os.Exit(1)
+	}
+
 	// Downloader for assets (FFmpeg, uBlock)
 	assetDownloader := download.NewDownloader("gad/1.0", args.Debug, rateLimit)
+	assetDownloader.SetRetryPolicy(retryPolicy)
+	assetDownloader.SetSegmentWorkers(args.SegmentWorkers)
+	assetDownloader.SetConnections(args.Connections)
+	assetDownloader.SetQuality(quality)
+	assetDownloader.SetSubtitleFormat(subtitleFormat)
+	assetDownloader.SetEmbedSubtitles(args.EmbedSubtitles)
+	assetDownloader.SetProfile(profile)
 
 	// Create FFmpeg manager
 	ff := ffmpeg.New(dataDir)
 
-	// Auto-download FFmpeg
+	// Auto-download FFmpeg. Without it, HLS streams are remuxed by the built-in remuxer.
+	// Tools that are optional are only tried once, an offline start would wait through all retries otherwise.
+	if !profile.NeedsFFmpeg() {
+		assetDownloader.SetRetryPolicy(nil)
+	}
 	slog.Info("Checking for FFmpeg...")
 	ffmpegPath, err := ff.AutoDownload(ctx, assetDownloader)
-	if err != nil {
-		slog.Error("Failed to manage FFmpeg", "error", err)
+	if err != nil && profile.NeedsFFmpeg() {
+		slog.Error("The post-processing profile needs FFmpeg", "profile", profile.Name, "container", profile.Container, "error", err)
 		os.Exit(1)
+	} else if err != nil {
+		slog.Warn("FFmpeg isn't available, using the built-in remuxer for H.264/AAC streams", "error", err)
+	} else {
+		slog.Info("Using FFmpeg at", "path", ffmpegPath)
+		assetDownloader.SetFfmpegPath(ffmpegPath)
+	}
+
+	// FFprobe verifies finished downloads, without it they are taken as they are
+	assetDownloader.SetRetryPolicy(nil)
+	ffprobePath, err := ff.AutoDownloadProbe(ctx, assetDownloader, ffmpegPath)
+	if err != nil {
+		slog.Warn("Failed to manage FFprobe, downloads won't be verified", "error", err)
+	} else {
+		slog.Debug("Using FFprobe at", "path", ffprobePath)
+		assetDownloader.SetFfprobePath(ffprobePath)
 	}
-	slog.Info("Using FFmpeg at", "path", ffmpegPath)
-	assetDownloader.SetFfmpegPath(ffmpegPath)
+	assetDownloader.SetRetryPolicy(retryPolicy)
 
 	// Chrome management
 	chromeMgr := chrome.NewManager(dataDir, assetDownloader)
 
+	// Shared between all series, so the ddos wait budget carries over in queue mode
+	scheduler := downloaders.NewRequestScheduler(args.DdosWaitEpisodes, args.DdosWaitMs)
+
 	if args.QueueFile != "" {
 		slog.Debug("Queue file specified", "file", args.QueueFile)
 		queueFile, err := os.Open(args.QueueFile)
@@ -117,7 +188,7 @@ func main() {
 			slog.Info("Processing URL from queue", "url", args.Url)
 			// I know that this could be better, but realistically people are only going to use queue with a whole series.
 			// and the download bar might not show all downloads, but who cares? i mean, i'll just have a cron job run it
-			if err := handleSeriesDownload(ctx, args, assetDownloader, chromeMgr, saveDir); err != nil {
+			if err := handleSeriesDownload(ctx, args, assetDownloader, chromeMgr, saveDir, retryPolicy, scheduler); err != nil {
 				slog.Error("Failed to handle series download from queue", "error", err, "url", args.Url)
 			}
 		}
@@ -134,14 +205,14 @@ func main() {
 	if args.Url != "" {
 		if args.Extractor != "" {
 			slog.Debug("Single download", "url", args.Url, "extractor", args.Extractor)
-			if err := handleSingleDownload(ctx, args, assetDownloader, chromeMgr, saveDir); err != nil {
+			if err := handleSingleDownload(ctx, args, assetDownloader, chromeMgr, saveDir, retryPolicy); err != nil {
 				slog.Error("Failed to handle single download", "error", err)
 				os.Exit(1)
 			}
 			os.Exit(0)
 		} else {
 			slog.Debug("Series download", "url", args.Url)
-			if err := handleSeriesDownload(ctx, args, assetDownloader, chromeMgr, saveDir); err != nil {
+			if err := handleSeriesDownload(ctx, args, assetDownloader, chromeMgr, saveDir, retryPolicy, scheduler); err != nil {
 				slog.Error("Failed to handle series download", "error", err)
 			}
 		}
@@ -151,7 +222,33 @@ func main() {
 	}
 }
 
-func handleSeriesDownload(ctx context.Context, args *cli.Args, d *download.Downloader, cm *chrome.ChromeManager, saveDir string) (err error) {
+func handleSeriesDownload(ctx context.Context, args *cli.Args, d *download.Downloader, cm *chrome.ChromeManager, saveDir string, retryPolicy *retry.Policy, scheduler *downloaders.RequestScheduler) (err error) {
+	priorities, err := args.GetExtractorPriorities()
+	if err != nil {
+		slog.Error("Failed to parse extractor priorities", "error", err)
+		return err
+	}
+	videoType, err := args.GetVideoType()
+	if err != nil {
+		slog.Error("Failed to parse video type", "error", err)
+		return err
+	}
+	episodes, err := args.GetEpisodesRequest()
+	if err != nil {
+		slog.Error("Failed to parse episode selection", "error", err)
+		return err
+	}
+	titleLanguage, includeTitles, err := args.GetTitleLanguage()
+	if err != nil {
+		slog.Error("Failed to parse episode title language", "error", err)
+		return err
+	}
+	template, err := args.GetNamingTemplate()
+	if err != nil {
+		slog.Error("Failed to parse naming template", "error", err)
+		return err
+	}
+
 	dl, err := downloaders.GetDownloader(args.Url)
 	if err != nil {
 		slog.Error("Failed to get downloader", "error", err)
@@ -178,21 +275,32 @@ func handleSeriesDownload(ctx context.Context, args *cli.Args, d *download.Downl
 	}
 	slog.Info("Series", "title", info.Title)
 
+	// Templates with folders of their own already keep the series apart
+	seriesDir := filepath.Join(saveDir, template.SeriesFolder(info.Title))
+
 	// maybe make this an option, idk.
 	if args.QueueFile != "" {
 		slog.Debug("Queue file there, doing special stuff")
-		folderName := utils.CleanFolderName(info.Title)
-		saveDir = filepath.Join(saveDir, folderName)
-		slog.Info("Saving to", "directory", saveDir)
+		if !template.HasFolder() {
+			saveDir = filepath.Join(saveDir, seriesFolder(saveDir, info.Title))
+			seriesDir = saveDir
+		}
+		slog.Info("Saving to", "directory", seriesDir)
 
-		if err := os.MkdirAll(saveDir, 0755); err != nil {
-			slog.Error("Failed to create save directory", "error", err, "path", saveDir)
+		if err := os.MkdirAll(seriesDir, 0755); err != nil {
+			slog.Error("Failed to create save directory", "error", err, "path", seriesDir)
 			return err
 		}
 
+		if args.Nfo {
+			writeSeriesMetadata(ctx, d, seriesDir, info)
+		}
 	}
 
-	manager := download.NewDownloadManager(d, args.ConcurrentDownloads, saveDir, *info, args.SkipExisting)
+	library := newLibrary(args, saveDir, seriesDir, template)
+	manager := download.NewDownloadManager(d, args.ConcurrentDownloads, library, *info, args.SkipExisting)
+	manager.SetWriteNfo(args.Nfo)
+	manager.SetIncludeTitles(includeTitles)
 	taskChan := make(chan *downloaders.DownloadTaskWrapper, 50)
 
 	// Start manager in background
@@ -209,8 +317,7 @@ func handleSeriesDownload(ctx context.Context, args *cli.Args, d *download.Downl
 	go func() {
 		for tw := range taskChan {
 			manager.Submit(download.ManagerTask{
-				DownloadUrl: tw.Url,
-				Referer:     tw.Referer,
+				Candidates:  tw.Candidates,
 				VideoType:   tw.Lang,
 				EpisodeInfo: tw.Episode,
 			})
@@ -223,35 +330,25 @@ func handleSeriesDownload(ctx context.Context, args *cli.Args, d *download.Downl
 		wg.Wait()
 	}()
 
-	seriesNameForCache := download.PrepareSeriesNameForFile(info.Title)
-	cache, _ := download.NewDirectoryCache(saveDir)
-
 	settings := downloaders.DownloadSettings{
 		SkipExisting: args.SkipExisting,
-		CheckIfExists: func(season, episode, maxEpisodes uint32, videoType *downloaders.VideoType) bool {
-			if !args.SkipExisting || cache == nil {
-				return false
-			}
-
-			// If videoType is nil, check by prefix using a dummy videoType and trimming it
-			if videoType == nil {
-				epInfo := downloaders.EpisodeInfo{Season: season, Episode: episode, MaxEpisodes: maxEpisodes}
-				// We build the name with no videoType and no title for a clean prefix
-				prefix := download.GetEpisodeName(seriesNameForCache, nil, &epInfo, false)
-				return cache.HasPrefix(prefix)
-			}
-
-			epInfo := downloaders.EpisodeInfo{Season: season, Episode: episode, MaxEpisodes: maxEpisodes}
-			outputName := download.GetEpisodeName(seriesNameForCache, videoType, &epInfo, false)
-			return cache.CheckIfEpisodeExists(outputName)
+		Retry:        retryPolicy,
+		Scheduler:    scheduler,
+		CheckIfExists: func(episode downloaders.EpisodeInfo, videoType *downloaders.VideoType) bool {
+			// Without a video type, any version of the episode counts. The title isn't loaded yet, so any title counts
+			return library.Exists(download.EpisodeFields(info.Title, videoType, &episode, true))
 		},
 	}
 
 	req := downloaders.DownloadRequest{
-		Url:           args.Url,
-		SaveDirectory: saveDir,
-		SeriesTitle:   info.Title,
-		// Other fields like language selection could be added to CLI args
+		Url:                 args.Url,
+		SaveDirectory:       saveDir,
+		SeriesTitle:         info.Title,
+		Language:            videoType,
+		Episodes:            episodes,
+		ExtractorPriorities: priorities,
+		TitleLanguage:       titleLanguage,
+		AbsoluteNumbers:     template.HasField("absolute"),
 	}
 
 	slog.Info("Starting scrape...")
@@ -265,12 +362,84 @@ func handleSeriesDownload(ctx context.Context, args *cli.Args, d *download.Downl
 	return managerErr
 }
 
-func handleSingleDownload(ctx context.Context, args *cli.Args, d *download.Downloader, cm *chrome.ChromeManager, saveDir string) error {
+// newLibrary returns where the episodes go. With --season-folders or --movies-folder the films, which the sites
+// list as season 0, are named as films next to the episodes or saved below the movies folder.
+func newLibrary(args *cli.Args, saveDir, seriesDir string, template *naming.Template) *download.Library {
+	if args.SeasonFolders {
+		template = template.WithSeasonFolders()
+	}
+	library := download.NewLibrary(saveDir, template)
+
+	switch {
+	case args.MoviesFolder != "":
+		library.SetFilms(args.MoviesFolder, naming.MustParse(naming.FilmFolderTemplate))
+	// Films have no absolute number, with the episode template they would all get the same name
+	case args.SeasonFolders, template.HasField("absolute"):
+		library.SetFilms(seriesDir, naming.MustParse(naming.FilmTemplate))
+	}
+	return library
+}
+
+// seriesFolder returns the name of the series folder in queue mode. Earlier versions dropped the characters
+// naming.Sanitize replaces, so an existing folder with such a name is kept.
+func seriesFolder(saveDir, title string) string {
+	name := naming.Sanitize(title)
+	legacy := utils.CleanFolderName(title)
+	if legacy == name {
+		return name
+	}
+	if _, err := os.Stat(filepath.Join(saveDir, name)); err == nil {
+		return name
+	}
+	if _, err := os.Stat(filepath.Join(saveDir, legacy)); err == nil {
+		slog.Debug("Using the series folder of an earlier version", "folder", legacy)
+		return legacy
+	}
+	return name
+}
+
+// writeSeriesMetadata writes tvshow.nfo into the series folder and downloads the artwork that isn't there yet.
+// Without them media servers only miss some details, so failures don't stop the download.
+func writeSeriesMetadata(ctx context.Context, d *download.Downloader, dir string, info *downloaders.SeriesInfo) {
+	if err := nfo.WriteTVShow(dir, *info); err != nil {
+		slog.Warn("Failed to write "+nfo.TVShowFile, "error", err)
+	}
+
+	artwork := []struct{ name, url string }{
+		{"poster.jpg", info.PosterUrl},
+		{"fanart.jpg", info.FanartUrl},
+	}
+	for _, image := range artwork {
+		path := filepath.Join(dir, image.name)
+		if image.url == "" {
+			slog.Debug("Series page has no artwork", "file", image.name)
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+
+		task := download.NewDownloadTask(path, image.url).
+			SetCustomMessage("Downloading " + image.name)
+		task.OutputPathHasExtension = true
+
+		if err := d.DownloadToFile(ctx, task); err != nil {
+			slog.Warn("Failed to download artwork", "file", image.name, "error", err)
+		}
+	}
+}
+
+func handleSingleDownload(ctx context.Context, args *cli.Args, d *download.Downloader, cm *chrome.ChromeManager, saveDir string, retryPolicy *retry.Policy) error {
 	slog.Info("Extracting video URL...", "url", args.Url)
 
 	// If it needs chrome (complex extractors), we would handle that here.
 	// For simple extractors like Vidoza:
-	ext, err := extractors.ExtractVideoUrl(ctx, args.Url, "", "")
+	var ext *extractors.ExtractedVideo
+	err := retryPolicy.Do(ctx, "extract "+args.Url, func() error {
+		var err error
+		ext, err = extractors.ExtractVideoUrl(ctx, args.Url, "", "")
+		return err
+	})
 	if err != nil {
 		slog.Error("Failed to extract video URL", "error", err)
 		return err
@@ -285,7 +454,8 @@ func handleSingleDownload(ctx context.Context, args *cli.Args, d *download.Downl
 
 	task := download.NewDownloadTask(outputPath, ext.Url).
 		SetSkipExisting(args.SkipExisting).
-		SetReferer(ext.Referer)
+		SetReferer(ext.Referer).
+		SetVerify(true)
 
 	slog.Info("Starting download...", "url", ext.Url)
 	if err := d.DownloadToFile(ctx, task); err != nil {
@@ -2,9 +2,11 @@ package downloaders
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/url"
+	"path"
 	"regexp"
 	"sort"
 	"strconv"
@@ -12,6 +14,7 @@ import (
 	"time"
 
 	"github.com/bugmaschine/gad/internal/extractors"
+	"github.com/bugmaschine/gad/pkg/retry"
 	"github.com/chromedp/cdproto/cdp"
 	"github.com/chromedp/chromedp"
 )
@@ -68,10 +71,60 @@ func (a *AniWorldSerienStream) GetSeriesInfo(ctx context.Context) (*SeriesInfo,
 		title = strings.Title(strings.ReplaceAll(a.ParsedUrl.Name, "-", " "))
 	}
 
-	return &SeriesInfo{
+	info := &SeriesInfo{
 		Title:       strings.TrimSpace(title),
 		Description: strings.TrimSpace(description),
-	}, nil
+	}
+
+	// Details for the .nfo files, the series can be downloaded without them
+	var details seriesDetails
+	err = chromedp.Run(ctx,
+		chromedp.Evaluate(`
+			(() => {
+				const abs = u => u ? new URL(u, location.href).href : "";
+				const cover = document.querySelector(".seriesCoverBox img");
+				const backdrop = document.querySelector(".backdrop");
+				const background = backdrop ? getComputedStyle(backdrop).backgroundImage.match(/url\(["']?(.*?)["']?\)/) : null;
+				const description = document.querySelector("p.seri_des");
+				const startDate = document.querySelector('span[itemprop="startDate"]');
+				return {
+					plot: description ? description.getAttribute("data-full-description") || "" : "",
+					genres: Array.from(document.querySelectorAll('.genres li a[itemprop="genre"]')).map(a => a.innerText.trim()).filter(g => g),
+					startDate: startDate ? startDate.innerText.trim() : "",
+					poster: abs(cover ? cover.getAttribute("data-src") || cover.getAttribute("src") : ""),
+					fanart: abs(background ? background[1] : "")
+				};
+			})()
+		`, &details),
+	)
+	if err != nil {
+		slog.Debug("Failed to extract series details", "error", err)
+		return info, nil
+	}
+
+	// The meta description is cut off, the full one is only in the description paragraph
+	if plot := strings.TrimSpace(details.Plot); plot != "" {
+		info.Description = plot
+	}
+	info.Genres = details.Genres
+	info.PosterUrl = details.Poster
+	info.FanartUrl = details.Fanart
+	if year := yearRegex.FindString(details.StartDate); year != "" {
+		parsed, _ := strconv.ParseUint(year, 10, 32)
+		info.Year = uint32(parsed)
+	}
+	slog.Debug("Series details", "genres", info.Genres, "year", info.Year, "poster", info.PosterUrl, "fanart", info.FanartUrl)
+	return info, nil
+}
+
+var yearRegex = regexp.MustCompile(`\b(19|20)\d{2}\b`)
+
+type seriesDetails struct {
+	Plot      string   `json:"plot"`
+	Genres    []string `json:"genres"`
+	StartDate string   `json:"startDate"`
+	Poster    string   `json:"poster"`
+	Fanart    string   `json:"fanart"`
 }
 
 func (a *AniWorldSerienStream) Download(ctx context.Context, request DownloadRequest, settings DownloadSettings, sender chan<- *DownloadTaskWrapper) error {
@@ -91,6 +144,19 @@ const (
 	SiteSerienStream
 )
 
+// LanguagePreference returns the order in which languages are picked if the user didn't request a specific one.
+func (s Site) LanguagePreference() []VideoType {
+	gerDub := VideoType{Type: VideoTypeDub, Language: LanguageGerman}
+	gerSub := VideoType{Type: VideoTypeSub, Language: LanguageGerman}
+	engDub := VideoType{Type: VideoTypeDub, Language: LanguageEnglish}
+	engSub := VideoType{Type: VideoTypeSub, Language: LanguageEnglish}
+
+	if s == SiteAniWorld {
+		return []VideoType{gerDub, gerSub, engSub, engDub}
+	}
+	return []VideoType{gerDub, gerSub, engDub, engSub}
+}
+
 func (s Site) BaseURL() string {
 	if s == SiteAniWorld {
 		return "https://aniworld.to/anime/stream"
@@ -181,6 +247,11 @@ type Scraper struct {
 	Request   DownloadRequest
 	Settings  DownloadSettings
 	Sender    chan<- *DownloadTaskWrapper
+
+	// titles holds the episode titles of the scraped season pages, by season and episode
+	titles map[uint32]map[uint32]episodeTitles
+	// episodeCounts holds the highest episode number of the seasons that were loaded, for absolute numbering
+	episodeCounts map[uint32]uint32
 }
 
 func (s *Scraper) Scrape(ctx context.Context) error {
@@ -188,7 +259,12 @@ func (s *Scraper) Scrape(ctx context.Context) error {
 	case EpisodesRequestUnspecified:
 		if s.ParsedUrl.Season != nil {
 			if s.ParsedUrl.Season.HasEpisode {
-				return s.scrapeEpisode(ctx, s.ParsedUrl.Season.Season, s.ParsedUrl.Season.Episode, s.ParsedUrl.Season.Episode) // Max is itself for single episode
+				info := EpisodeInfo{Season: s.ParsedUrl.Season.Season, Episode: s.ParsedUrl.Season.Episode, MaxEpisodes: s.ParsedUrl.Season.Episode} // Max is itself for single episode
+				offset, err := s.seasonOffset(ctx, info.Season)
+				if err != nil {
+					return err
+				}
+				return s.scrapeEpisode(ctx, s.absolute(info, offset))
 			}
 			return s.scrapeSeason(ctx, s.ParsedUrl.Season.Season, AllOrSpecific{All: true})
 		}
@@ -201,24 +277,48 @@ func (s *Scraper) Scrape(ctx context.Context) error {
 		return s.scrapeSeason(ctx, season, s.Request.Episodes.Payload)
 	case EpisodesRequestSeasons:
 		return s.scrapeSeasons(ctx, s.Request.Episodes.Payload)
+	case EpisodesRequestSelectors:
+		return s.scrapeSelected(ctx, s.Request.Episodes.Selectors)
 	}
 	return nil
 }
 
 func (s *Scraper) scrapeSeasons(ctx context.Context, payload AllOrSpecific) error {
+	seasons, err := s.seasonNumbers(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, season := range seasons {
+		if s.shouldDownloadSeason(season, payload) {
+			slog.Debug("Queueing season for scraping", "season", season)
+			if err := s.scrapeSeason(ctx, season, AllOrSpecific{All: true}); err != nil {
+				slog.Error("Failed to scrape season", "season", season, "error", err)
+			}
+		} else {
+			slog.Debug("Skipping season due to filter", "season", season)
+		}
+	}
+	return nil
+}
+
+// seasonNumbers returns the seasons of the series in order, films are season 0.
+func (s *Scraper) seasonNumbers(ctx context.Context) ([]uint32, error) {
+	if err := s.navigate(ctx, s.ParsedUrl.GetEpisodeUrl(1, 1), `.hosterSiteDirectNav`, true); err != nil {
+		return nil, err
+	}
+
 	var nodes []*cdp.Node
 	err := chromedp.Run(ctx,
-		chromedp.Navigate(s.ParsedUrl.GetEpisodeUrl(1, 1)),
-		chromedp.WaitVisible(`.hosterSiteDirectNav`, chromedp.ByQuery),
 		chromedp.Nodes(`#stream > ul:first-of-type > li`, &nodes),
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var seasons []uint32
 	if len(nodes) == 0 {
-		return fmt.Errorf("no seasons found")
+		return nil, fmt.Errorf("no seasons found")
 	}
 
 	var seasonTexts []string
@@ -226,7 +326,7 @@ func (s *Scraper) scrapeSeasons(ctx context.Context, payload AllOrSpecific) erro
 		chromedp.Evaluate(`Array.from(document.querySelectorAll("#stream > ul:first-of-type > li")).map(li => li.innerText.trim())`, &seasonTexts),
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for _, t := range seasonTexts {
@@ -241,20 +341,175 @@ func (s *Scraper) scrapeSeasons(ctx context.Context, payload AllOrSpecific) erro
 	}
 	slog.Debug("Found seasons", "raw", seasonTexts, "parsed", seasons)
 	sort.Slice(seasons, func(i, j int) bool { return seasons[i] < seasons[j] })
+	return seasons, nil
+}
+
+// scrapeSelected scrapes the episodes the selectors pick, across all seasons.
+func (s *Scraper) scrapeSelected(ctx context.Context, selectors []EpisodeSelector) error {
+	seasons, err := s.seasonNumbers(ctx)
+	if err != nil {
+		return err
+	}
+
+	runs := make([]EpisodeSelector, 0, len(selectors))
+	for _, sel := range selectors {
+		switch {
+		case sel.Latest > 0:
+			from, err := s.latestStart(ctx, seasons, sel.Latest)
+			if err != nil {
+				return err
+			}
+			slog.Debug("Latest episodes start at", "season", from.Season, "episode", from.Episode)
+			runs = append(runs, EpisodeSelector{From: from})
+		case sel.New:
+			from, err := s.newStart(ctx, seasons)
+			if err != nil {
+				return err
+			}
+			slog.Debug("New episodes start at", "season", from.Season, "episode", from.Episode)
+			runs = append(runs, EpisodeSelector{From: from})
+		default:
+			runs = append(runs, sel)
+		}
+	}
 
 	for _, season := range seasons {
-		if s.shouldDownloadSeason(season, payload) {
-			slog.Debug("Queueing season for scraping", "season", season)
-			if err := s.scrapeSeason(ctx, season, AllOrSpecific{All: true}); err != nil {
-				slog.Error("Failed to scrape season", "season", season, "error", err)
+		var specific []Range
+		for _, run := range runs {
+			if r, ok := run.Range(season); ok {
+				specific = append(specific, r)
 			}
-		} else {
+		}
+		if len(specific) == 0 {
 			slog.Debug("Skipping season due to filter", "season", season)
+			continue
+		}
+
+		slog.Debug("Queueing season for scraping", "season", season, "episodes", specific)
+		if err := s.scrapeSeason(ctx, season, AllOrSpecific{Specific: specific}); err != nil {
+			slog.Error("Failed to scrape season", "season", season, "error", err)
 		}
 	}
 	return nil
 }
 
+// latestStart returns the first of the last n episodes of the series. Films don't count.
+func (s *Scraper) latestStart(ctx context.Context, seasons []uint32, n uint32) (EpisodePosition, error) {
+	from := EpisodePosition{Season: 1}
+	for i := len(seasons) - 1; i >= 0 && seasons[i] != 0; i-- {
+		episodes, err := s.seasonEpisodes(ctx, seasons[i])
+		if err != nil {
+			return EpisodePosition{}, err
+		}
+		if n <= uint32(len(episodes)) {
+			return EpisodePosition{Season: seasons[i], Episode: episodes[uint32(len(episodes))-n]}, nil
+		}
+		n -= uint32(len(episodes))
+		from = EpisodePosition{Season: seasons[i]}
+	}
+	return from, nil
+}
+
+// newStart returns the episode after the highest one that exists in any version. Everything is new if none of
+// them exists. Films don't count.
+func (s *Scraper) newStart(ctx context.Context, seasons []uint32) (EpisodePosition, error) {
+	if s.Settings.CheckIfExists == nil {
+		slog.Warn("Can't look for existing episodes, every episode counts as new")
+		return EpisodePosition{Season: 1}, nil
+	}
+
+	for i := len(seasons) - 1; i >= 0 && seasons[i] != 0; i-- {
+		season := seasons[i]
+		episodes, err := s.seasonEpisodes(ctx, season)
+		if err != nil {
+			return EpisodePosition{}, err
+		}
+		offset, err := s.seasonOffset(ctx, season)
+		if err != nil {
+			return EpisodePosition{}, err
+		}
+		for j := len(episodes) - 1; j >= 0; j-- {
+			info := s.absolute(EpisodeInfo{Season: season, Episode: episodes[j], MaxEpisodes: episodes[len(episodes)-1]}, offset)
+			if s.Settings.CheckIfExists(info, nil) {
+				slog.Info("Highest existing episode", "season", season, "episode", episodes[j])
+				return EpisodePosition{Season: season, Episode: episodes[j] + 1}, nil
+			}
+		}
+	}
+	return EpisodePosition{Season: 1}, nil
+}
+
+// exists reports whether the episode exists and should be skipped.
+func (s *Scraper) exists(info EpisodeInfo, videoType *VideoType) bool {
+	return s.Settings.SkipExisting && s.Settings.CheckIfExists != nil && s.Settings.CheckIfExists(info, videoType)
+}
+
+// navigate loads a page through the request scheduler and waits for the selector.
+// Block pages are backed off by the scheduler, other failures are retried by the retry policy.
+func (s *Scraper) navigate(ctx context.Context, url, waitSelector string, episodePage bool) error {
+	site := s.ParsedUrl.Site
+	return s.Settings.Retry.Do(ctx, "load "+url, func() error {
+		for blocked := 0; ; blocked++ {
+			// Only the first try counts against the episode budget
+			if err := s.Settings.Scheduler.Wait(ctx, site, episodePage && blocked == 0); err != nil {
+				return err
+			}
+
+			// Long timeout for potential challenges
+			navCtx, cancel := context.WithTimeout(ctx, 45*time.Second)
+			err := chromedp.Run(navCtx,
+				chromedp.Navigate(url),
+				chromedp.WaitVisible(waitSelector, chromedp.ByQuery),
+			)
+			cancel()
+			if err == nil {
+				s.Settings.Scheduler.Succeeded(site)
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			if !isBlockPage(ctx) {
+				// navigation errors are usually connection problems or a slow challenge page
+				return retry.Retryable(err)
+			}
+			if blocked >= maxBlockedPerPage {
+				return retry.Fatal(ErrBlocked)
+			}
+			if err := s.Settings.Scheduler.Blocked(ctx, site); err != nil {
+				return retry.Fatal(err)
+			}
+		}
+	})
+}
+
+// isBlockPage checks whether the current page is a ddos protection or rate limit page.
+func isBlockPage(ctx context.Context) bool {
+	checkCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var blocked bool
+	err := chromedp.Run(checkCtx,
+		chromedp.Evaluate(`
+			(() => {
+				const title = (document.title || "").toLowerCase();
+				const body = (document.body ? document.body.innerText : "").slice(0, 2000).toLowerCase();
+				return ["ddos-guard", "just a moment", "attention required", "too many requests", "access denied"].some(t => title.includes(t))
+					|| body.includes("checking your browser")
+					|| body.includes("too many requests");
+			})()
+		`, &blocked),
+	)
+	if err != nil {
+		return false
+	}
+	if blocked {
+		slog.Debug("Detected block page")
+	}
+	return blocked
+}
+
 func (s *Scraper) shouldDownloadSeason(season uint32, payload AllOrSpecific) bool {
 	if payload.All {
 		return true
@@ -268,30 +523,43 @@ func (s *Scraper) shouldDownloadSeason(season uint32, payload AllOrSpecific) boo
 }
 
 func (s *Scraper) scrapeSeason(ctx context.Context, season uint32, payload AllOrSpecific) error {
-	err := chromedp.Run(ctx,
-		chromedp.Navigate(s.ParsedUrl.GetSeasonUrl(season)),
-		chromedp.WaitVisible(`.hosterSiteDirectNav`, chromedp.ByQuery),
-	)
+	episodes, err := s.seasonEpisodes(ctx, season)
 	if err != nil {
 		return err
 	}
 
-	var episodeTexts []string
+	// The titles are nice to have, the episodes can be downloaded without them
+	var titles []episodeTitles
 	err = chromedp.Run(ctx,
-		chromedp.Evaluate(`Array.from(document.querySelectorAll("li > a[data-episode-id]")).map(a => a.innerText.trim())`, &episodeTexts),
+		chromedp.Evaluate(`
+			Array.from(document.querySelectorAll("table.seasonEpisodesList tbody tr")).map(tr => {
+				const number = tr.querySelector('meta[itemprop="episodeNumber"]');
+				const german = tr.querySelector("td.seasonEpisodeTitle strong");
+				const english = tr.querySelector("td.seasonEpisodeTitle span");
+				return {
+					episode: number ? number.getAttribute("content") || "" : "",
+					german: german ? german.innerText.trim() : "",
+					english: english ? english.innerText.trim() : ""
+				};
+			})
+		`, &titles),
 	)
 	if err != nil {
-		return err
+		slog.Debug("Failed to extract episode titles", "season", season, "error", err)
 	}
-
-	var episodes []uint32
-	for _, t := range episodeTexts {
-		num, err := strconv.ParseUint(t, 10, 32)
-		if err == nil {
-			episodes = append(episodes, uint32(num))
+	for _, t := range titles {
+		num, err := strconv.ParseUint(t.Episode, 10, 32)
+		if err != nil {
+			continue
+		}
+		if s.titles == nil {
+			s.titles = make(map[uint32]map[uint32]episodeTitles)
+		}
+		if s.titles[season] == nil {
+			s.titles[season] = make(map[uint32]episodeTitles)
 		}
+		s.titles[season][uint32(num)] = t
 	}
-	sort.Slice(episodes, func(i, j int) bool { return episodes[i] < episodes[j] })
 
 	// Find max episode for padding
 	var maxEpisodes uint32
@@ -300,16 +568,30 @@ func (s *Scraper) scrapeSeason(ctx context.Context, season uint32, payload AllOr
 			maxEpisodes = ep
 		}
 	}
+	// Loads the earlier season pages, so it has to happen before the episode pages
+	offset, err := s.seasonOffset(ctx, season)
+	if err != nil {
+		return err
+	}
+
+	// With a fully specified language we know the file name before visiting the episode page
+	var existsType *VideoType
+	if s.Request.Language.IsSpecific() {
+		existsType = &s.Request.Language
+	}
 
 	for _, episode := range episodes {
-		if s.Settings.CheckIfExists != nil && s.Settings.CheckIfExists(season, episode, maxEpisodes, nil) {
+		info := s.absolute(EpisodeInfo{Season: season, Episode: episode, MaxEpisodes: maxEpisodes}, offset)
+		if s.exists(info, existsType) {
 			slog.Info("Skipping episode because it already exists", "season", season, "episode", episode)
 			continue
 		}
 
 		if s.shouldDownloadEpisode(episode, payload) {
 			slog.Debug("Queueing episode for scraping", "season", season, "episode", episode)
-			if err := s.scrapeEpisode(ctx, season, episode, maxEpisodes); err != nil {
+			if err := s.scrapeEpisode(ctx, info); errors.Is(err, ErrLanguageNotAvailable) {
+				slog.Warn("Skipping episode", "season", season, "episode", episode, "reason", err)
+			} else if err != nil {
 				slog.Error("Failed to scrape episode", "season", season, "episode", episode, "error", err)
 			}
 		} else {
@@ -319,6 +601,69 @@ func (s *Scraper) scrapeSeason(ctx context.Context, season uint32, payload AllOr
 	return nil
 }
 
+// seasonEpisodes loads the season page and returns the numbers of its episodes in order.
+func (s *Scraper) seasonEpisodes(ctx context.Context, season uint32) ([]uint32, error) {
+	if err := s.navigate(ctx, s.ParsedUrl.GetSeasonUrl(season), `.hosterSiteDirectNav`, false); err != nil {
+		return nil, err
+	}
+
+	var episodeTexts []string
+	err := chromedp.Run(ctx,
+		chromedp.Evaluate(`Array.from(document.querySelectorAll("li > a[data-episode-id]")).map(a => a.innerText.trim())`, &episodeTexts),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var episodes []uint32
+	for _, t := range episodeTexts {
+		num, err := strconv.ParseUint(t, 10, 32)
+		if err == nil {
+			episodes = append(episodes, uint32(num))
+		}
+	}
+	sort.Slice(episodes, func(i, j int) bool { return episodes[i] < episodes[j] })
+
+	if s.episodeCounts == nil {
+		s.episodeCounts = make(map[uint32]uint32)
+	}
+	if len(episodes) > 0 {
+		s.episodeCounts[season] = episodes[len(episodes)-1]
+	}
+	return episodes, nil
+}
+
+// seasonOffset returns the number of episodes before the season for absolute numbering, 0 if the request doesn't
+// ask for it. The earlier seasons that weren't scraped yet are loaded to count their episodes. The highest episode
+// number of a season is used as its count, so the numbers don't change if an episode is missing on the site.
+func (s *Scraper) seasonOffset(ctx context.Context, season uint32) (uint32, error) {
+	if !s.Request.AbsoluteNumbers || season == 0 {
+		return 0, nil
+	}
+
+	var offset uint32
+	for earlier := uint32(1); earlier < season; earlier++ {
+		count, ok := s.episodeCounts[earlier]
+		if !ok {
+			slog.Debug("Counting episodes for absolute numbering", "season", earlier)
+			if _, err := s.seasonEpisodes(ctx, earlier); err != nil {
+				return 0, fmt.Errorf("failed to count the episodes of season %d for absolute numbering: %w", earlier, err)
+			}
+			count = s.episodeCounts[earlier]
+		}
+		offset += count
+	}
+	return offset, nil
+}
+
+// absolute sets the absolute number of the episode if the request asks for it. Films have none.
+func (s *Scraper) absolute(info EpisodeInfo, offset uint32) EpisodeInfo {
+	if s.Request.AbsoluteNumbers && info.Season != 0 {
+		info.Absolute = offset + info.Episode
+	}
+	return info
+}
+
 func (s *Scraper) shouldDownloadEpisode(episode uint32, payload AllOrSpecific) bool {
 	if payload.All {
 		return true
@@ -331,65 +676,99 @@ func (s *Scraper) shouldDownloadEpisode(episode uint32, payload AllOrSpecific) b
 	return false
 }
 
-func (s *Scraper) scrapeEpisode(ctx context.Context, season, episode, maxEpisodes uint32) error {
-	url := s.ParsedUrl.GetEpisodeUrl(season, episode)
+func (s *Scraper) scrapeEpisode(ctx context.Context, info EpisodeInfo) error {
+	url := s.ParsedUrl.GetEpisodeUrl(info.Season, info.Episode)
 	slog.Info("Navigating to episode page", "url", url)
 
-	// Long timeout for potential challenges
-	eCtx, cancel := context.WithTimeout(ctx, 45*time.Second)
-	defer cancel()
-
-	err := chromedp.Run(eCtx,
-		chromedp.Navigate(url),
-		chromedp.WaitVisible(`.changeLanguageBox`, chromedp.ByQuery),
-	)
+	err := s.navigate(ctx, url, `.changeLanguageBox`, true)
 	if err != nil {
 		return fmt.Errorf("failed to load episode page: %w", err)
 	}
 
-	var langInfo struct {
-		Key  string `json:"key"`
-		Type string `json:"type"`
-	}
-
+	var langImages []languageImage
 	err = chromedp.Run(ctx,
 		chromedp.Evaluate(`
-			(() => {
-				const imgs = Array.from(document.querySelectorAll('div.changeLanguageBox img'));
-				// Priority: Dub (German without "Untertitel"), then Sub (German with "Untertitel")
-				const sub = imgs.find(img => (img.title || img.alt || "").includes("Untertitel"));
-				const dub = imgs.find(img => (img.title || img.alt || "").includes("Deutsch") && !(img.title || img.alt || "").includes("Untertitel"));
-				
-				if (dub) return {key: dub.getAttribute("data-lang-key"), type: "dub"};
-				if (sub) return {key: sub.getAttribute("data-lang-key"), type: "sub"};
-				return null;
-			})()
-		`, &langInfo),
+			Array.from(document.querySelectorAll('div.changeLanguageBox img')).map(img => ({
+				key: img.getAttribute("data-lang-key") || "",
+				src: img.getAttribute("src") || "",
+				title: img.title || img.alt || ""
+			}))
+		`, &langImages),
 	)
-	if err != nil || langInfo.Key == "" {
+	if err != nil {
+		return fmt.Errorf("failed to find language info: %w", err)
+	}
+
+	available := make(map[VideoType]string)
+	for _, img := range langImages {
+		vt, ok := parseLanguageImage(img.Src, img.Title)
+		if !ok || img.Key == "" {
+			slog.Debug("Unknown language", "key", img.Key, "src", img.Src, "title", img.Title)
+			continue
+		}
+		if _, exists := available[vt]; !exists {
+			available[vt] = img.Key
+		}
+	}
+	if len(available) == 0 {
 		return fmt.Errorf("failed to find language info")
 	}
-	slog.Debug("Found language info", "key", langInfo.Key, "type", langInfo.Type)
 
-	var videoType VideoType
-	if langInfo.Type == "dub" {
-		videoType = VideoType{Type: VideoTypeDub, Language: LanguageGerman}
-	} else {
-		videoType = VideoType{Type: VideoTypeSub, Language: LanguageGerman}
+	videoType, langKey, ok := selectLanguage(available, s.Request.Language, s.ParsedUrl.Site.LanguagePreference())
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrLanguageNotAvailable, describeVideoType(s.Request.Language))
 	}
+	slog.Debug("Selected language", "key", langKey, "type", videoType, "available", len(available))
 
-	if s.Settings.CheckIfExists != nil && s.Settings.CheckIfExists(season, episode, maxEpisodes, &videoType) {
-		slog.Info("Skipping episode because it already exists", "season", season, "episode", episode)
+	if s.exists(info, &videoType) {
+		slog.Info("Skipping episode because it already exists", "season", info.Season, "episode", info.Episode)
 		return nil
 	}
-	return s.sendStreamToDownloader(ctx, season, episode, maxEpisodes, langInfo.Key, videoType)
+	info.Title = s.episodeTitle(ctx, info.Season, info.Episode)
+	return s.sendStreamToDownloader(ctx, info, langKey, videoType)
+}
+
+// episodeTitles are the titles of an episode, either of them can be empty.
+type episodeTitles struct {
+	Episode string `json:"episode"`
+	German  string `json:"german"`
+	English string `json:"english"`
 }
 
-func (s *Scraper) sendStreamToDownloader(ctx context.Context, season, episode, maxEpisodes uint32, langKey string, videoType VideoType) error {
-	var streams []struct {
-		Name string `json:"name"`
-		Href string `json:"href"`
+// pick returns the title in the language, or the other one if there is none in it. German is the default.
+func (t episodeTitles) pick(lang Language) string {
+	if lang == LanguageEnglish && t.English != "" || t.German == "" {
+		return t.English
 	}
+	return t.German
+}
+
+// episodeTitle returns the title of an episode in the requested language. Episodes that weren't listed
+// on a season page, like the ones of episode URLs, take it from the title of the current episode page.
+func (s *Scraper) episodeTitle(ctx context.Context, season, episode uint32) string {
+	titles, ok := s.titles[season][episode]
+	if !ok {
+		err := chromedp.Run(ctx,
+			chromedp.Evaluate(`
+				(() => {
+					const german = document.querySelector(".hosterSiteTitle .episodeGermanTitle");
+					const english = document.querySelector(".hosterSiteTitle .episodeEnglishTitle");
+					return {
+						german: german ? german.innerText.trim() : "",
+						english: english ? english.innerText.trim() : ""
+					};
+				})()
+			`, &titles),
+		)
+		if err != nil {
+			slog.Debug("Failed to extract episode title", "season", season, "episode", episode, "error", err)
+		}
+	}
+	return titles.pick(s.Request.TitleLanguage)
+}
+
+func (s *Scraper) sendStreamToDownloader(ctx context.Context, info EpisodeInfo, langKey string, videoType VideoType) error {
+	var streams []hosterLink
 
 	err := chromedp.Run(ctx,
 		chromedp.Evaluate(fmt.Sprintf(`
@@ -410,6 +789,29 @@ func (s *Scraper) sendStreamToDownloader(ctx context.Context, season, episode, m
 	}
 	base, _ := url.Parse(currentUrl)
 
+	streams = orderHosters(streams, s.Request.ExtractorPriorities)
+	if len(streams) == 0 {
+		return fmt.Errorf("no hoster left after applying extractor priorities")
+	}
+
+	candidates := s.extractCandidates(ctx, streams, base, currentUrl)
+	if len(candidates) == 0 {
+		return fmt.Errorf("no valid hoster found")
+	}
+
+	slog.Debug("Extracted stream candidates", "season", info.Season, "episode", info.Episode, "count", len(candidates))
+	s.Sender <- &DownloadTaskWrapper{
+		Episode:    info,
+		Lang:       videoType,
+		Candidates: candidates,
+	}
+	return nil
+}
+
+// extractCandidates extracts the video of every hoster, keeping their order. A hoster that fails for good, or still
+// fails after its retries, is left out, so the download falls back to the next one.
+func (s *Scraper) extractCandidates(ctx context.Context, streams []hosterLink, base *url.URL, referer string) []StreamCandidate {
+	var candidates []StreamCandidate
 	for _, stream := range streams {
 		rel, err := url.Parse(stream.Href)
 		if err != nil {
@@ -421,19 +823,117 @@ func (s *Scraper) sendStreamToDownloader(ctx context.Context, season, episode, m
 		slog.Info("Trying hoster", "name", stream.Name, "url", absoluteUrl)
 
 		// Try to extract
-		extracted, err := extractors.ExtractVideoUrlWithExtractor(ctx, absoluteUrl, stream.Name, "", currentUrl)
+		var extracted *extractors.ExtractedVideo
+		err = s.Settings.Retry.Do(ctx, "extract "+stream.Name, func() error {
+			var extractErr error
+			extracted, extractErr = extractors.ExtractVideoUrlWithExtractor(ctx, absoluteUrl, stream.Name, "", referer)
+			return extractErr
+		})
+		if err != nil {
+			slog.Debug("Hoster failed", "name", stream.Name, "error", err)
+		}
 		if err == nil && extracted != nil {
-			s.Sender <- &DownloadTaskWrapper{
-				Episode: EpisodeInfo{Season: season, Episode: episode, MaxEpisodes: maxEpisodes},
-				Lang:    videoType,
+			candidates = append(candidates, StreamCandidate{
+				Hoster:  stream.Name,
 				Url:     extracted.Url,
 				Referer: extracted.Referer,
-			}
-			return nil
+			})
 		}
 	}
+	return candidates
+}
+
+var ErrLanguageNotAvailable = errors.New("requested language not available")
 
-	return fmt.Errorf("no valid hoster found")
+type languageImage struct {
+	Key   string `json:"key"`
+	Src   string `json:"src"`
+	Title string `json:"title"`
+}
+
+// languageFlags maps the flag images of the language box, named after the audio and the subtitles, to video types.
+// Subbed versions keep the original audio, which is English on s.to.
+var languageFlags = map[string]VideoType{
+	"german":           {Type: VideoTypeDub, Language: LanguageGerman},
+	"english":          {Type: VideoTypeDub, Language: LanguageEnglish},
+	"japanese-german":  {Type: VideoTypeSub, Language: LanguageGerman},
+	"japanese-english": {Type: VideoTypeSub, Language: LanguageEnglish},
+	"english-german":   {Type: VideoTypeSub, Language: LanguageGerman},
+}
+
+// parseLanguageImage maps a flag of the language box to a video type,
+// by its image (e.g. /public/img/japanese-german.svg) or its title (e.g. "mit Untertitel Deutsch").
+func parseLanguageImage(src, title string) (VideoType, bool) {
+	src = strings.ToLower(path.Base(src))
+	title = strings.ToLower(title)
+
+	if vt, ok := languageFlags[strings.TrimSuffix(src, path.Ext(src))]; ok {
+		return vt, true
+	}
+
+	isSub := strings.Contains(title, "untertitel")
+	switch {
+	case strings.Contains(title, "deutsch") && isSub:
+		return VideoType{Type: VideoTypeSub, Language: LanguageGerman}, true
+	case strings.Contains(title, "englisch") && isSub:
+		return VideoType{Type: VideoTypeSub, Language: LanguageEnglish}, true
+	case strings.Contains(title, "deutsch"):
+		return VideoType{Type: VideoTypeDub, Language: LanguageGerman}, true
+	case strings.Contains(title, "englisch"):
+		return VideoType{Type: VideoTypeDub, Language: LanguageEnglish}, true
+	}
+
+	return VideoType{}, false
+}
+
+// selectLanguage picks the first video type of the preference chain that is available and matches the request.
+func selectLanguage(available map[VideoType]string, requested VideoType, preference []VideoType) (VideoType, string, bool) {
+	for _, vt := range preference {
+		key, ok := available[vt]
+		if ok && requested.Matches(vt) {
+			return vt, key, true
+		}
+	}
+	return VideoType{}, "", false
+}
+
+func describeVideoType(vt VideoType) string {
+	if vt.Type == VideoTypeUnspecified {
+		return vt.Language.GetNameLong()
+	}
+	return vt.String()
+}
+
+type hosterLink struct {
+	Name string `json:"name"`
+	Href string `json:"href"`
+}
+
+// orderHosters sorts the hosters by extractor priority and drops the excluded ones.
+// Hosters with the same priority keep their order from the page.
+func orderHosters(streams []hosterLink, priorities []ExtractorMatch) []hosterLink {
+	type ranked struct {
+		link hosterLink
+		rank int
+	}
+
+	var kept []ranked
+	for _, stream := range streams {
+		rank, ok := ExtractorRank(stream.Name, priorities)
+		if !ok {
+			slog.Debug("Skipping hoster due to extractor priorities", "name", stream.Name)
+			continue
+		}
+		kept = append(kept, ranked{link: stream, rank: rank})
+	}
+
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].rank < kept[j].rank })
+
+	ordered := make([]hosterLink, 0, len(kept))
+	for _, k := range kept {
+		ordered = append(ordered, k.link)
+	}
+	return ordered
 }
 
 func init() {
@@ -0,0 +1,34 @@
+package downloaders
+
+import "testing"
+
+func TestParseLanguageImage(t *testing.T) {
+	gerDub := VideoType{Type: VideoTypeDub, Language: LanguageGerman}
+	engDub := VideoType{Type: VideoTypeDub, Language: LanguageEnglish}
+	gerSub := VideoType{Type: VideoTypeSub, Language: LanguageGerman}
+	engSub := VideoType{Type: VideoTypeSub, Language: LanguageEnglish}
+	tests := []struct {
+		src   string
+		title string
+		want  VideoType
+		ok    bool
+	}{
+		{"/public/img/german.svg", "Deutsch", gerDub, true},
+		{"/public/img/english.svg", "Englisch", engDub, true},
+		{"/public/img/japanese-german.svg", "mit Untertitel Deutsch", gerSub, true},
+		{"/public/img/japanese-english.svg", "mit Untertitel Englisch", engSub, true},
+		// s.to: English audio with German subtitles
+		{"/public/img/english-german.svg", "Englisch mit Untertitel Deutsch", gerSub, true},
+		{"/public/img/English-German.SVG", "", gerSub, true},
+		// Unknown images fall back to the title
+		{"/public/img/flag.png", "mit Untertitel Deutsch", gerSub, true},
+		{"/public/img/flag.png", "Englisch", engDub, true},
+		{"/public/img/flag.png", "", VideoType{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseLanguageImage(tt.src, tt.title)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s %q: got %v %v, want %v %v", tt.src, tt.title, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package downloaders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bugmaschine/gad/internal/extractors"
+	"github.com/bugmaschine/gad/pkg/retry"
+)
+
+func TestExtractorRank(t *testing.T) {
+	vidoza := ExtractorMatch{Name: "vidoza"}
+	noStreamtape := ExtractorMatch{Name: "streamtape", Excluded: true}
+	wildcard := ExtractorMatch{Any: true}
+	tests := []struct {
+		priorities []ExtractorMatch
+		hoster     string
+		rank       int
+		ok         bool
+	}{
+		{nil, "Voe", 0, true},
+		{[]ExtractorMatch{vidoza, wildcard}, "Vidoza", 0, true},
+		{[]ExtractorMatch{vidoza, wildcard}, "Voe", 1, true},
+		{[]ExtractorMatch{wildcard, vidoza}, "Vidoza", 1, true},
+		{[]ExtractorMatch{vidoza}, "Voe", 0, false},
+		{[]ExtractorMatch{vidoza, wildcard, noStreamtape}, "Streamtape", 0, false},
+		// A list that only excludes keeps every other hoster
+		{[]ExtractorMatch{noStreamtape}, "Voe", 1, true},
+		{[]ExtractorMatch{noStreamtape}, "Streamtape", 0, false},
+		// Filemoon is also called MoonF on the sites
+		{[]ExtractorMatch{{Name: "filemoon"}}, "MoonF", 0, true},
+	}
+	for _, tt := range tests {
+		rank, ok := ExtractorRank(tt.hoster, tt.priorities)
+		if rank != tt.rank || ok != tt.ok {
+			t.Errorf("%s in %+v: got %d %v, want %d %v", tt.hoster, tt.priorities, rank, ok, tt.rank, tt.ok)
+		}
+	}
+}
+
+func TestOrderHosters(t *testing.T) {
+	streams := []hosterLink{{Name: "VOE"}, {Name: "Streamtape"}, {Name: "Vidoza"}, {Name: "Doodstream"}}
+	tests := []struct {
+		priorities []ExtractorMatch
+		want       []string
+	}{
+		{nil, []string{"VOE", "Streamtape", "Vidoza", "Doodstream"}},
+		{[]ExtractorMatch{{Name: "vidoza"}, {Any: true}}, []string{"Vidoza", "VOE", "Streamtape", "Doodstream"}},
+		{[]ExtractorMatch{{Name: "streamtape", Excluded: true}}, []string{"VOE", "Vidoza", "Doodstream"}},
+		{[]ExtractorMatch{{Name: "doodstream"}, {Name: "voe"}}, []string{"Doodstream", "VOE"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, stream := range orderHosters(streams, tt.priorities) {
+			got = append(got, stream.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: got %v, want %v", tt.priorities, got, tt.want)
+		}
+	}
+}
+
+// fakeExtractor fails its first fails calls with err, then extracts a video.
+type fakeExtractor struct {
+	name  string
+	err   error
+	fails int
+	calls int
+}
+
+func (f *fakeExtractor) Names() []string                         { return []string{f.name} }
+func (f *fakeExtractor) SupportedFrom() extractors.SupportedFrom { return extractors.SupportedFromUrl }
+func (f *fakeExtractor) SupportsUrl(string) bool                 { return false }
+
+func (f *fakeExtractor) ExtractVideoUrl(_ context.Context, source extractors.ExtractFrom) (*extractors.ExtractedVideo, error) {
+	f.calls++
+	fakeCalls = append(fakeCalls, f.name)
+	if f.calls <= f.fails {
+		return nil, f.err
+	}
+	return &extractors.ExtractedVideo{Url: "https://video.example/" + f.name, Referer: source.Url}, nil
+}
+
+var (
+	fakeHosters = []*fakeExtractor{
+		{name: "FakeWorking"},
+		{name: "FakeDown", err: retry.Retryable(errors.New("timeout")), fails: math.MaxInt},
+		{name: "FakeFlaky", err: retry.Retryable(errors.New("timeout")), fails: 1},
+		{name: "FakeRemoved", err: retry.Fatal(errors.New("video removed")), fails: math.MaxInt},
+	}
+	fakeCalls []string
+)
+
+func init() {
+	for _, fake := range fakeHosters {
+		extractors.Register(fake)
+	}
+}
+
+func TestExtractCandidates(t *testing.T) {
+	fakeCalls = nil
+	var streams []hosterLink
+	for i, fake := range fakeHosters {
+		fake.calls = 0
+		streams = append(streams, hosterLink{Name: fake.name, Href: fmt.Sprintf("/redirect/%d", i)})
+	}
+	priorities := []ExtractorMatch{{Name: "fakeremoved"}, {Name: "fakeflaky"}, {Name: "fakedown"}, {Any: true}}
+	base, _ := url.Parse("https://aniworld.to/anime/stream/show/staffel-1/episode-1")
+	s := &Scraper{Settings: DownloadSettings{Retry: &retry.Policy{Retries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}}}
+
+	candidates := s.extractCandidates(context.Background(), orderHosters(streams, priorities), base, base.String())
+
+	// A fatal error skips the hoster at once, a retryable one is retried until the retries run out
+	wantCalls := []string{"FakeRemoved", "FakeFlaky", "FakeFlaky", "FakeDown", "FakeDown", "FakeDown", "FakeWorking"}
+	if !reflect.DeepEqual(fakeCalls, wantCalls) {
+		t.Errorf("calls: got %v, want %v", fakeCalls, wantCalls)
+	}
+	want := []StreamCandidate{
+		{Hoster: "FakeFlaky", Url: "https://video.example/FakeFlaky", Referer: "https://aniworld.to/redirect/2"},
+		{Hoster: "FakeWorking", Url: "https://video.example/FakeWorking", Referer: "https://aniworld.to/redirect/0"},
+	}
+	if !reflect.DeepEqual(candidates, want) {
+		t.Errorf("candidates: got %+v, want %+v", candidates, want)
+	}
+}
@@ -0,0 +1,133 @@
+package downloaders
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// blockedBaseWait is used as first backoff when blocked, if no ddos wait is configured.
+	blockedBaseWait = 30 * time.Second
+	blockedMaxWait  = 15 * time.Minute
+	// maxBlockedPerPage is how often we back off before giving up on a page.
+	maxBlockedPerPage = 6
+)
+
+var ErrBlocked = errors.New("blocked by site")
+
+// RequestScheduler spaces out navigations per site, so long queue runs don't trigger the ddos protection.
+// It is meant to be shared between series, so the budget carries over in queue mode.
+// A nil *RequestScheduler never waits.
+type RequestScheduler struct {
+	mu           sync.Mutex
+	waitEpisodes uint32
+	wait         time.Duration
+	sites        map[Site]*siteBudget
+	// sleep pauses for the duration or until the context is done
+	sleep func(context.Context, time.Duration) error
+}
+
+type siteBudget struct {
+	mu           sync.Mutex
+	episodePages uint32
+	blocked      int
+}
+
+func NewRequestScheduler(waitEpisodes, waitMs uint32) *RequestScheduler {
+	return &RequestScheduler{
+		waitEpisodes: waitEpisodes,
+		wait:         time.Duration(waitMs) * time.Millisecond,
+		sites:        make(map[Site]*siteBudget),
+		sleep:        sleep,
+	}
+}
+
+func (r *RequestScheduler) budget(site Site) *siteBudget {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.sites[site]
+	if !ok {
+		b = &siteBudget{}
+		r.sites[site] = b
+	}
+	return b
+}
+
+// Wait is called before every navigation. After every waitEpisodes episode pages it pauses for the configured time.
+func (r *RequestScheduler) Wait(ctx context.Context, site Site, episodePage bool) error {
+	if r == nil || !episodePage || r.waitEpisodes == 0 || r.wait <= 0 {
+		return nil
+	}
+
+	b := r.budget(site)
+	// Holding the lock while sleeping makes concurrent scrapers of the same site wait as well
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.episodePages >= r.waitEpisodes {
+		slog.Info("Waiting to avoid rate limiting", "duration", r.wait, "episodes", b.episodePages)
+		if err := r.sleep(ctx, r.wait); err != nil {
+			return err
+		}
+		b.episodePages = 0
+	}
+	b.episodePages++
+	return nil
+}
+
+// Blocked is called when a block page was detected. It waits longer each time the site blocks us in a row,
+// also across pages, until a page loads fine again.
+func (r *RequestScheduler) Blocked(ctx context.Context, site Site) error {
+	if r == nil {
+		return ErrBlocked
+	}
+
+	b := r.budget(site)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.blocked++
+
+	wait := r.wait
+	if wait <= 0 {
+		wait = blockedBaseWait
+	}
+	for i := 1; i < b.blocked && wait < blockedMaxWait; i++ {
+		wait *= 2
+	}
+	wait = min(wait, blockedMaxWait)
+
+	slog.Warn("Blocked by site, backing off", "duration", wait, "times", b.blocked)
+	if err := r.sleep(ctx, wait); err != nil {
+		return err
+	}
+	// Start a fresh budget after the pause
+	b.episodePages = 0
+	return nil
+}
+
+// Succeeded resets the block backoff after a page loaded fine.
+func (r *RequestScheduler) Succeeded(site Site) {
+	if r == nil {
+		return
+	}
+
+	b := r.budget(site)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.blocked = 0
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,87 @@
+package downloaders
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRequestScheduler(t *testing.T) {
+	// Steps: e is an episode page, p another page, b a block page and s a page that loaded fine.
+	// Upper case letters are requests to the other site.
+	tests := []struct {
+		name         string
+		waitEpisodes uint32
+		waitMs       uint32
+		steps        string
+		want         []time.Duration
+	}{
+		{"budget", 2, 1000, "eeeee", []time.Duration{time.Second, time.Second}},
+		{"other pages are free", 2, 1000, "epepep", []time.Duration{time.Second}},
+		{"no budget", 0, 1000, "eeeee", nil},
+		{"sites have their own budget", 2, 1000, "eeEEe", []time.Duration{time.Second}},
+		{"backoff", 2, 0, "bbb", []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute}},
+		{"backoff starts at the wait", 2, 1000, "bb", []time.Duration{time.Second, 2 * time.Second}},
+		{"backoff is capped", 2, 0, "bbbbbbb", []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 15 * time.Minute, 15 * time.Minute}},
+		{"success resets the backoff", 2, 0, "bbsb", []time.Duration{30 * time.Second, time.Minute, 30 * time.Second}},
+		{"sites are blocked apart", 2, 0, "bbB", []time.Duration{30 * time.Second, time.Minute, 30 * time.Second}},
+		{"backoff resets the budget", 2, 1000, "eebee", []time.Duration{time.Second}},
+	}
+	for _, tt := range tests {
+		r := NewRequestScheduler(tt.waitEpisodes, tt.waitMs)
+		var waits []time.Duration
+		r.sleep = func(_ context.Context, d time.Duration) error {
+			waits = append(waits, d)
+			return nil
+		}
+
+		ctx := context.Background()
+		for _, step := range tt.steps {
+			site := SiteAniWorld
+			if step >= 'A' && step <= 'Z' {
+				site, step = SiteSerienStream, step-'A'+'a'
+			}
+			var err error
+			switch step {
+			case 'e', 'p':
+				err = r.Wait(ctx, site, step == 'e')
+			case 'b':
+				err = r.Blocked(ctx, site)
+			case 's':
+				r.Succeeded(site)
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		if !reflect.DeepEqual(waits, tt.want) {
+			t.Errorf("%s: waited %v, want %v", tt.name, waits, tt.want)
+		}
+	}
+}
+
+func TestRequestSchedulerCancel(t *testing.T) {
+	r := NewRequestScheduler(1, 60000)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := r.Wait(ctx, SiteAniWorld, true); err != nil {
+		t.Fatalf("the first page shouldn't wait: %v", err)
+	}
+	if err := r.Wait(ctx, SiteAniWorld, true); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait() = %v, want the context error", err)
+	}
+	if err := r.Blocked(ctx, SiteAniWorld); !errors.Is(err, context.Canceled) {
+		t.Errorf("Blocked() = %v, want the context error", err)
+	}
+
+	var none *RequestScheduler
+	if err := none.Wait(ctx, SiteAniWorld, true); err != nil {
+		t.Errorf("a nil scheduler waited: %v", err)
+	}
+	if err := none.Blocked(ctx, SiteAniWorld); !errors.Is(err, ErrBlocked) {
+		t.Errorf("a nil scheduler should give up when blocked, got %v", err)
+	}
+}
@@ -3,6 +3,11 @@ package downloaders
 import (
 	"context"
 	"fmt"
+	"math"
+	"strings"
+
+	"github.com/bugmaschine/gad/internal/extractors"
+	"github.com/bugmaschine/gad/pkg/retry"
 )
 
 type Language int
@@ -35,6 +40,27 @@ func (l Language) GetNameLong() string {
 	}
 }
 
+// ISO6392 returns the ISO 639-2 code of the language, as used to tag media streams. It is "" if the language is unspecified.
+func (l Language) ISO6392() string {
+	switch l {
+	case LanguageEnglish:
+		return "eng"
+	case LanguageGerman:
+		return "deu"
+	default:
+		return ""
+	}
+}
+
+// AudioLanguage returns the language of the audio. Only dubs are known to have it, the audio of
+// subbed versions is in the original language.
+func (vt VideoType) AudioLanguage() Language {
+	if vt.Type == VideoTypeDub {
+		return vt.Language
+	}
+	return LanguageUnspecified
+}
+
 type VideoType struct {
 	Type     VideoTypeKind
 	Language Language
@@ -68,9 +94,31 @@ func (vt VideoType) String() string {
 	}
 }
 
+// Matches reports whether the available video type satisfies this requested one.
+// Unspecified parts of the request match anything.
+func (vt VideoType) Matches(available VideoType) bool {
+	if vt.Type != VideoTypeUnspecified && vt.Type != available.Type {
+		return false
+	}
+	if vt.Type == VideoTypeRaw {
+		return true
+	}
+	return vt.Language == LanguageUnspecified || vt.Language == available.Language
+}
+
+// IsSpecific reports whether the video type names exactly one language version.
+func (vt VideoType) IsSpecific() bool {
+	if vt.Type == VideoTypeRaw {
+		return true
+	}
+	return vt.Type != VideoTypeUnspecified && vt.Language != LanguageUnspecified
+}
+
 type EpisodesRequest struct {
 	Kind    EpisodesRequestKind
 	Payload AllOrSpecific
+	// Selectors pick the episodes of EpisodesRequestSelectors
+	Selectors []EpisodeSelector
 }
 
 type EpisodesRequestKind int
@@ -79,6 +127,8 @@ const (
 	EpisodesRequestUnspecified EpisodesRequestKind = iota
 	EpisodesRequestEpisodes
 	EpisodesRequestSeasons
+	// EpisodesRequestSelectors picks episodes across seasons, like S1E5-S2E3
+	EpisodesRequestSelectors
 )
 
 type AllOrSpecific struct {
@@ -91,28 +141,125 @@ type Range struct {
 	End   uint32
 }
 
+// EpisodeSelector picks a run of episodes across seasons. Latest and New depend on the episodes of the site
+// and the ones that exist, so the scraper turns them into runs that start at the first picked episode.
+type EpisodeSelector struct {
+	From EpisodePosition
+	// To is the last picked episode, nil if the run goes on to the end of the series
+	To *EpisodePosition
+	// Latest picks the last episodes of the series
+	Latest uint32
+	// New picks the episodes after the highest one that exists
+	New bool
+}
+
+// EpisodePosition is an episode of a season. Episode 0 stands for the start of the season in From and for
+// its end in To.
+type EpisodePosition struct {
+	Season  uint32
+	Episode uint32
+}
+
+// Range returns the episodes of the season the selector picks, and false if it picks none of them.
+// Films are season 0, so they are only picked by runs that start there.
+func (sel EpisodeSelector) Range(season uint32) (Range, bool) {
+	if season < sel.From.Season || sel.To != nil && season > sel.To.Season {
+		return Range{}, false
+	}
+	r := Range{Begin: 0, End: math.MaxUint32}
+	if season == sel.From.Season {
+		r.Begin = sel.From.Episode
+	}
+	if sel.To != nil && season == sel.To.Season && sel.To.Episode != 0 {
+		r.End = sel.To.Episode
+	}
+	return r, r.Begin <= r.End
+}
+
 type ExtractorMatch struct {
 	Any  bool
 	Name string
+	// Excluded bans the named extractor, even if it would be matched by the * fallback.
+	Excluded bool
+}
+
+// Matches reports whether the hoster name refers to the same extractor as this match.
+func (m ExtractorMatch) Matches(hoster string) bool {
+	if m.Any {
+		return true
+	}
+	if strings.EqualFold(m.Name, hoster) {
+		return true
+	}
+	want := extractors.GetExtractorByName(m.Name)
+	return want != nil && want == extractors.GetExtractorByName(hoster)
+}
+
+// ExtractorRank returns the position of the hoster in the priority list, and false if it must not be used.
+// Named matches win over the * fallback. Without any priorities every hoster gets the same rank, and a list
+// that only excludes extractors ends with an implicit *.
+func ExtractorRank(hoster string, priorities []ExtractorMatch) (int, bool) {
+	if len(priorities) == 0 {
+		return 0, true
+	}
+
+	anyRank := -1
+	onlyExcluded := true
+	for i, m := range priorities {
+		if !m.Excluded {
+			onlyExcluded = false
+		}
+		if m.Any {
+			if anyRank < 0 {
+				anyRank = i
+			}
+			continue
+		}
+		if m.Matches(hoster) {
+			if m.Excluded {
+				return 0, false
+			}
+			return i, true
+		}
+	}
+
+	if anyRank < 0 && onlyExcluded {
+		return len(priorities), true
+	}
+	if anyRank < 0 {
+		return 0, false
+	}
+	return anyRank, true
 }
 
 type SeriesInfo struct {
 	Title       string
 	Description string
+	Genres      []string
+	// Year is the year the series started, 0 if it is unknown
+	Year uint32
+	// PosterUrl and FanartUrl point to the artwork of the series page, they are empty if there is none
+	PosterUrl string
+	FanartUrl string
 }
 
 type EpisodeInfo struct {
-	Season      uint32
-	Episode     uint32
+	Season  uint32
+	Episode uint32
+	// Absolute is the episode number counted across all seasons. It is only set if the request asks for it,
+	// and films and specials never have one
+	Absolute    uint32
 	Title       string
 	MaxEpisodes uint32
 }
 
 type DownloadSettings struct {
-	DdosWaitEpisodes uint32
-	DdosWaitMs       uint32
-	SkipExisting     bool
-	CheckIfExists    func(season, episode, maxEpisodes uint32, videoType *VideoType) bool
+	SkipExisting bool
+	Retry        *retry.Policy
+	Scheduler    *RequestScheduler
+	// CheckIfExists reports whether the episode exists, in any version if videoType is nil. Existing episodes
+	// are skipped with SkipExisting, and the new selector looks for the highest one either way
+	CheckIfExists func(episode EpisodeInfo, videoType *VideoType) bool
 }
 
 type DownloadRequest struct {
@@ -122,6 +269,10 @@ type DownloadRequest struct {
 	SaveDirectory       string
 	SeriesTitle         string
 	ExtractorPriorities []ExtractorMatch
+	// TitleLanguage is the language of the episode titles, German is used if it is unspecified
+	TitleLanguage Language
+	// AbsoluteNumbers counts the episodes across all seasons, which needs the episode count of every earlier season
+	AbsoluteNumbers bool
 }
 
 type Downloader interface {
@@ -129,9 +280,16 @@ type Downloader interface {
 	Download(ctx context.Context, request DownloadRequest, settings DownloadSettings, sender chan<- *DownloadTaskWrapper) error
 }
 
+// StreamCandidate is an extracted video url from a single hoster.
+type StreamCandidate struct {
+	Hoster  string
+	Url     string
+	Referer string
+}
+
 type DownloadTaskWrapper struct {
 	Episode EpisodeInfo
 	Lang    VideoType
-	Url     string
-	Referer string
+	// Candidates are ordered by priority, the first one that downloads successfully wins.
+	Candidates []StreamCandidate
 }
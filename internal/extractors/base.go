@@ -60,15 +60,18 @@ func ExistsExtractorWithName(name string) bool {
 }
 
 func ExtractVideoUrl(ctx context.Context, url string, userAgent, referer string) (*ExtractedVideo, error) {
+	// Keep the last error, so callers can tell a transient failure from an unsupported URL
+	var lastErr error
 	for _, e := range registry {
 		if (e.SupportedFrom()&SupportedFromUrl) != 0 && e.SupportsUrl(url) {
 			res, err := e.ExtractVideoUrl(ctx, ExtractFrom{Url: url, UserAgent: userAgent, Referer: referer})
 			if err == nil && res != nil {
 				return res, nil
 			}
+			lastErr = err
 		}
 	}
-	return nil, nil
+	return nil, lastErr
 }
 
 func ExtractVideoUrlWithExtractor(ctx context.Context, url string, name string, userAgent, referer string) (*ExtractedVideo, error) {
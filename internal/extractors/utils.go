@@ -9,6 +9,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+
+	"github.com/bugmaschine/gad/pkg/retry"
 )
 
 func IsUrlHostAndHasPath(rawUrl string, expectedHost string, mustHavePath bool, ignoreCase bool) bool {
@@ -57,8 +59,8 @@ func GetSource(ctx context.Context, from ExtractFrom) (string, error) {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to fetch source: status %d", resp.StatusCode)
+	if err := retry.CheckResponse(resp); err != nil {
+		return "", fmt.Errorf("failed to fetch source: %w", err)
 	}
 
 	body, err := io.ReadAll(resp.Body)
@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
 	"sort"
@@ -8,6 +9,9 @@ import (
 	"strings"
 
 	"github.com/bugmaschine/gad/internal/downloaders"
+	"github.com/bugmaschine/gad/internal/extractors"
+	"github.com/bugmaschine/gad/pkg/download"
+	"github.com/bugmaschine/gad/pkg/naming"
 	"github.com/spf13/cobra"
 )
 
@@ -20,11 +24,24 @@ type Args struct {
 	ExtractorPriorities string
 	Extractor           string
 	ConcurrentDownloads int
+	SegmentWorkers      int
+	Connections         int
+	Quality             string
+	MaxResolution       string
+	Subtitles           string
+	EmbedSubtitles      bool
+	Container           string
+	Profile             string
 	LimitRate           string
 	Retries             int
-	DdosWaitEpisodes    int
+	DdosWaitEpisodes    uint32
 	DdosWaitMs          uint32
 	SkipExisting        bool
+	Nfo                 bool
+	EpisodeTitles       string
+	Naming              string
+	SeasonFolders       bool
+	MoviesFolder        string
 	Debug               bool
 	Browser             bool
 	Url                 string
@@ -33,49 +50,139 @@ type Args struct {
 	LogFile             string
 }
 
-func (a *Args) GetVideoType() downloaders.VideoType {
+// errRawUnsupported is returned for raw, because none of the supported sites offers raw versions. The preference
+// chain only has dubs and subs, so a raw request would skip every episode.
+var errRawUnsupported = errors.New("the supported sites don't offer raw versions, use dub or sub")
+
+func (a *Args) GetVideoType() (downloaders.VideoType, error) {
 	if a.TypeLanguage != "" {
-		vt, err := parseShorthand(a.TypeLanguage)
-		if err == nil {
-			return vt
-		}
+		return parseShorthand(a.TypeLanguage)
 	}
 
 	lang := parseLanguage(a.Language)
+	if a.Language != "" && lang == downloaders.LanguageUnspecified {
+		return downloaders.VideoType{}, fmt.Errorf("unknown language: %s", a.Language)
+	}
+
 	switch strings.ToLower(a.VideoType) {
 	case "raw":
-		return downloaders.VideoType{Type: downloaders.VideoTypeRaw}
+		return downloaders.VideoType{}, errRawUnsupported
 	case "dub":
-		return downloaders.VideoType{Type: downloaders.VideoTypeDub, Language: lang}
+		return downloaders.VideoType{Type: downloaders.VideoTypeDub, Language: lang}, nil
 	case "sub":
-		return downloaders.VideoType{Type: downloaders.VideoTypeSub, Language: lang}
+		return downloaders.VideoType{Type: downloaders.VideoTypeSub, Language: lang}, nil
+	case "":
+		return downloaders.VideoType{Type: downloaders.VideoTypeUnspecified, Language: lang}, nil
 	default:
-		return downloaders.VideoType{Type: downloaders.VideoTypeUnspecified, Language: lang}
+		return downloaders.VideoType{}, fmt.Errorf("unknown video type: %s", a.VideoType)
 	}
 }
 
-func (a *Args) GetEpisodesRequest() downloaders.EpisodesRequest {
+// GetEpisodesRequest returns the episodes to download. Plain numbers in --episodes are episodes of the season
+// of the URL or season 1, selectors like S1E5-S2E3, latest:3 or new pick episodes across seasons.
+func (a *Args) GetEpisodesRequest() (downloaders.EpisodesRequest, error) {
+	if a.Episodes != "" && a.Seasons != "" {
+		return downloaders.EpisodesRequest{}, fmt.Errorf("--episodes and --seasons can't be combined, select whole seasons like S2 in --episodes instead")
+	}
 	if a.Episodes != "" {
-		ranges, _ := parseRanges(a.Episodes)
+		if isSelectorList(a.Episodes) {
+			selectors, err := parseSelectors(a.Episodes)
+			if err != nil {
+				return downloaders.EpisodesRequest{}, err
+			}
+			return downloaders.EpisodesRequest{Kind: downloaders.EpisodesRequestSelectors, Selectors: selectors}, nil
+		}
+		ranges, err := parseRanges(a.Episodes)
+		if err != nil {
+			return downloaders.EpisodesRequest{}, fmt.Errorf("invalid episodes %q: %w", a.Episodes, err)
+		}
 		return downloaders.EpisodesRequest{
 			Kind: downloaders.EpisodesRequestEpisodes,
 			Payload: downloaders.AllOrSpecific{
 				All:      a.Episodes == "all",
 				Specific: ranges,
 			},
-		}
+		}, nil
 	}
 	if a.Seasons != "" {
-		ranges, _ := parseRanges(a.Seasons)
+		ranges, err := parseRanges(a.Seasons)
+		if err != nil {
+			return downloaders.EpisodesRequest{}, fmt.Errorf("invalid seasons %q: %w", a.Seasons, err)
+		}
 		return downloaders.EpisodesRequest{
 			Kind: downloaders.EpisodesRequestSeasons,
 			Payload: downloaders.AllOrSpecific{
 				All:      a.Seasons == "all",
 				Specific: ranges,
 			},
+		}, nil
+	}
+	return downloaders.EpisodesRequest{Kind: downloaders.EpisodesRequestUnspecified}, nil
+}
+
+func (a *Args) GetQuality() (download.Quality, error) {
+	return download.ParseQuality(a.Quality, a.MaxResolution)
+}
+
+func (a *Args) GetSubtitleFormat() (download.SubtitleFormat, error) {
+	return download.ParseSubtitleFormat(a.Subtitles)
+}
+
+// GetTitleLanguage returns the language of the episode titles in file names, and false if they are turned off.
+func (a *Args) GetTitleLanguage() (downloaders.Language, bool, error) {
+	switch strings.ToLower(a.EpisodeTitles) {
+	case "", "none":
+		return downloaders.LanguageUnspecified, false, nil
+	}
+	lang := parseLanguage(a.EpisodeTitles)
+	if lang == downloaders.LanguageUnspecified {
+		return lang, false, fmt.Errorf("unknown episode title language: %s", a.EpisodeTitles)
+	}
+	return lang, true, nil
+}
+
+func (a *Args) GetNamingTemplate() (*naming.Template, error) {
+	return naming.Parse(a.Naming)
+}
+
+func (a *Args) GetProfile() (download.Profile, error) {
+	return download.ParseProfile(a.Profile, a.Container)
+}
+
+func (a *Args) GetExtractorPriorities() ([]downloaders.ExtractorMatch, error) {
+	return parseExtractorPriorities(a.ExtractorPriorities)
+}
+
+// parseExtractorPriorities parses a list like "vidoza,*,!streamtape".
+// "*" stands for every extractor not named in the list, "!name" bans an extractor.
+func parseExtractorPriorities(input string) ([]downloaders.ExtractorMatch, error) {
+	noSpace := strings.ReplaceAll(input, " ", "")
+	if noSpace == "" {
+		return nil, nil
+	}
+
+	var matches []downloaders.ExtractorMatch
+	for _, part := range strings.Split(noSpace, ",") {
+		if part == "" {
+			continue
+		}
+		if part == "*" {
+			matches = append(matches, downloaders.ExtractorMatch{Any: true})
+			continue
+		}
+
+		excluded := strings.HasPrefix(part, "!")
+		name := strings.TrimPrefix(part, "!")
+		if name == "*" {
+			return nil, fmt.Errorf("cannot exclude the * fallback")
 		}
+		if !extractors.ExistsExtractorWithName(name) {
+			return nil, fmt.Errorf("unknown extractor: %s", name)
+		}
+		matches = append(matches, downloaders.ExtractorMatch{Name: name, Excluded: excluded})
 	}
-	return downloaders.EpisodesRequest{Kind: downloaders.EpisodesRequestUnspecified}
+
+	return matches, nil
 }
 
 func parseLanguage(s string) downloaders.Language {
@@ -95,7 +202,7 @@ func parseShorthand(input string) (downloaders.VideoType, error) {
 		return downloaders.VideoType{Type: downloaders.VideoTypeUnspecified, Language: downloaders.LanguageUnspecified}, nil
 	}
 	if inputLower == "raw" {
-		return downloaders.VideoType{Type: downloaders.VideoTypeRaw}, nil
+		return downloaders.VideoType{}, errRawUnsupported
 	}
 	if inputLower == "dub" {
 		return downloaders.VideoType{Type: downloaders.VideoTypeDub, Language: downloaders.LanguageUnspecified}, nil
@@ -168,6 +275,94 @@ func parseRanges(input string) ([]downloaders.Range, error) {
 	return mergeRanges(ranges), nil
 }
 
+var (
+	episodePositionRegex = regexp.MustCompile(`(?i)^s(\d+)(?:e(\d+))?$`)
+	latestRegex          = regexp.MustCompile(`(?i)^latest:(\d+)$`)
+)
+
+// isSelectorList reports whether the episode list uses selectors instead of plain episode numbers.
+func isSelectorList(input string) bool {
+	for _, part := range strings.Split(strings.ReplaceAll(input, " ", ""), ",") {
+		lower := strings.ToLower(part)
+		if strings.HasPrefix(lower, "s") || strings.HasPrefix(lower, "latest") || lower == "new" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSelectors parses a list of episode selectors: S1E5-S2E3, S2, S2-S4, S3E10- (to the end), latest:3 (the
+// last three episodes) and new (the episodes after the highest one on disk).
+func parseSelectors(input string) ([]downloaders.EpisodeSelector, error) {
+	var selectors []downloaders.EpisodeSelector
+	for _, part := range strings.Split(strings.ReplaceAll(input, " ", ""), ",") {
+		selector, err := parseSelector(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid episode selector %q: %w (e.g. S1E5-S2E3, S2, S3E10-, latest:3 or new)", part, err)
+		}
+		selectors = append(selectors, selector)
+	}
+	return selectors, nil
+}
+
+func parseSelector(part string) (downloaders.EpisodeSelector, error) {
+	if strings.EqualFold(part, "new") {
+		return downloaders.EpisodeSelector{New: true}, nil
+	}
+	if matches := latestRegex.FindStringSubmatch(part); matches != nil {
+		n, err := strconv.ParseUint(matches[1], 10, 32)
+		if err != nil || n == 0 {
+			return downloaders.EpisodeSelector{}, fmt.Errorf("latest needs a number of episodes above 0")
+		}
+		return downloaders.EpisodeSelector{Latest: uint32(n)}, nil
+	}
+
+	fromPart, toPart, isRange := strings.Cut(part, "-")
+	from, err := parseEpisodePosition(fromPart)
+	if err != nil {
+		return downloaders.EpisodeSelector{}, err
+	}
+	if !isRange {
+		return downloaders.EpisodeSelector{From: from, To: &from}, nil
+	}
+	if toPart == "" {
+		return downloaders.EpisodeSelector{From: from}, nil
+	}
+
+	to, err := parseEpisodePosition(toPart)
+	if err != nil {
+		return downloaders.EpisodeSelector{}, err
+	}
+	if to.Season < from.Season || to.Season == from.Season && to.Episode != 0 && to.Episode < from.Episode {
+		return downloaders.EpisodeSelector{}, fmt.Errorf("the end comes before the start")
+	}
+	return downloaders.EpisodeSelector{From: from, To: &to}, nil
+}
+
+// parseEpisodePosition parses S2 or S2E5. Without an episode it stands for the whole season.
+func parseEpisodePosition(input string) (downloaders.EpisodePosition, error) {
+	matches := episodePositionRegex.FindStringSubmatch(input)
+	if matches == nil {
+		return downloaders.EpisodePosition{}, fmt.Errorf("expected a season like S2 or an episode like S2E5")
+	}
+	season, err := strconv.ParseUint(matches[1], 10, 32)
+	if err != nil {
+		return downloaders.EpisodePosition{}, err
+	}
+	position := downloaders.EpisodePosition{Season: uint32(season)}
+	if matches[2] != "" {
+		episode, err := strconv.ParseUint(matches[2], 10, 32)
+		if err != nil {
+			return downloaders.EpisodePosition{}, err
+		}
+		if episode == 0 {
+			return downloaders.EpisodePosition{}, fmt.Errorf("episodes start at 1")
+		}
+		position.Episode = uint32(episode)
+	}
+	return position, nil
+}
+
 func mergeRanges(ranges []downloaders.Range) []downloaders.Range {
 	if len(ranges) <= 1 {
 		return ranges
@@ -254,19 +449,32 @@ func NewRootCommand(args *Args) *cobra.Command {
 	}
 
 	f := cmd.Flags()
-	f.StringVar(&args.VideoType, "type", "", "Only download specific video type (raw, dub, sub)")
+	f.StringVar(&args.VideoType, "type", "", "Only download specific video type (dub, sub)")
 	f.StringVar(&args.Language, "lang", "", "Only download specific language")
 	f.StringVarP(&args.TypeLanguage, "type-language", "t", "", "Shorthand for language and video type")
-	f.StringVarP(&args.Episodes, "episodes", "e", "", "Only download specific episodes (e.g. 1-3,5)")
+	f.StringVarP(&args.Episodes, "episodes", "e", "", "Only download specific episodes (e.g. 1-3,5), or select them across seasons: S1E5-S2E3, S2, S3E10-, latest:3 or new")
 	f.StringVarP(&args.Seasons, "seasons", "s", "", "Only download specific seasons")
-	f.StringVarP(&args.ExtractorPriorities, "priorities", "p", "*", "Extractor priorities")
+	f.StringVarP(&args.ExtractorPriorities, "priorities", "p", "*", "Extractor priorities, * matches every other extractor and !name excludes one (e.g. vidoza,*,!streamtape)")
 	f.StringVarP(&args.Extractor, "extractor", "u", "", "Use underlying extractors directly")
 	f.IntVarP(&args.ConcurrentDownloads, "concurrent", "N", 5, "Concurrent downloads")
+	f.IntVar(&args.SegmentWorkers, "segment-workers", 4, "Concurrent segment downloads per HLS download")
+	f.IntVar(&args.Connections, "connections", 4, "Connections per file download, if the server supports range requests")
+	f.StringVar(&args.Quality, "quality", "best", "Stream variant to pick: best, lowest or a preferred codec (h264, h265, av1, vp9)")
+	f.StringVar(&args.MaxResolution, "max-resolution", "", "Highest stream resolution to download (e.g. 720p)")
+	f.StringVar(&args.Subtitles, "subtitles", "srt", "Save HLS subtitles next to the episode as srt, vtt or none")
+	f.BoolVar(&args.EmbedSubtitles, "embed-subtitles", false, "Embed HLS subtitles as soft subtitle tracks")
+	f.StringVar(&args.Container, "container", "", "Container of the saved episodes: mp4, mkv or ts (default mp4)")
+	f.StringVar(&args.Profile, "profile", "copy", "Post-processing profile: copy, mkv, faststart (MP4 for streaming) or encode[:preset] (x264, e.g. encode:slow)")
 	f.StringVarP(&args.LimitRate, "rate", "r", "inf", "Maximum download rate")
-	f.IntVarP(&args.Retries, "retries", "R", 5, "Number of download retries")
-	f.IntVar(&args.DdosWaitEpisodes, "ddos-wait-episodes", 4, "Amount of requests before waiting")
+	f.IntVarP(&args.Retries, "retries", "R", 5, "Number of retries for scraping, extracting and downloading")
+	f.Uint32Var(&args.DdosWaitEpisodes, "ddos-wait-episodes", 4, "Amount of episode pages to load before waiting")
 	f.Uint32Var(&args.DdosWaitMs, "ddos-wait-ms", 60000, "Duration in milliseconds to wait")
 	f.BoolVar(&args.SkipExisting, "skip-existing", false, "Skip existing files")
+	f.StringVar(&args.Naming, "naming", naming.DefaultPreset, "Naming preset (sdl, jellyfin, plex) or template, e.g. \"{series}/Season {season:02}/{series} - S{season:02}E{episode:0w}[ - {type}]{ext}\"")
+	f.BoolVar(&args.SeasonFolders, "season-folders", false, "Put the episodes into Season NN folders and save films as \"<Series> - Film N (title)\" instead of season 0")
+	f.StringVar(&args.MoviesFolder, "movies-folder", "", "Save films into a folder of their own each below this folder, instead of next to the episodes")
+	f.StringVar(&args.EpisodeTitles, "episode-titles", "none", "Put the episode titles into the file names: de, en or none. Falls back to the other language if there is no title")
+	f.BoolVar(&args.Nfo, "nfo", false, "Write .nfo files for Kodi/Jellyfin next to the episodes, and in queue mode tvshow.nfo and artwork into the series folder")
 	f.BoolVar(&args.Browser, "browser", false, "Show browser window")
 	f.BoolVarP(&args.Debug, "debug", "d", false, "Enable debug mode")
 	f.StringVarP(&args.QueueFile, "queue-file", "q", "", "Path to the file containing URLs to download")
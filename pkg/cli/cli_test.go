@@ -0,0 +1,124 @@
+package cli
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/bugmaschine/gad/internal/downloaders"
+)
+
+func TestParseSelectors(t *testing.T) {
+	// The episodes of seasons 0 to 3 each selector picks
+	tests := []struct {
+		input string
+		want  [4]*downloaders.Range
+	}{
+		{"S1E5-S2E3", [4]*downloaders.Range{nil, {Begin: 5, End: math.MaxUint32}, {Begin: 0, End: 3}, nil}},
+		{"S2", [4]*downloaders.Range{nil, nil, {Begin: 0, End: math.MaxUint32}, nil}},
+		{"s3e10-", [4]*downloaders.Range{nil, nil, nil, {Begin: 10, End: math.MaxUint32}}},
+		{"S1E2", [4]*downloaders.Range{nil, {Begin: 2, End: 2}, nil, nil}},
+		{"S0-S1", [4]*downloaders.Range{{Begin: 0, End: math.MaxUint32}, {Begin: 0, End: math.MaxUint32}, nil, nil}},
+	}
+	for _, tt := range tests {
+		selectors, err := parseSelectors(tt.input)
+		if err != nil || len(selectors) != 1 {
+			t.Fatalf("%s: %v", tt.input, err)
+		}
+		for season, want := range tt.want {
+			got, ok := selectors[0].Range(uint32(season))
+			if ok != (want != nil) || ok && got != *want {
+				t.Errorf("%s season %d: got %v %v, want %v", tt.input, season, got, ok, want)
+			}
+		}
+	}
+
+	selectors, err := parseSelectors("latest:3, new")
+	want := []downloaders.EpisodeSelector{{Latest: 3}, {New: true}}
+	if err != nil || !reflect.DeepEqual(selectors, want) {
+		t.Errorf("latest:3, new: got %v, %v", selectors, err)
+	}
+
+	for _, input := range []string{"S2E3-S1E5", "S1E0", "latest:0", "latest", "S1E5,7", "E5", "S1-E5", "newest"} {
+		if _, err := parseSelectors(input); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestGetEpisodesRequest(t *testing.T) {
+	tests := []struct {
+		args Args
+		kind downloaders.EpisodesRequestKind
+		err  bool
+	}{
+		{Args{}, downloaders.EpisodesRequestUnspecified, false},
+		{Args{Episodes: "1-3,5"}, downloaders.EpisodesRequestEpisodes, false},
+		{Args{Seasons: "2"}, downloaders.EpisodesRequestSeasons, false},
+		{Args{Episodes: "S1E5-S2E3"}, downloaders.EpisodesRequestSelectors, false},
+		{Args{Episodes: "1-x"}, 0, true},
+		{Args{Seasons: "two"}, 0, true},
+		{Args{Episodes: "1", Seasons: "2"}, 0, true},
+	}
+	for _, tt := range tests {
+		request, err := tt.args.GetEpisodesRequest()
+		if (err != nil) != tt.err || err == nil && request.Kind != tt.kind {
+			t.Errorf("%+v: got %v, %v", tt.args, request.Kind, err)
+		}
+	}
+}
+
+func TestParseExtractorPriorities(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []downloaders.ExtractorMatch
+	}{
+		{"", nil},
+		{"*", []downloaders.ExtractorMatch{{Any: true}}},
+		{"vidoza, *, !streamtape", []downloaders.ExtractorMatch{{Name: "vidoza"}, {Any: true}, {Name: "streamtape", Excluded: true}}},
+		{"!streamtape", []downloaders.ExtractorMatch{{Name: "streamtape", Excluded: true}}},
+	}
+	for _, tt := range tests {
+		got, err := parseExtractorPriorities(tt.input)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %+v, %v", tt.input, got, err)
+		}
+	}
+
+	for _, input := range []string{"!*", "unknownhoster", "vidoza,!nope"} {
+		if _, err := parseExtractorPriorities(input); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestGetVideoType(t *testing.T) {
+	tests := []struct {
+		args Args
+		want downloaders.VideoType
+		err  bool
+	}{
+		{Args{}, downloaders.VideoType{}, false},
+		{Args{VideoType: "dub", Language: "de"}, downloaders.VideoType{Type: downloaders.VideoTypeDub, Language: downloaders.LanguageGerman}, false},
+		{Args{TypeLanguage: "engsub"}, downloaders.VideoType{Type: downloaders.VideoTypeSub, Language: downloaders.LanguageEnglish}, false},
+		{Args{VideoType: "raw"}, downloaders.VideoType{}, true},
+		{Args{TypeLanguage: "raw"}, downloaders.VideoType{}, true},
+		{Args{Language: "fr"}, downloaders.VideoType{}, true},
+	}
+	for _, tt := range tests {
+		got, err := tt.args.GetVideoType()
+		if (err != nil) != tt.err || err == nil && got != tt.want {
+			t.Errorf("%+v: got %v, %v", tt.args, got, err)
+		}
+	}
+}
+
+func TestDdosWaitEpisodesFlag(t *testing.T) {
+	var args Args
+	if err := NewRootCommand(&args).ParseFlags([]string{"--ddos-wait-episodes=-1"}); err == nil {
+		t.Errorf("a negative episode budget was accepted: %d", args.DdosWaitEpisodes)
+	}
+	if err := NewRootCommand(&args).ParseFlags([]string{"--ddos-wait-episodes=0"}); err != nil || args.DdosWaitEpisodes != 0 {
+		t.Errorf("turning the budget off failed: %v", err)
+	}
+}
@@ -1,70 +1,66 @@
 package download
 
 import (
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+
+	"github.com/bugmaschine/gad/pkg/naming"
 )
 
+// DirectoryCache holds the finished files below a directory, so existing episodes are found without
+// asking the filesystem for every one of them.
 type DirectoryCache struct {
-	mu    sync.RWMutex
-	files map[string]struct{}
+	mu sync.RWMutex
+	// files are the names of the files in the directory and all folders below it
+	files []string
 }
 
+// NewDirectoryCache reads the files below dir, including the ones in subfolders.
 func NewDirectoryCache(dir string) (*DirectoryCache, error) {
-	cache := &DirectoryCache{
-		files: make(map[string]struct{}),
-	}
+	cache := &DirectoryCache{}
 
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return cache, nil
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
 		}
-		return nil, err
-	}
-
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			cache.files[entry.Name()] = struct{}{}
+		// Unfinished downloads, subtitles and .nfo files don't count as existing
+		if entry.IsDir() || isPartialFile(entry.Name()) || isSidecarFile(entry.Name()) {
+			return nil
 		}
+		cache.files = append(cache.files, entry.Name())
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
 	}
 
 	return cache, nil
 }
 
-func (c *DirectoryCache) CheckIfEpisodeExists(name string) bool {
+// CheckIfEpisodeExists reports whether the episode was saved in any container, under the file name the template
+// gives it. The folder doesn't matter, so episodes that were sorted into other folders are found as well.
+// Files with and without the title count, and every video type of the episode counts if fields has none.
+func (c *DirectoryCache) CheckIfEpisodeExists(template *naming.Template, fields naming.Fields) bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	// Check with .mp4 and .ts as in Rust code (implicitly handled by checking common names)
-	if _, ok := c.files[name+".mp4"]; ok {
-		return true
-	}
-	if _, ok := c.files[name+".ts"]; ok {
-		return true
-	}
-	if _, ok := c.files[name]; ok {
-		return true
+	pattern := template.Pattern(fields, containerExtensions)
+	for _, f := range c.files {
+		if pattern.MatchString(f) {
+			return true
+		}
 	}
-
 	return false
 }
 
-func (c *DirectoryCache) HasPrefix(prefix string) bool {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+func isPartialFile(name string) bool {
+	return strings.HasSuffix(name, PartSuffix) || strings.HasSuffix(name, PartSuffix+resumeSuffix) || strings.HasSuffix(name, PartSuffix+sourceSuffix)
+}
 
-	for f := range c.files {
-		if len(f) >= len(prefix) && f[:len(prefix)] == prefix {
-			// If the next character is a digit, then it's a collision (e.g. S01E10 matching S01E105)
-			if len(f) > len(prefix) {
-				nextChar := f[len(prefix)]
-				if nextChar >= '0' && nextChar <= '9' {
-					continue
-				}
-			}
-			return true
-		}
-	}
-	return false
+// isSidecarFile reports whether the file belongs to an episode instead of being one.
+func isSidecarFile(name string) bool {
+	return strings.HasSuffix(name, ".srt") || strings.HasSuffix(name, ".vtt") || strings.HasSuffix(name, ".nfo")
 }
@@ -0,0 +1,67 @@
+package download
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bugmaschine/gad/internal/downloaders"
+	"github.com/bugmaschine/gad/pkg/naming"
+)
+
+func TestCheckIfEpisodeExists(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"Show - S01E01 - GerDub.mkv",
+		"Show - S01E02 - GerDub - The Title.mp4",
+		"Show - S01E03 - GerDub - Another Title.nfo",
+		"Show - S01E04 - GerDub.mp4.part",
+		"Show - S01E05 - GerDub - Title.de.srt",
+		"Season 01/Show - S01E06 - GerDub.mp4",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache, err := NewDirectoryCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := naming.Default()
+	gerDub := downloaders.VideoType{Type: downloaders.VideoTypeDub, Language: downloaders.LanguageGerman}
+	engDub := downloaders.VideoType{Type: downloaders.VideoTypeDub, Language: downloaders.LanguageEnglish}
+	tests := []struct {
+		episode   uint32
+		videoType downloaders.VideoType
+		want      bool
+	}{
+		{1, gerDub, true},
+		{1, engDub, false},
+		{2, gerDub, true},
+		{3, gerDub, false},
+		{4, gerDub, false},
+		{5, gerDub, false},
+		{6, gerDub, true},
+	}
+	for _, tt := range tests {
+		episode := downloaders.EpisodeInfo{Season: 1, Episode: tt.episode, Title: "The Title"}
+		if got := cache.CheckIfEpisodeExists(template, EpisodeFields("Show", &tt.videoType, &episode, true)); got != tt.want {
+			t.Errorf("episode %d %s: got %v, want %v", tt.episode, tt.videoType, got, tt.want)
+		}
+	}
+
+	// Without a video type any version counts, and any title before it is known
+	episode := downloaders.EpisodeInfo{Season: 1, Episode: 2}
+	if !cache.CheckIfEpisodeExists(template, EpisodeFields("Show", nil, &episode, false)) {
+		t.Errorf("episode 2 without video type wasn't found")
+	}
+	episode.Title = "Other Title"
+	if cache.CheckIfEpisodeExists(template, EpisodeFields("Show", &gerDub, &episode, true)) {
+		t.Errorf("episode 2 was found under another title")
+	}
+}
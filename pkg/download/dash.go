@@ -0,0 +1,680 @@
+package download
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bugmaschine/gad/pkg/retry"
+)
+
+// maxDashSegments guards against broken manifests that would expand to an endless segment list.
+const maxDashSegments = 200000
+
+type mpd struct {
+	Type                      string      `xml:"type,attr"`
+	MediaPresentationDuration string      `xml:"mediaPresentationDuration,attr"`
+	BaseURLs                  []string    `xml:"BaseURL"`
+	Periods                   []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	Start           string              `xml:"start,attr"`
+	Duration        string              `xml:"duration,attr"`
+	BaseURLs        []string            `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+	SegmentBase     *mpdSegmentBase     `xml:"SegmentBase"`
+	AdaptationSets  []mpdAdaptationSet  `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ContentType       string              `xml:"contentType,attr"`
+	MimeType          string              `xml:"mimeType,attr"`
+	Codecs            string              `xml:"codecs,attr"`
+	Lang              string              `xml:"lang,attr"`
+	BaseURLs          []string            `xml:"BaseURL"`
+	ContentProtection []struct{}          `xml:"ContentProtection"`
+	SegmentTemplate   *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList       *mpdSegmentList     `xml:"SegmentList"`
+	SegmentBase       *mpdSegmentBase     `xml:"SegmentBase"`
+	Representations   []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID                string              `xml:"id,attr"`
+	MimeType          string              `xml:"mimeType,attr"`
+	Codecs            string              `xml:"codecs,attr"`
+	Bandwidth         uint64              `xml:"bandwidth,attr"`
+	Height            int                 `xml:"height,attr"`
+	BaseURLs          []string            `xml:"BaseURL"`
+	ContentProtection []struct{}          `xml:"ContentProtection"`
+	SegmentTemplate   *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList       *mpdSegmentList     `xml:"SegmentList"`
+	SegmentBase       *mpdSegmentBase     `xml:"SegmentBase"`
+}
+
+type mpdSegmentTemplate struct {
+	Media                  string              `xml:"media,attr"`
+	Initialization         string              `xml:"initialization,attr"`
+	StartNumber            *uint64             `xml:"startNumber,attr"`
+	Timescale              *uint64             `xml:"timescale,attr"`
+	Duration               *uint64             `xml:"duration,attr"`
+	PresentationTimeOffset *uint64             `xml:"presentationTimeOffset,attr"`
+	SegmentTimeline        *mpdSegmentTimeline `xml:"SegmentTimeline"`
+}
+
+type mpdSegmentTimeline struct {
+	S []struct {
+		T *uint64 `xml:"t,attr"`
+		D uint64  `xml:"d,attr"`
+		R int64   `xml:"r,attr"`
+	} `xml:"S"`
+}
+
+type mpdSegmentList struct {
+	Timescale      *uint64 `xml:"timescale,attr"`
+	Duration       *uint64 `xml:"duration,attr"`
+	Initialization *mpdURL `xml:"Initialization"`
+	SegmentURLs    []struct {
+		Media      string `xml:"media,attr"`
+		MediaRange string `xml:"mediaRange,attr"`
+	} `xml:"SegmentURL"`
+}
+
+type mpdSegmentBase struct {
+	IndexRange     string  `xml:"indexRange,attr"`
+	Initialization *mpdURL `xml:"Initialization"`
+}
+
+type mpdURL struct {
+	SourceURL string `xml:"sourceURL,attr"`
+	Range     string `xml:"range,attr"`
+}
+
+// dashTrack is the video or an audio track of a DASH manifest, over all periods.
+type dashTrack struct {
+	jobs     []segmentJob
+	ext      string
+	language string
+}
+
+// dashDownload downloads a static DASH manifest. The video representation is picked by the quality settings,
+// the audio with the highest bandwidth is taken for every language, and FFmpeg muxes them into the output.
+func (d *Downloader) dashDownload(ctx context.Context, resp *http.Response, referer, outputPath, message string, task *DownloadTask) error {
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var manifest mpd
+	if err := xml.Unmarshal(data, &manifest); err != nil {
+		return retry.Fatal(fmt.Errorf("failed to decode mpd: %w", err))
+	}
+
+	tracks, err := d.dashTracks(ctx, &manifest, resp.Request.URL, referer)
+	if err != nil {
+		return err
+	}
+
+	base := strings.TrimSuffix(outputPath, filepath.Ext(outputPath))
+	var downloaded []downloadedTrack
+	for i, track := range tracks {
+		trackBase, trackMessage := base+".video", message
+		if i > 0 {
+			trackBase = fmt.Sprintf("%s.audio%d", base, i)
+			trackMessage = fmt.Sprintf("%s (audio %s)", message, track.language)
+		}
+		result, err := d.downloadSegments(ctx, track.jobs, track.ext, referer, trackBase, trackMessage)
+		if err != nil {
+			return err
+		}
+		result.language = track.language
+		downloaded = append(downloaded, result)
+	}
+
+	// Without separate audio, the video representation has to carry it
+	return d.finishTracks(downloaded, len(tracks) == 1, nil, outputPath, message, task)
+}
+
+// dashTracks builds the segment jobs of the video and audio tracks. Every period of the manifest becomes a period of the tracks.
+func (d *Downloader) dashTracks(ctx context.Context, manifest *mpd, manifestURL *url.URL, referer string) ([]dashTrack, error) {
+	if manifest.Type == "dynamic" {
+		return nil, retry.Fatal(errors.New("live DASH streams aren't supported"))
+	}
+	if len(manifest.Periods) == 0 {
+		return nil, retry.Fatal(errors.New("mpd has no periods"))
+	}
+
+	totalDuration, _ := parseISODuration(manifest.MediaPresentationDuration)
+	manifestBase := resolveBaseURL(manifestURL, manifest.BaseURLs)
+
+	tracks := []dashTrack{{}}
+	var periodStart float64
+	for p := range manifest.Periods {
+		period := &manifest.Periods[p]
+		if start, ok := parseISODuration(period.Start); ok {
+			periodStart = start
+		}
+		periodDuration, ok := parseISODuration(period.Duration)
+		if !ok {
+			end := totalDuration
+			if p+1 < len(manifest.Periods) {
+				if nextStart, ok := parseISODuration(manifest.Periods[p+1].Start); ok {
+					end = nextStart
+				}
+			}
+			periodDuration = end - periodStart
+		}
+		periodBase := resolveBaseURL(manifestBase, period.BaseURLs)
+
+		var videoSets, audioSets []*mpdAdaptationSet
+		for i := range period.AdaptationSets {
+			set := &period.AdaptationSets[i]
+			switch set.kind() {
+			case "video":
+				videoSets = append(videoSets, set)
+			case "audio":
+				audioSets = append(audioSets, set)
+			}
+		}
+		if len(videoSets) == 0 {
+			return nil, retry.Fatal(fmt.Errorf("period %d has no video", p))
+		}
+
+		// Video
+		var sets []*mpdAdaptationSet
+		var candidates []*mpdRepresentation
+		var representations []representation
+		for _, set := range videoSets {
+			for i := range set.Representations {
+				rep := &set.Representations[i]
+				sets = append(sets, set)
+				candidates = append(candidates, rep)
+				representations = append(representations, representation{height: rep.Height, bandwidth: rep.Bandwidth, codecs: firstNonEmpty(rep.Codecs, set.Codecs)})
+			}
+		}
+		i := d.quality.pick(representations)
+		if i < 0 {
+			return nil, retry.Fatal(fmt.Errorf("period %d has no video representations", p))
+		}
+		slog.Debug("Selected DASH representation", "period", p, "id", candidates[i].ID, "height", candidates[i].Height, "bandwidth", candidates[i].Bandwidth)
+		jobs, err := d.representationJobs(ctx, period, sets[i], candidates[i], periodBase, periodDuration, referer)
+		if err != nil {
+			return nil, err
+		}
+		tracks[0].appendPeriod(jobs, p, sets[i].mimeType(candidates[i]))
+
+		// Audio, one track per language. The tracks of later periods are matched by language.
+		seen := make(map[string]bool)
+		for _, set := range audioSets {
+			if seen[set.Lang] || len(set.Representations) == 0 {
+				continue
+			}
+			seen[set.Lang] = true
+
+			best := &set.Representations[0]
+			for i := range set.Representations {
+				if set.Representations[i].Bandwidth > best.Bandwidth {
+					best = &set.Representations[i]
+				}
+			}
+			jobs, err := d.representationJobs(ctx, period, set, best, periodBase, periodDuration, referer)
+			if err != nil {
+				return nil, fmt.Errorf("audio %q: %w", set.Lang, err)
+			}
+
+			track := -1
+			for t := 1; t < len(tracks); t++ {
+				if tracks[t].language == set.Lang {
+					track = t
+					break
+				}
+			}
+			if track < 0 {
+				if p > 0 {
+					slog.Warn("Skipping audio that is missing in the first period", "language", set.Lang, "period", p)
+					continue
+				}
+				tracks = append(tracks, dashTrack{language: set.Lang})
+				track = len(tracks) - 1
+			}
+			tracks[track].appendPeriod(jobs, p, set.mimeType(best))
+		}
+
+		periodStart += periodDuration
+	}
+
+	for t := range tracks {
+		tracks[t].number()
+	}
+	return tracks, nil
+}
+
+// appendPeriod adds the segments of a period. The first one carries the init section.
+func (t *dashTrack) appendPeriod(jobs []segmentJob, period int, mimeType string) {
+	for i := range jobs {
+		jobs[i].period = period
+	}
+	t.jobs = append(t.jobs, jobs...)
+	if t.ext == "" {
+		t.ext = ".m4s"
+		if strings.Contains(mimeType, "webm") {
+			t.ext = ".webm"
+		}
+	}
+}
+
+// number numbers the segments and periods of the track without gaps, as the resume manifest expects them.
+func (t *dashTrack) number() {
+	period, last := -1, -1
+	for i := range t.jobs {
+		if t.jobs[i].period != last {
+			last = t.jobs[i].period
+			period++
+		}
+		t.jobs[i].index = i
+		t.jobs[i].period = period
+	}
+}
+
+// kind returns "video", "audio" or "text".
+func (s *mpdAdaptationSet) kind() string {
+	if s.ContentType != "" {
+		return s.ContentType
+	}
+	mimeType := s.MimeType
+	if mimeType == "" && len(s.Representations) > 0 {
+		mimeType = s.Representations[0].MimeType
+	}
+	kind, _, _ := strings.Cut(mimeType, "/")
+	if kind == "application" {
+		return "text"
+	}
+	return kind
+}
+
+func (s *mpdAdaptationSet) mimeType(rep *mpdRepresentation) string {
+	return firstNonEmpty(rep.MimeType, s.MimeType)
+}
+
+// representationJobs lists the segments of a representation. The addressing can be defined on the period,
+// the adaptation set or the representation, the most specific one wins.
+func (d *Downloader) representationJobs(ctx context.Context, period *mpdPeriod, set *mpdAdaptationSet, rep *mpdRepresentation, periodBase *url.URL, periodDuration float64, referer string) ([]segmentJob, error) {
+	if len(set.ContentProtection) > 0 || len(rep.ContentProtection) > 0 {
+		return nil, retry.Fatal(errors.New("DRM protected DASH streams aren't supported"))
+	}
+	base := resolveBaseURL(resolveBaseURL(periodBase, set.BaseURLs), rep.BaseURLs)
+
+	if template := mergeSegmentTemplates(rep.SegmentTemplate, set.SegmentTemplate, period.SegmentTemplate); template != nil {
+		return templateJobs(template, rep, base, periodDuration)
+	}
+	if list := firstNonNil(rep.SegmentList, set.SegmentList, period.SegmentList); list != nil {
+		return listJobs(list, base)
+	}
+	segmentBase := firstNonNil(rep.SegmentBase, set.SegmentBase, period.SegmentBase)
+	return d.baseJobs(ctx, segmentBase, base, periodDuration, referer)
+}
+
+// mergeSegmentTemplates fills the unset attributes of the most specific template from the ones above it.
+func mergeSegmentTemplates(templates ...*mpdSegmentTemplate) *mpdSegmentTemplate {
+	var merged *mpdSegmentTemplate
+	for _, t := range templates {
+		if t == nil {
+			continue
+		}
+		if merged == nil {
+			copied := *t
+			merged = &copied
+			continue
+		}
+		if merged.Media == "" {
+			merged.Media = t.Media
+		}
+		if merged.Initialization == "" {
+			merged.Initialization = t.Initialization
+		}
+		if merged.StartNumber == nil {
+			merged.StartNumber = t.StartNumber
+		}
+		if merged.Timescale == nil {
+			merged.Timescale = t.Timescale
+		}
+		if merged.Duration == nil {
+			merged.Duration = t.Duration
+		}
+		if merged.PresentationTimeOffset == nil {
+			merged.PresentationTimeOffset = t.PresentationTimeOffset
+		}
+		if merged.SegmentTimeline == nil {
+			merged.SegmentTimeline = t.SegmentTimeline
+		}
+	}
+	return merged
+}
+
+func templateJobs(template *mpdSegmentTemplate, rep *mpdRepresentation, base *url.URL, periodDuration float64) ([]segmentJob, error) {
+	if template.Media == "" {
+		return nil, retry.Fatal(errors.New("segment template without media"))
+	}
+	timescale := valueOr(template.Timescale, 1)
+	number := valueOr(template.StartNumber, 1)
+	offset := valueOr(template.PresentationTimeOffset, 0)
+
+	var jobs []segmentJob
+	add := func(time, duration uint64) error {
+		if len(jobs) >= maxDashSegments {
+			return retry.Fatal(errors.New("too many segments in the segment template"))
+		}
+		segmentURL, err := base.Parse(expandTemplate(template.Media, rep, number, time))
+		if err != nil {
+			return retry.Fatal(err)
+		}
+		jobs = append(jobs, segmentJob{url: segmentURL.String(), duration: float64(duration) / float64(timescale)})
+		number++
+		return nil
+	}
+
+	if template.SegmentTimeline != nil {
+		var time uint64
+		timeline := template.SegmentTimeline.S
+		for i, s := range timeline {
+			if s.T != nil {
+				time = *s.T
+			}
+			if s.D == 0 {
+				return nil, retry.Fatal(errors.New("segment timeline entry without duration"))
+			}
+			repeat := s.R
+			if repeat < 0 {
+				// Repeat until the next entry or the end of the period
+				end := offset + uint64(periodDuration*float64(timescale))
+				if i+1 < len(timeline) && timeline[i+1].T != nil {
+					end = *timeline[i+1].T
+				}
+				repeat = int64(math.Ceil(float64(end-min(end, time))/float64(s.D))) - 1
+			}
+			for k := int64(0); k <= repeat; k++ {
+				if err := add(time, s.D); err != nil {
+					return nil, err
+				}
+				time += s.D
+			}
+		}
+	} else {
+		duration := valueOr(template.Duration, 0)
+		if duration == 0 || periodDuration <= 0 {
+			return nil, retry.Fatal(errors.New("segment template without timeline, duration or period length"))
+		}
+		count := int(math.Ceil(periodDuration * float64(timescale) / float64(duration)))
+		for k := 0; k < count; k++ {
+			if err := add(offset+uint64(k)*duration, duration); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if template.Initialization != "" && len(jobs) > 0 {
+		initURL, err := base.Parse(expandTemplate(template.Initialization, rep, 0, 0))
+		if err != nil {
+			return nil, retry.Fatal(err)
+		}
+		jobs[0].init = &initSection{url: initURL.String()}
+	}
+	return jobs, nil
+}
+
+var templateIdentifierRegex = regexp.MustCompile(`\$(RepresentationID|Number|Time|Bandwidth)(%0\d+d)?\$`)
+
+// expandTemplate replaces the identifiers of a SegmentTemplate, like "$Number%05d$".
+func expandTemplate(template string, rep *mpdRepresentation, number, time uint64) string {
+	expanded := templateIdentifierRegex.ReplaceAllStringFunc(template, func(identifier string) string {
+		parts := templateIdentifierRegex.FindStringSubmatch(identifier)
+		format := "%d"
+		if parts[2] != "" {
+			format = parts[2]
+		}
+		switch parts[1] {
+		case "RepresentationID":
+			return rep.ID
+		case "Number":
+			return fmt.Sprintf(format, number)
+		case "Time":
+			return fmt.Sprintf(format, time)
+		default:
+			return fmt.Sprintf(format, rep.Bandwidth)
+		}
+	})
+	return strings.ReplaceAll(expanded, "$$", "$")
+}
+
+func listJobs(list *mpdSegmentList, base *url.URL) ([]segmentJob, error) {
+	timescale := valueOr(list.Timescale, 1)
+	duration := float64(valueOr(list.Duration, 0)) / float64(timescale)
+
+	var jobs []segmentJob
+	for _, segment := range list.SegmentURLs {
+		segmentURL, err := base.Parse(segment.Media)
+		if err != nil {
+			return nil, retry.Fatal(err)
+		}
+		job := segmentJob{url: segmentURL.String(), duration: duration}
+		if segment.MediaRange != "" {
+			if job.byteRange, err = parseByteRange(segment.MediaRange); err != nil {
+				return nil, retry.Fatal(err)
+			}
+		}
+		jobs = append(jobs, job)
+	}
+	if len(jobs) == 0 {
+		return nil, retry.Fatal(errors.New("segment list without segments"))
+	}
+
+	if list.Initialization != nil {
+		init, err := initFromURL(list.Initialization, base)
+		if err != nil {
+			return nil, err
+		}
+		jobs[0].init = init
+	}
+	return jobs, nil
+}
+
+// baseJobs splits a single file representation into its subsegments, using the sidx box at the index range.
+// Without an index range, the whole file is a single segment.
+func (d *Downloader) baseJobs(ctx context.Context, segmentBase *mpdSegmentBase, base *url.URL, periodDuration float64, referer string) ([]segmentJob, error) {
+	if segmentBase == nil || segmentBase.IndexRange == "" {
+		return []segmentJob{{url: base.String(), duration: periodDuration}}, nil
+	}
+
+	indexRange, err := parseByteRange(segmentBase.IndexRange)
+	if err != nil {
+		return nil, retry.Fatal(err)
+	}
+	index, err := d.getBytesRange(ctx, base.String(), referer, indexRange)
+	if err != nil {
+		return nil, retry.Fatal(fmt.Errorf("failed to fetch segment index: %w", err))
+	}
+	subsegments, durations, err := parseSidx(index, indexRange.offset)
+	if err != nil {
+		return nil, retry.Fatal(err)
+	}
+
+	var jobs []segmentJob
+	for i, subsegment := range subsegments {
+		jobs = append(jobs, segmentJob{url: base.String(), byteRange: subsegment, duration: durations[i]})
+	}
+
+	// The init section is everything in front of the index, if it isn't given
+	init := &initSection{url: base.String(), byteRange: &byteRange{offset: 0, length: indexRange.offset}}
+	if segmentBase.Initialization != nil {
+		if init, err = initFromURL(segmentBase.Initialization, base); err != nil {
+			return nil, err
+		}
+	}
+	if init.byteRange == nil || init.byteRange.length > 0 {
+		jobs[0].init = init
+	}
+	return jobs, nil
+}
+
+func initFromURL(u *mpdURL, base *url.URL) (*initSection, error) {
+	initURL, err := base.Parse(u.SourceURL)
+	if err != nil {
+		return nil, retry.Fatal(err)
+	}
+	init := &initSection{url: initURL.String()}
+	if u.Range != "" {
+		if init.byteRange, err = parseByteRange(u.Range); err != nil {
+			return nil, retry.Fatal(err)
+		}
+	}
+	return init, nil
+}
+
+// parseSidx reads the subsegment ranges and durations from a segment index box that starts at offset in the file.
+func parseSidx(data []byte, offset int64) ([]*byteRange, []float64, error) {
+	if len(data) < 8 || string(data[4:8]) != "sidx" {
+		return nil, nil, errors.New("index range doesn't point to a sidx box")
+	}
+	boxSize := int64(binary.BigEndian.Uint32(data[0:4]))
+
+	errShort := errors.New("sidx box is too short")
+	if len(data) < 20 {
+		return nil, nil, errShort
+	}
+	version := data[8]
+	timescale := binary.BigEndian.Uint32(data[16:20])
+	pos := 20
+
+	var firstOffset uint64
+	if version == 0 {
+		if len(data) < pos+8 {
+			return nil, nil, errShort
+		}
+		firstOffset = uint64(binary.BigEndian.Uint32(data[pos+4 : pos+8]))
+		pos += 8
+	} else {
+		if len(data) < pos+16 {
+			return nil, nil, errShort
+		}
+		firstOffset = binary.BigEndian.Uint64(data[pos+8 : pos+16])
+		pos += 16
+	}
+	if len(data) < pos+4 {
+		return nil, nil, errShort
+	}
+	count := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+	pos += 4
+	if len(data) < pos+count*12 || timescale == 0 {
+		return nil, nil, errShort
+	}
+
+	// Subsegments start right after the sidx box
+	start := offset + boxSize + int64(firstOffset)
+	var ranges []*byteRange
+	var durations []float64
+	for i := 0; i < count; i++ {
+		reference := binary.BigEndian.Uint32(data[pos : pos+4])
+		if reference&0x80000000 != 0 {
+			return nil, nil, errors.New("nested segment indexes aren't supported")
+		}
+		size := int64(reference & 0x7fffffff)
+		duration := binary.BigEndian.Uint32(data[pos+4 : pos+8])
+		ranges = append(ranges, &byteRange{offset: start, length: size})
+		durations = append(durations, float64(duration)/float64(timescale))
+		start += size
+		pos += 12
+	}
+	if len(ranges) == 0 {
+		return nil, nil, errors.New("sidx box without references")
+	}
+	return ranges, durations, nil
+}
+
+// parseByteRange parses "first-last", with both ends inclusive.
+func parseByteRange(value string) (*byteRange, error) {
+	first, last, found := strings.Cut(value, "-")
+	if !found {
+		return nil, fmt.Errorf("invalid byte range: %s", value)
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid byte range: %s", value)
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return nil, fmt.Errorf("invalid byte range: %s", value)
+	}
+	return &byteRange{offset: start, length: end - start + 1}, nil
+}
+
+var isoDurationRegex = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISODuration parses durations like "PT1H23M4.5S" into seconds.
+func parseISODuration(value string) (float64, bool) {
+	matches := isoDurationRegex.FindStringSubmatch(strings.TrimSpace(value))
+	if matches == nil || value == "P" || value == "PT" {
+		return 0, false
+	}
+	var seconds float64
+	for i, unit := range []float64{86400, 3600, 60, 1} {
+		if matches[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(matches[i+1], 64)
+		if err != nil {
+			return 0, false
+		}
+		seconds += n * unit
+	}
+	return seconds, true
+}
+
+// resolveBaseURL applies the first BaseURL element, if there is one.
+func resolveBaseURL(base *url.URL, baseURLs []string) *url.URL {
+	if len(baseURLs) == 0 {
+		return base
+	}
+	resolved, err := base.Parse(strings.TrimSpace(baseURLs[0]))
+	if err != nil {
+		return base
+	}
+	return resolved
+}
+
+func firstNonNil[T any](values ...*T) *T {
+	for _, v := range values {
+		if v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func valueOr(value *uint64, fallback uint64) uint64 {
+	if value == nil {
+		return fallback
+	}
+	return *value
+}
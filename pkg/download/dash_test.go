@@ -0,0 +1,104 @@
+package download
+
+import (
+	"context"
+	"encoding/xml"
+	"net/url"
+	"testing"
+)
+
+func TestDashTracks(t *testing.T) {
+	manifest := `<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT20S">
+  <BaseURL>media/</BaseURL>
+  <Period>
+    <AdaptationSet contentType="video" mimeType="video/mp4">
+      <SegmentTemplate timescale="1000" initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Number%03d$.m4s" startNumber="5">
+        <SegmentTimeline>
+          <S t="0" d="4000" r="2"/>
+          <S d="8000"/>
+        </SegmentTimeline>
+      </SegmentTemplate>
+      <Representation id="v1080" bandwidth="5000000" height="1080" codecs="avc1.640028"/>
+      <Representation id="v720" bandwidth="3000000" height="720" codecs="avc1.64001f"/>
+    </AdaptationSet>
+    <AdaptationSet contentType="audio" lang="de" mimeType="audio/mp4">
+      <Representation id="a" bandwidth="128000">
+        <SegmentTemplate timescale="48000" duration="480000" media="audio/$Time$.m4s" initialization="audio/init.mp4"/>
+      </Representation>
+    </AdaptationSet>
+    <AdaptationSet contentType="audio" lang="ja" mimeType="audio/mp4">
+      <Representation id="j" bandwidth="128000">
+        <SegmentList timescale="1" duration="10">
+          <Initialization sourceURL="ja.mp4" range="0-99"/>
+          <SegmentURL media="ja.mp4" mediaRange="100-199"/>
+          <SegmentURL media="ja.mp4" mediaRange="200-299"/>
+        </SegmentList>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+
+	var m mpd
+	if err := xml.Unmarshal([]byte(manifest), &m); err != nil {
+		t.Fatal(err)
+	}
+	manifestURL, _ := url.Parse("https://example.com/stream/manifest.mpd")
+
+	d := NewDownloader("", false, 0)
+	d.SetQuality(Quality{MaxHeight: 720})
+	tracks, err := d.dashTracks(context.Background(), &m, manifestURL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 3 || tracks[1].language != "de" || tracks[2].language != "ja" {
+		t.Fatalf("dashTracks() = %d tracks, expected video, de and ja", len(tracks))
+	}
+
+	video := tracks[0].jobs
+	expected := []string{"v720/005.m4s", "v720/006.m4s", "v720/007.m4s", "v720/008.m4s"}
+	if len(video) != len(expected) {
+		t.Fatalf("video has %d segments, expected %d", len(video), len(expected))
+	}
+	for i, job := range video {
+		if job.url != "https://example.com/stream/media/"+expected[i] {
+			t.Errorf("video segment %d = %s, expected %s", i, job.url, expected[i])
+		}
+	}
+	if video[0].init == nil || video[0].init.url != "https://example.com/stream/media/v720/init.mp4" || video[3].duration != 8 {
+		t.Errorf("unexpected video init or duration: %+v", video[0].init)
+	}
+
+	audio := tracks[1].jobs
+	if len(audio) != 2 || audio[1].url != "https://example.com/stream/media/audio/480000.m4s" {
+		t.Errorf("unexpected audio segments: %+v", audio)
+	}
+
+	list := tracks[2].jobs
+	if len(list) != 2 || *list[1].byteRange != (byteRange{offset: 200, length: 100}) || *list[0].init.byteRange != (byteRange{offset: 0, length: 100}) {
+		t.Errorf("unexpected segment list: %+v", list)
+	}
+}
+
+func TestParseISODuration(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+		ok       bool
+	}{
+		{"PT1H23M4.5S", 4984.5, true},
+		{"PT24M", 1440, true},
+		{"P1DT1S", 86401, true},
+		{"PT", 0, false},
+		{"", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result, ok := parseISODuration(tt.input)
+			if result != tt.expected || ok != tt.ok {
+				t.Errorf("parseISODuration(%q) = %v, %v, expected %v, %v", tt.input, result, ok, tt.expected, tt.ok)
+			}
+		})
+	}
+}
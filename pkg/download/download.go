@@ -1,39 +1,42 @@
 package download
 
 import (
-	"bytes"
 	"context"
-	"crypto/aes"
-	"crypto/cipher"
-	"encoding/binary"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
-	"github.com/grafov/m3u8"
+	"github.com/bugmaschine/gad/pkg/retry"
 	"github.com/vbauerster/mpb/v8"
 	"github.com/vbauerster/mpb/v8/decor"
 	"golang.org/x/time/rate"
 )
 
 type Downloader struct {
-	client     *http.Client
-	progress   *mpb.Progress
-	totalBar   *mpb.Bar
-	totalSize  int64
-	limiter    *rate.Limiter
-	userAgent  string
-	ffmpegPath string
-	debug      bool
-	mu         sync.Mutex
+	client         *http.Client
+	progress       *mpb.Progress
+	totalBar       *mpb.Bar
+	totalSize      int64
+	limiter        *rate.Limiter
+	userAgent      string
+	ffmpegPath     string
+	ffprobePath    string
+	retry          *retry.Policy
+	segmentWorkers int
+	quality        Quality
+	subtitleFormat SubtitleFormat
+	embedSubtitles bool
+	profile        Profile
+	connections    int
+	debug          bool
+	mu             sync.Mutex
 }
 
 func NewDownloader(userAgent string, debug bool, limitRate float64) *Downloader {
@@ -44,11 +47,15 @@ func NewDownloader(userAgent string, debug bool, limitRate float64) *Downloader
 
 	p := mpb.New()
 	return &Downloader{
-		client:    &http.Client{},
-		progress:  p,
-		limiter:   rLimit,
-		userAgent: userAgent,
-		debug:     debug,
+		client:         &http.Client{},
+		progress:       p,
+		limiter:        rLimit,
+		userAgent:      userAgent,
+		segmentWorkers: 1,
+		connections:    1,
+		subtitleFormat: SubtitlesNone,
+		profile:        Profile{Name: "copy", Container: ContainerMP4},
+		debug:          debug,
 	}
 }
 
@@ -56,46 +63,211 @@ func (d *Downloader) SetFfmpegPath(path string) {
 	d.ffmpegPath = path
 }
 
-func (d *Downloader) DownloadToFile(ctx context.Context, task *DownloadTask) error {
-	slog.Debug("Starting download to file", "url", task.Url, "path", task.OutputPath)
-	if task.SkipExisting {
-		if _, err := os.Stat(task.OutputPath); err == nil {
-			slogInfo("skipping download for %s: file already exists", filepath.Base(task.OutputPath))
-			return nil
-		}
+// SetFfprobePath enables the verification of finished downloads that ask for it.
+func (d *Downloader) SetFfprobePath(path string) {
+	d.ffprobePath = path
+}
+
+func (d *Downloader) SetRetryPolicy(policy *retry.Policy) {
+	d.retry = policy
+}
+
+func (d *Downloader) SetQuality(quality Quality) {
+	d.quality = quality
+}
+
+func (d *Downloader) SetSubtitleFormat(format SubtitleFormat) {
+	d.subtitleFormat = format
+}
+
+func (d *Downloader) SetEmbedSubtitles(embed bool) {
+	d.embedSubtitles = embed
+}
+
+// SetProfile sets the container of finished episodes and how they are post-processed.
+func (d *Downloader) SetProfile(profile Profile) {
+	d.profile = profile
+}
+
+func (d *Downloader) SetConnections(connections int) {
+	if connections < 1 {
+		connections = 1
 	}
+	d.connections = connections
+}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", task.Url, nil)
-	if err != nil {
-		return err
+func (d *Downloader) SetSegmentWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	d.segmentWorkers = workers
+}
+
+// get sends a GET request with the downloader's user agent and the given referer,
+// and returns a *retry.StatusError for anything but 200 OK.
+func (d *Downloader) get(ctx context.Context, url, referer string) (*http.Response, error) {
+	return d.getFrom(ctx, url, referer, 0, "")
+}
+
+// getFrom works like get, but asks for the content starting at offset if it is bigger than zero.
+// In that case 206 Partial Content and 416 Range Not Satisfiable are accepted as well.
+func (d *Downloader) getFrom(ctx context.Context, url, referer string, offset int64, ifRange string) (*http.Response, error) {
+	if offset > 0 {
+		return d.getRange(ctx, url, referer, fmt.Sprintf("bytes=%d-", offset), ifRange)
 	}
+	return d.getRange(ctx, url, referer, "", "")
+}
 
+// getRange sends a GET request with the given Range header, if it isn't empty. With an If-Range validator
+// the server sends the whole file instead of the range if the file changed.
+func (d *Downloader) getRange(ctx context.Context, url, referer, byteRange, ifRange string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, retry.Fatal(err)
+	}
 	if d.userAgent != "" {
 		req.Header.Set("User-Agent", d.userAgent)
 	}
-	if task.Referer != "" {
-		req.Header.Set("Referer", task.Referer)
+	if referer != "" {
+		req.Header.Set("Referer", referer)
+	}
+
+	accepted := []int{http.StatusOK}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+		accepted = append(accepted, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable)
 	}
 
 	resp, err := d.client.Do(req)
 	if err != nil {
+		return nil, err
+	}
+	if err := retry.CheckResponse(resp, accepted...); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// getBytes fetches a small resource like a key or playlist, retrying transient failures.
+func (d *Downloader) getBytes(ctx context.Context, url, referer string) ([]byte, error) {
+	return d.getBytesRange(ctx, url, referer, nil)
+}
+
+// byteRange is a part of a resource, as given by EXT-X-BYTERANGE or the BYTERANGE of EXT-X-MAP.
+type byteRange struct {
+	offset int64
+	length int64
+}
+
+func (r *byteRange) header() string {
+	return fmt.Sprintf("bytes=%d-%d", r.offset, r.offset+r.length-1)
+}
+
+// getBytesRange works like getBytes, but only returns the byte range if it isn't nil.
+func (d *Downloader) getBytesRange(ctx context.Context, url, referer string, r *byteRange) ([]byte, error) {
+	var data []byte
+	err := d.retry.Do(ctx, "fetch "+url, func() error {
+		body, err := d.openRange(ctx, url, referer, r)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		data, err = io.ReadAll(body)
 		return err
+	})
+	return data, err
+}
+
+// openRange opens a resource, or the byte range of it if r isn't nil, for reading at the configured rate.
+// It doesn't retry, since callers that stream the body have to throw away what they already wrote first.
+func (d *Downloader) openRange(ctx context.Context, url, referer string, r *byteRange) (io.ReadCloser, error) {
+	if r == nil {
+		resp, err := d.get(ctx, url, referer)
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{d.limitReader(ctx, resp.Body), resp.Body}, nil
 	}
-	slog.Debug("Got response", "status", resp.Status, "content-type", resp.Header.Get("Content-Type"))
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status: %s", resp.Status)
+	resp, err := d.getRange(ctx, url, referer, r.header(), "")
+	if err != nil {
+		return nil, err
 	}
 
-	contentType := resp.Header.Get("Content-Type")
-	isM3U8 := strings.Contains(strings.ToLower(resp.Request.URL.String()), ".m3u8") ||
-		strings.Contains(strings.ToLower(contentType), "application/vnd.apple.mpegurl") ||
-		strings.Contains(strings.ToLower(contentType), "application/x-mpegURL")
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if start, _, ok := parseContentRange(resp.Header.Get("Content-Range")); !ok || start != r.offset {
+			resp.Body.Close()
+			return nil, retry.Fatal(fmt.Errorf("unexpected content range %q for %s", resp.Header.Get("Content-Range"), r.header()))
+		}
+	case http.StatusOK:
+		// The server ignored the range, so skip to it ourselves
+		if _, err := io.CopyN(io.Discard, resp.Body, r.offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	default:
+		resp.Body.Close()
+		return nil, retry.Fatal(fmt.Errorf("range %s not satisfiable", r.header()))
+	}
+
+	return readCloser{&rangeReader{r: d.limitReader(ctx, resp.Body), left: r.length, byteRange: r}, resp.Body}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// rangeReader reads exactly the length of a byte range, and fails if the body ends before.
+type rangeReader struct {
+	r         io.Reader
+	left      int64
+	byteRange *byteRange
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.r.Read(p)
+	r.left -= int64(n)
+	if err == io.EOF && r.left > 0 {
+		return n, fmt.Errorf("got %d of %d bytes of %s: %w", r.byteRange.length-r.left, r.byteRange.length, r.byteRange.header(), io.ErrUnexpectedEOF)
+	}
+	if r.left == 0 && err == nil {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (d *Downloader) DownloadToFile(ctx context.Context, task *DownloadTask) error {
+	slog.Debug("Starting download to file", "url", task.Url, "path", task.OutputPath)
+	if task.SkipExisting {
+		if path := task.existingPath(); path != "" {
+			slogInfo("skipping download for %s: file already exists", filepath.Base(path))
+			return nil
+		}
+	}
 
-	outputPath := task.OutputPath
-	if !task.OutputPathHasExtension {
-		outputPath += ".mp4"
+	return d.retry.Do(ctx, "download "+task.Filename(), func() error {
+		return d.downloadToFile(ctx, task)
+	})
+}
+
+func (d *Downloader) downloadToFile(ctx context.Context, task *DownloadTask) error {
+	outputPath := task.FinalPath(d.profile.Container.Ext())
+	if !task.OverwriteFile {
+		if _, err := os.Stat(outputPath); err == nil {
+			return retry.Fatal(fmt.Errorf("file already exists: %s", outputPath))
+		}
 	}
 
 	message := task.CustomMessage
@@ -103,26 +275,106 @@ func (d *Downloader) DownloadToFile(ctx context.Context, task *DownloadTask) err
 		message = filepath.Base(outputPath)
 	}
 
-	flags := os.O_CREATE | os.O_WRONLY
-	if task.OverwriteFile {
-		flags |= os.O_TRUNC
-	} else {
-		flags |= os.O_EXCL
+	// Continue where a previous run stopped
+	partPath := outputPath + PartSuffix
+	if chunks := loadChunkResume(partPath); chunks != nil && !task.disableSplit {
+		if chunks.Source.matches(task.Url) {
+			// The .part file of a split download is preallocated, so its size says nothing about the progress
+			slog.Debug("Found partial split download", "path", partPath, "chunks", len(chunks.Chunks))
+			return d.finishSplitDownload(ctx, task, chunks, partPath, outputPath, message)
+		}
+		slog.Debug("Partial split download is from another source, starting over", "path", partPath, "source", chunks.Source.URL)
+		chunks.remove()
+		os.Remove(partPath)
 	}
 
-	targetFile, err := os.OpenFile(outputPath, flags, 0644)
+	// Only a .part file that is known to be from the same file is resumed
+	var offset int64
+	var source partSource
+	if info, err := os.Stat(partPath); err == nil && info.Size() > 0 {
+		saved, ok := loadPartSource(partPath)
+		if ok && saved.matches(task.Url) {
+			offset, source = info.Size(), saved
+			slog.Debug("Found partial download", "path", partPath, "size", offset)
+		} else {
+			slog.Debug("Partial download is from another source, starting over", "path", partPath)
+			os.Remove(partPath)
+			removePartSource(partPath)
+		}
+	}
+
+	resp, err := d.getFrom(ctx, task.Url, task.Referer, offset, source.ifRange())
 	if err != nil {
 		return err
 	}
-	defer targetFile.Close()
+	slog.Debug("Got response", "status", resp.Status, "content-type", resp.Header.Get("Content-Type"))
+	defer resp.Body.Close()
+
+	contentType := resp.Header.Get("Content-Type")
+	isM3U8 := strings.Contains(strings.ToLower(resp.Request.URL.String()), ".m3u8") ||
+		strings.Contains(strings.ToLower(contentType), "application/vnd.apple.mpegurl") ||
+		strings.Contains(strings.ToLower(contentType), "application/x-mpegURL")
 
 	if isM3U8 {
 		slog.Debug("Detected M3U8 playlist, starting HLS download")
-		return d.m3u8Download(ctx, resp, task.Referer, outputPath, message)
-	} else {
-		slog.Debug("Starting simple file download")
-		return d.simpleDownload(ctx, resp, targetFile, message)
+		if offset > 0 {
+			// The leftover belongs to a different kind of download, and the playlist was requested with a range
+			resp.Body.Close()
+			os.Remove(partPath)
+			removePartSource(partPath)
+			return retry.Retryable(fmt.Errorf("discarded stale partial download"))
+		}
+		return d.m3u8Download(ctx, resp, task.Referer, outputPath, message, task)
+	}
+
+	isMPD := strings.Contains(strings.ToLower(resp.Request.URL.Path), ".mpd") ||
+		strings.Contains(strings.ToLower(contentType), "application/dash+xml")
+
+	if isMPD {
+		slog.Debug("Detected DASH manifest, starting DASH download")
+		if offset > 0 {
+			resp.Body.Close()
+			os.Remove(partPath)
+			removePartSource(partPath)
+			return retry.Retryable(fmt.Errorf("discarded stale partial download"))
+		}
+		return d.dashDownload(ctx, resp, task.Referer, outputPath, message, task)
+	}
+
+	if offset == 0 && d.canSplit(task, resp) {
+		resp.Body.Close()
+		chunks := newChunkResume(partPath, newPartSource(task.Url, resp, resp.ContentLength), d.connections)
+		slog.Debug("Starting split download", "path", partPath, "size", resp.ContentLength, "chunks", len(chunks.Chunks))
+		return d.finishSplitDownload(ctx, task, chunks, partPath, outputPath, message)
 	}
+
+	slog.Debug("Starting simple file download")
+	if err := d.simpleDownload(ctx, task, resp, partPath, offset, source, message); err != nil {
+		return err
+	}
+	if err := d.finishFile(task, partPath, outputPath); err != nil {
+		return err
+	}
+	removePartSource(partPath)
+	return nil
+}
+
+func (d *Downloader) finishSplitDownload(ctx context.Context, task *DownloadTask, chunks *chunkResume, partPath, outputPath, message string) error {
+	err := d.splitDownload(ctx, task, chunks, partPath, message)
+	if errors.Is(err, errRangesUnsupported) {
+		// Start over with a single connection on the next attempt. The chunk marked the error as fatal,
+		// which would win over Retryable, so only its message is kept.
+		task.disableSplit = true
+		chunks.remove()
+		os.Remove(partPath)
+		return retry.Retryable(fmt.Errorf("retrying with a single connection: %s", err))
+	}
+	if err != nil {
+		return err
+	}
+
+	chunks.remove()
+	return d.finishFile(task, partPath, outputPath)
 }
 
 func (d *Downloader) ensureTotalBar() {
@@ -165,31 +417,71 @@ func (d *Downloader) addTotalSize(n int64) {
 	}
 }
 
-func (d *Downloader) simpleDownload(ctx context.Context, resp *http.Response, targetFile *os.File, message string) error {
-	contentLength := resp.ContentLength
+// simpleDownload writes the response into the .part file, appending if the server honoured the range request.
+// source is the file the existing bytes came from, the resumed file has to have its size. The source of a fresh
+// download is saved next to the .part file before anything is written. The file is only complete if its size
+// matches the size announced by the server.
+func (d *Downloader) simpleDownload(ctx context.Context, task *DownloadTask, resp *http.Response, partPath string, offset int64, source partSource, message string) error {
+	flags := os.O_CREATE | os.O_WRONLY
+	var total int64
+
+	switch resp.StatusCode {
+	case http.StatusRequestedRangeNotSatisfiable:
+		_, remoteSize, _ := parseContentRange(resp.Header.Get("Content-Range"))
+		if remoteSize == offset && (source.Size < 0 || remoteSize == source.Size) {
+			slog.Debug("Partial download is already complete", "path", partPath)
+			return nil
+		}
+		os.Remove(partPath)
+		removePartSource(partPath)
+		return retry.Retryable(fmt.Errorf("partial download doesn't match remote size, starting over"))
+	case http.StatusPartialContent:
+		start, remoteSize, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != offset || source.Size >= 0 && remoteSize != source.Size {
+			os.Remove(partPath)
+			removePartSource(partPath)
+			return retry.Retryable(fmt.Errorf("server resumed at the wrong offset or with another file, starting over"))
+		}
+		slog.Debug("Resuming download", "path", partPath, "offset", offset)
+		flags |= os.O_APPEND
+		total = remoteSize
+		if total < 0 && resp.ContentLength >= 0 {
+			total = offset + resp.ContentLength
+		}
+	default:
+		if offset > 0 {
+			slog.Debug("Server doesn't support range requests, starting over", "path", partPath)
+		}
+		offset = 0
+		flags |= os.O_TRUNC
+		total = resp.ContentLength
+		if err := savePartSource(partPath, newPartSource(task.Url, resp, total)); err != nil {
+			return retry.Fatal(err)
+		}
+	}
+
+	targetFile, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return retry.Fatal(err)
+	}
+	defer targetFile.Close()
 
 	d.ensureTotalBar()
-	d.addTotalSize(contentLength)
+	if total > 0 {
+		d.addTotalSize(total - offset)
+	}
 
 	// generic progress bar
-	bar := d.progress.AddBar(contentLength,
+	bar := d.progress.AddBar(total,
 		mpb.PrependDecorators(
 			decor.Name(message, decor.WC{W: len(message) + 1}),
 			decor.CountersKibiByte("% .2f / % .2f"),
 		),
 		d.downloadInfo(),
 	)
+	bar.SetCurrent(offset)
 
-	var reader io.Reader = resp.Body
-	if d.limiter != nil {
-		reader = &rateLimitedReader{
-			r:       resp.Body,
-			limiter: d.limiter,
-			ctx:     ctx,
-		}
-	}
-
-	proxyReader := bar.ProxyReader(reader)
+	proxyReader := bar.ProxyReader(d.limitReader(ctx, resp.Body))
 	defer proxyReader.Close()
 
 	// Wrap proxyReader to update totalBar
@@ -198,249 +490,63 @@ func (d *Downloader) simpleDownload(ctx context.Context, resp *http.Response, ta
 		finalReader = io.TeeReader(proxyReader, totalWriter{d})
 	}
 
-	_, err := io.Copy(targetFile, finalReader)
-	if err != nil {
+	if _, err := io.Copy(targetFile, finalReader); err != nil {
+		bar.Abort(true)
 		return err
 	}
-
-	return nil
-}
-
-func (d *Downloader) m3u8Download(ctx context.Context, resp *http.Response, referer, outputPath, message string) error {
-	m3u8Bytes, err := io.ReadAll(resp.Body)
-	if err != nil {
+	if err := targetFile.Close(); err != nil {
+		bar.Abort(true)
 		return err
 	}
 
-	p, listType, err := m3u8.DecodeFrom(bytes.NewReader(m3u8Bytes), true)
-	if err != nil {
-		return fmt.Errorf("failed to decode m3u8: %w", err)
-	}
-
-	var mediaPlaylist *m3u8.MediaPlaylist
-	mediaPlaylistURL := resp.Request.URL
-
-	if listType == m3u8.MASTER {
-		master := p.(*m3u8.MasterPlaylist)
-		if len(master.Variants) == 0 {
-			return fmt.Errorf("no variants in master playlist")
-		}
-
-		// Sort variants by bandwidth (descending) as simple quality heuristic
-		sort.Slice(master.Variants, func(i, j int) bool {
-			return master.Variants[i].Bandwidth > master.Variants[j].Bandwidth
-		})
-
-		bestVariant := master.Variants[0]
-		variantURL, err := mediaPlaylistURL.Parse(bestVariant.URI)
-		if err != nil {
-			return fmt.Errorf("failed to parse variant URL: %w", err)
-		}
-
-		mediaPlaylistURL = variantURL
-		req, err := http.NewRequestWithContext(ctx, "GET", variantURL.String(), nil)
+	if total >= 0 {
+		info, err := os.Stat(partPath)
 		if err != nil {
 			return err
 		}
-		if d.userAgent != "" {
-			req.Header.Set("User-Agent", d.userAgent)
-		}
-		if referer != "" {
-			req.Header.Set("Referer", referer)
+		if info.Size() != total {
+			bar.Abort(true)
+			// Keep the .part file, the next attempt resumes from here
+			return fmt.Errorf("incomplete download, got %d of %d bytes: %w", info.Size(), total, io.ErrUnexpectedEOF)
 		}
-
-		vResp, err := d.client.Do(req)
-		if err != nil {
-			return err
-		}
-		defer vResp.Body.Close()
-
-		vp, vt, err := m3u8.DecodeFrom(vResp.Body, true)
-		if err != nil || vt != m3u8.MEDIA {
-			return fmt.Errorf("failed to decode media playlist: %w", err)
-		}
-		mediaPlaylist = vp.(*m3u8.MediaPlaylist)
-	} else if listType == m3u8.MEDIA {
-		mediaPlaylist = p.(*m3u8.MediaPlaylist)
-	} else {
-		return fmt.Errorf("unsupported playlist type")
 	}
 
-	d.ensureTotalBar()
-
-	// per episode bar
-
-	bar := d.progress.AddBar(0, // Total will be updated as we go
-		mpb.PrependDecorators(
-			decor.Name(message+" ", decor.WC{W: len(message) + 1}),
-			decor.CountersKibiByte("% .2f / % .2f"),
-		),
-		d.downloadInfo(),
-	)
-
-	// Use a temporary .ts file for m3u8
-	tsPath := outputPath
-	if strings.HasSuffix(outputPath, ".mp4") {
-		tsPath = strings.TrimSuffix(outputPath, ".mp4") + ".ts"
-	}
+	return nil
+}
 
-	targetFile, err := os.OpenFile(tsPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
+// parseContentRange parses "bytes 100-199/1000" and "bytes */1000".
+// The total is -1 if the server doesn't know it.
+func parseContentRange(value string) (start, total int64, ok bool) {
+	value, found := strings.CutPrefix(strings.TrimSpace(value), "bytes ")
+	if !found {
+		return 0, -1, false
 	}
-	defer targetFile.Close()
-
-	var totalDuration float64
-	for _, seg := range mediaPlaylist.Segments {
-		if seg == nil {
-			break
-		}
-		totalDuration += seg.Duration
+	rangePart, totalPart, found := strings.Cut(value, "/")
+	if !found {
+		return 0, -1, false
 	}
 
-	var downloadedBytes int64
-	var downloadedDuration float64
-	var currentKey []byte
-	var currentIV []byte
-	var lastEstimation int64
-
-	for i, segment := range mediaPlaylist.Segments {
-		if segment == nil {
-			break
-		}
-
-		if segment.Key != nil {
-			if segment.Key.Method == "AES-128" {
-				keyURL, err := mediaPlaylistURL.Parse(segment.Key.URI)
-				if err != nil {
-					return err
-				}
-
-				req, err := http.NewRequestWithContext(ctx, "GET", keyURL.String(), nil)
-				if err != nil {
-					return err
-				}
-				if d.userAgent != "" {
-					req.Header.Set("User-Agent", d.userAgent)
-				}
-				if referer != "" {
-					req.Header.Set("Referer", referer)
-				}
-
-				kResp, err := d.client.Do(req)
-				if err != nil {
-					return err
-				}
-				currentKey, err = io.ReadAll(kResp.Body)
-				kResp.Body.Close()
-				if err != nil {
-					return err
-				}
-
-				if segment.Key.IV != "" {
-					ivStr := strings.TrimPrefix(segment.Key.IV, "0x")
-					currentIV, err = hex.DecodeString(ivStr)
-					if err != nil {
-						return err
-					}
-				} else {
-					// Use sequence number as IV if not provided
-					seq := uint64(mediaPlaylist.SeqNo) + uint64(i)
-					currentIV = make([]byte, 16)
-					binary.BigEndian.PutUint64(currentIV[8:], seq)
-				}
-			} else {
-				return fmt.Errorf("unsupported encryption method: %s", segment.Key.Method)
-			}
-		}
-
-		segmentURL, err := mediaPlaylistURL.Parse(segment.URI)
-		if err != nil {
-			return err
-		}
-
-		req, err := http.NewRequestWithContext(ctx, "GET", segmentURL.String(), nil)
-		if err != nil {
-			return err
-		}
-		if d.userAgent != "" {
-			req.Header.Set("User-Agent", d.userAgent)
-		}
-		if referer != "" {
-			req.Header.Set("Referer", referer)
-		}
-
-		sResp, err := d.client.Do(req)
-		if err != nil {
-			return err
-		}
-
-		segmentBytes, err := io.ReadAll(sResp.Body)
-		sResp.Body.Close()
-		if err != nil {
-			return err
-		}
-
-		if currentKey != nil {
-			block, err := aes.NewCipher(currentKey)
-			if err != nil {
-				return err
-			}
-			mode := cipher.NewCBCDecrypter(block, currentIV)
-			// PKCS7 padding is handled by the M3U8 standard, but we might need to unpad if it's not a multiple of block size (though it should be for AES-128 in HLS)
-			decrypted := make([]byte, len(segmentBytes))
-			mode.CryptBlocks(decrypted, segmentBytes)
-
-			// Unpad PKCS7
-			paddingLen := int(decrypted[len(decrypted)-1])
-			if paddingLen > 0 && paddingLen <= aes.BlockSize {
-				segmentBytes = decrypted[:len(decrypted)-paddingLen]
-			} else {
-				segmentBytes = decrypted
-			}
-		}
-
-		n, err := targetFile.Write(segmentBytes)
+	total = -1
+	if totalPart != "*" {
+		t, err := strconv.ParseInt(totalPart, 10, 64)
 		if err != nil {
-			return err
+			return 0, -1, false
 		}
-		downloadedBytes += int64(n)
-		downloadedDuration += segment.Duration
-
-		// Estimation
-		estimatedTotal := int64((float64(downloadedBytes) * totalDuration) / downloadedDuration)
-		bar.SetTotal(estimatedTotal, false)
-
-		// Update total bar with the change in estimation
-		diff := estimatedTotal - lastEstimation
-		d.addTotalSize(diff)
-		lastEstimation = estimatedTotal
-
-		bar.SetCurrent(downloadedBytes)
-		d.addTotalPos(int64(n))
+		total = t
 	}
 
-	bar.SetTotal(downloadedBytes, true)
-	bar.SetCurrent(downloadedBytes)
-
-	targetFile.Close()
-
-	// Post-processing with FFmpeg
-	if d.ffmpegPath != "" && tsPath != outputPath {
-		slog.Debug("Remuxing with FFmpeg", "in", tsPath, "out", outputPath)
-		cmd := exec.Command(d.ffmpegPath, "-y", "-i", tsPath, "-c", "copy", outputPath)
-		if !d.debug {
-			cmd.Stdout = nil
-			cmd.Stderr = nil
-		}
-		if err := cmd.Run(); err == nil {
-			os.Remove(tsPath)
-		} else {
-			slog.Warn("FFmpeg remux failed", "error", err)
-		}
+	if rangePart == "*" {
+		return 0, total, true
 	}
-
-	return nil
+	startPart, _, found := strings.Cut(rangePart, "-")
+	if !found {
+		return 0, total, false
+	}
+	start, err := strconv.ParseInt(startPart, 10, 64)
+	if err != nil {
+		return 0, total, false
+	}
+	return start, total, true
 }
 
 type totalWriter struct {
@@ -456,6 +562,18 @@ func (d *Downloader) Wait() {
 	d.progress.Wait()
 }
 
+// limitReader applies the global rate limit, which is shared by all downloads and segment workers.
+func (d *Downloader) limitReader(ctx context.Context, r io.Reader) io.Reader {
+	if d.limiter == nil {
+		return r
+	}
+	return &rateLimitedReader{
+		r:       r,
+		limiter: d.limiter,
+		ctx:     ctx,
+	}
+}
+
 type rateLimitedReader struct {
 	r       io.Reader
 	limiter *rate.Limiter
@@ -463,6 +581,10 @@ type rateLimitedReader struct {
 }
 
 func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	// WaitN fails for more than the burst size
+	if burst := r.limiter.Burst(); burst > 0 && len(p) > burst {
+		p = p[:burst]
+	}
 	n, err := r.r.Read(p)
 	if n > 0 {
 		if err := r.limiter.WaitN(r.ctx, n); err != nil {
@@ -0,0 +1,126 @@
+package download
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bugmaschine/gad/pkg/retry"
+)
+
+// errVerification marks a finished download that failed the integrity check. It isn't retried,
+// since the same hoster would most likely serve the same broken file again.
+var errVerification = errors.New("verification failed")
+
+// The duration of a stream is checked against the total of its playlist or manifest. It may be off by a few frames,
+// and playlists tend to round the segment lengths.
+const (
+	durationToleranceAbsolute = 5 * time.Second
+	durationToleranceRelative = 0.02
+)
+
+// finalize checks a finished download and only then moves it from tempPath to outputPath.
+// expected is the duration the file should have, 0 if it isn't known. A file that fails the check is removed.
+func (d *Downloader) finalize(tempPath, outputPath string, verify bool, expected time.Duration) error {
+	if verify && d.ffprobePath != "" {
+		if err := d.verifyMedia(tempPath, filepath.Ext(outputPath), expected); err != nil {
+			os.Remove(tempPath)
+			return retry.Fatal(fmt.Errorf("%w: %s: %w", errVerification, filepath.Base(outputPath), err))
+		}
+	} else if verify {
+		slog.Debug("FFprobe isn't available, skipping verification", "path", outputPath)
+	}
+
+	if err := os.Rename(tempPath, outputPath); err != nil {
+		return retry.Fatal(err)
+	}
+	return nil
+}
+
+// probeResult is the part of ffprobe's JSON output that gets checked.
+type probeResult struct {
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+	} `json:"streams"`
+}
+
+func (d *Downloader) verifyMedia(path, ext string, expected time.Duration) error {
+	out, err := exec.Command(d.ffprobePath, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", path).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return fmt.Errorf("ffprobe: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return fmt.Errorf("ffprobe: %w", err)
+	}
+
+	var result probeResult
+	if err := json.Unmarshal(out, &result); err != nil {
+		return fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+	if err := checkProbe(result, ext, expected); err != nil {
+		return err
+	}
+	slog.Debug("Verified download", "path", path, "format", result.Format.FormatName, "duration", result.Format.Duration, "streams", len(result.Streams))
+	return nil
+}
+
+// containerFormats maps file extensions to the format names ffprobe reports for them.
+var containerFormats = map[string]string{
+	".mp4": "mp4",
+	".m4v": "mp4",
+	".mov": "mov",
+	".mkv": "matroska",
+	".ts":  "mpegts",
+}
+
+// checkProbe checks the container, that there is video and audio, and that the duration is close to the expected one.
+func checkProbe(result probeResult, ext string, expected time.Duration) error {
+	if format, ok := containerFormats[strings.ToLower(ext)]; ok {
+		if !strings.Contains(result.Format.FormatName, format) {
+			return fmt.Errorf("expected a %s container, got %q", format, result.Format.FormatName)
+		}
+	}
+
+	var video, audio bool
+	for _, stream := range result.Streams {
+		video = video || stream.CodecType == "video"
+		audio = audio || stream.CodecType == "audio"
+	}
+	if !video {
+		return errors.New("no video stream")
+	}
+	if !audio {
+		return errors.New("no audio stream")
+	}
+
+	seconds, err := strconv.ParseFloat(result.Format.Duration, 64)
+	if err != nil || seconds <= 0 {
+		if expected > 0 {
+			return fmt.Errorf("unknown duration %q", result.Format.Duration)
+		}
+		return nil
+	}
+	if expected <= 0 {
+		return nil
+	}
+
+	actual := time.Duration(seconds * float64(time.Second))
+	tolerance := max(durationToleranceAbsolute, time.Duration(float64(expected)*durationToleranceRelative))
+	if diff := time.Duration(math.Abs(float64(actual - expected))); diff > tolerance {
+		return fmt.Errorf("duration is %s, expected %s", actual.Round(time.Second), expected.Round(time.Second))
+	}
+	return nil
+}
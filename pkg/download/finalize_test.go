@@ -0,0 +1,88 @@
+package download
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bugmaschine/gad/pkg/retry"
+)
+
+func TestCheckProbe(t *testing.T) {
+	const complete = `{"format":{"format_name":"mov,mp4,m4a,3gp,3g2,mj2","duration":"1420.500000"},"streams":[{"codec_type":"video"},{"codec_type":"audio"}]}`
+
+	tests := []struct {
+		name     string
+		output   string
+		ext      string
+		expected time.Duration
+		ok       bool
+	}{
+		{"complete", complete, ".mp4", 1420 * time.Second, true},
+		{"unknown expected duration", complete, ".mp4", 0, true},
+		{"within tolerance", complete, ".mp4", 1445 * time.Second, true},
+		{"too short", complete, ".mp4", 1500 * time.Second, false},
+		{"wrong container", complete, ".mkv", 0, false},
+		{"unchecked container", complete, ".bin", 0, true},
+		{"no audio", `{"format":{"format_name":"mpegts","duration":"10"},"streams":[{"codec_type":"video"}]}`, ".ts", 0, false},
+		{"no video", `{"format":{"format_name":"mpegts","duration":"10"},"streams":[{"codec_type":"audio"}]}`, ".ts", 0, false},
+		{"no duration", `{"format":{"format_name":"matroska,webm"},"streams":[{"codec_type":"video"},{"codec_type":"audio"}]}`, ".mkv", 10 * time.Second, false},
+	}
+	for _, tt := range tests {
+		var result probeResult
+		if err := json.Unmarshal([]byte(tt.output), &result); err != nil {
+			t.Fatal(err)
+		}
+		err := checkProbe(result, tt.ext, tt.expected)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+}
+
+func TestKeepTrack(t *testing.T) {
+	dir := t.TempDir()
+	d := NewDownloader("", false, 0)
+	outputPath := filepath.Join(dir, "Episode 1.ts")
+	videoPath := filepath.Join(dir, "Episode 1.video.ts"+PartSuffix)
+	track := func(partPaths ...string) downloadedTrack {
+		for _, partPath := range partPaths {
+			if err := os.WriteFile(partPath, []byte("data"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return downloadedTrack{partPaths: partPaths, resume: &segmentResume{path: filepath.Join(dir, "resume.json")}}
+	}
+
+	tests := []struct {
+		name   string
+		tracks []downloadedTrack
+	}{
+		{"separate audio", []downloadedTrack{track(videoPath), track(filepath.Join(dir, "Episode 1.audio1.ts"+PartSuffix))}},
+		{"periods", []downloadedTrack{track(videoPath, filepath.Join(dir, "Episode 1.video.1.ts"+PartSuffix))}},
+		{"other container", []downloadedTrack{track(filepath.Join(dir, "Episode 1.video.mp4"+PartSuffix))}},
+	}
+	for _, tt := range tests {
+		err := d.keepTrack(tt.tracks, outputPath, &DownloadTask{})
+		if err == nil || retry.IsRetryable(err) {
+			t.Errorf("%s: expected a fatal error, got %v", tt.name, err)
+		}
+		if _, err := os.Stat(outputPath); err == nil {
+			t.Errorf("%s: the output was created", tt.name)
+		}
+		for _, partPath := range tt.tracks[0].partPaths {
+			if _, err := os.Stat(partPath); err != nil {
+				t.Errorf("%s: the .part file wasn't kept: %v", tt.name, err)
+			}
+		}
+	}
+
+	if err := d.keepTrack([]downloadedTrack{track(videoPath)}, outputPath, &DownloadTask{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(outputPath); err != nil {
+		t.Errorf("the single track wasn't moved into place: %v", err)
+	}
+}
@@ -0,0 +1,551 @@
+package download
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bugmaschine/gad/pkg/retry"
+	"github.com/grafov/m3u8"
+)
+
+// hlsTrack is a media playlist that gets downloaded, either the video or a separate audio rendition.
+type hlsTrack struct {
+	playlist *m3u8.MediaPlaylist
+	url      *url.URL
+	// audio is set for separate audio renditions
+	audio *m3u8.Alternative
+	// subtitle is set for subtitle renditions
+	subtitle *m3u8.Alternative
+}
+
+// hlsStream is everything that gets downloaded for a playlist.
+type hlsStream struct {
+	// tracks holds the video first, then the separate audio renditions
+	tracks    []hlsTrack
+	subtitles []hlsTrack
+	// muxedAudio reports whether the video track carries audio itself
+	muxedAudio bool
+}
+
+// label names an audio rendition for messages and metadata.
+func (t hlsTrack) label() string {
+	if t.audio.Language != "" {
+		return t.audio.Language
+	}
+	return t.audio.Name
+}
+
+func (d *Downloader) m3u8Download(ctx context.Context, resp *http.Response, referer, outputPath, message string, task *DownloadTask) error {
+	stream, err := d.loadStream(ctx, resp, referer)
+	if err != nil {
+		return err
+	}
+
+	// The tracks are named apart from the output, whose .part file belongs to plain file downloads
+	base := strings.TrimSuffix(outputPath, filepath.Ext(outputPath))
+	var tracks []downloadedTrack
+	for i, track := range stream.tracks {
+		trackBase, trackMessage := base+".video", message
+		if track.audio != nil {
+			trackBase = fmt.Sprintf("%s.audio%d", base, i)
+			trackMessage = fmt.Sprintf("%s (audio %s)", message, track.label())
+		}
+
+		segments := track.segments()
+		jobs, err := segmentJobs(segments, track.playlist.SeqNo, track.url)
+		if err != nil {
+			return err
+		}
+		downloaded, err := d.downloadSegments(ctx, jobs, segmentExtension(segments), referer, trackBase, trackMessage)
+		if err != nil {
+			return err
+		}
+		if track.audio != nil {
+			downloaded.language = track.audio.Language
+		}
+		tracks = append(tracks, downloaded)
+	}
+
+	var subtitles []subtitleFile
+	if len(stream.subtitles) > 0 && (d.subtitleFormat != SubtitlesNone || d.embedSubtitles && d.ffmpegPath != "") {
+		subtitles = d.downloadSubtitles(ctx, stream.subtitles, referer, base)
+	}
+	return d.finishTracks(tracks, stream.muxedAudio, subtitles, outputPath, message, task)
+}
+
+// segments returns the segments of the playlist, without the unused capacity at the end.
+func (t hlsTrack) segments() []*m3u8.MediaSegment {
+	var segments []*m3u8.MediaSegment
+	for _, seg := range t.playlist.Segments {
+		if seg == nil {
+			break
+		}
+		segments = append(segments, seg)
+	}
+	return segments
+}
+
+// segmentExtension returns the extension matching the segment format. fMP4 segments come with an init section,
+// audio renditions may use packed audio segments.
+func segmentExtension(segments []*m3u8.MediaSegment) string {
+	for _, seg := range segments {
+		if seg.Map == nil {
+			continue
+		}
+		// Some MPEG-TS streams use EXT-X-MAP for a shared PAT/PMT
+		if uriExtension(seg.Map.URI) == ".ts" {
+			return ".ts"
+		}
+		return ".m4s"
+	}
+	switch ext := uriExtension(segments[0].URI); ext {
+	case ".aac", ".ac3", ".ec3", ".mp3":
+		return ext
+	}
+	return ".ts"
+}
+
+// uriExtension returns the lowercase extension of the path of a possibly relative URI.
+func uriExtension(uri string) string {
+	path, _, _ := strings.Cut(uri, "?")
+	return strings.ToLower(filepath.Ext(path))
+}
+
+// loadStream decodes the playlist from the response. For a master playlist, the variant is picked by the quality settings,
+// and its separate audio renditions and subtitles are loaded as well.
+func (d *Downloader) loadStream(ctx context.Context, resp *http.Response, referer string) (hlsStream, error) {
+	m3u8Bytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return hlsStream{}, err
+	}
+
+	p, listType, err := m3u8.DecodeFrom(bytes.NewReader(m3u8Bytes), true)
+	if err != nil {
+		return hlsStream{}, fmt.Errorf("failed to decode m3u8: %w", err)
+	}
+
+	playlistURL := resp.Request.URL
+
+	switch listType {
+	case m3u8.MASTER:
+		master := p.(*m3u8.MasterPlaylist)
+		variant := d.quality.selectVariant(master.Variants)
+		if variant == nil {
+			return hlsStream{}, fmt.Errorf("no variants in master playlist")
+		}
+		slog.Debug("Selected variant", "resolution", variant.Resolution, "bandwidth", variant.Bandwidth, "codecs", variant.Codecs)
+
+		video, err := d.loadMediaPlaylist(ctx, playlistURL, variant.URI, referer)
+		if err != nil {
+			return hlsStream{}, err
+		}
+		stream := hlsStream{tracks: []hlsTrack{video}}
+
+		var renditions []*m3u8.Alternative
+		renditions, stream.muxedAudio = audioRenditions(variant)
+		for _, rendition := range renditions {
+			audio, err := d.loadMediaPlaylist(ctx, playlistURL, rendition.URI, referer)
+			if err != nil {
+				return hlsStream{}, fmt.Errorf("audio rendition %q: %w", rendition.Name, err)
+			}
+			audio.audio = rendition
+			stream.tracks = append(stream.tracks, audio)
+		}
+
+		for _, rendition := range subtitleRenditions(variant) {
+			subtitle, err := d.loadMediaPlaylist(ctx, playlistURL, rendition.URI, referer)
+			if err != nil {
+				slog.Warn("Failed to load subtitle playlist", "name", rendition.Name, "error", err)
+				continue
+			}
+			subtitle.subtitle = rendition
+			stream.subtitles = append(stream.subtitles, subtitle)
+		}
+		return stream, nil
+	case m3u8.MEDIA:
+		return hlsStream{tracks: []hlsTrack{{playlist: p.(*m3u8.MediaPlaylist), url: playlistURL}}, muxedAudio: true}, nil
+	default:
+		return hlsStream{}, fmt.Errorf("unsupported playlist type")
+	}
+}
+
+// loadMediaPlaylist fetches a media playlist referenced by a master playlist.
+func (d *Downloader) loadMediaPlaylist(ctx context.Context, masterURL *url.URL, uri, referer string) (hlsTrack, error) {
+	playlistURL, err := masterURL.Parse(uri)
+	if err != nil {
+		return hlsTrack{}, retry.Fatal(fmt.Errorf("failed to parse playlist URL: %w", err))
+	}
+
+	playlistBytes, err := d.getBytes(ctx, playlistURL.String(), referer)
+	if err != nil {
+		return hlsTrack{}, retry.Fatal(err)
+	}
+
+	p, listType, err := m3u8.DecodeFrom(bytes.NewReader(playlistBytes), true)
+	if err != nil || listType != m3u8.MEDIA {
+		return hlsTrack{}, fmt.Errorf("failed to decode media playlist: %w", err)
+	}
+	return hlsTrack{playlist: p.(*m3u8.MediaPlaylist), url: playlistURL}, nil
+}
+
+type segmentJob struct {
+	index     int
+	url       string
+	byteRange *byteRange
+	duration  float64
+	// key is nil for unencrypted segments
+	key *m3u8.Key
+	iv  []byte
+	// period counts the discontinuities and init section changes before the segment
+	period int
+	// init is set on the first segment of a period, if the segments need an init section
+	init *initSection
+}
+
+// initSection is the EXT-X-MAP of the segments, encrypted with the key that was active where it appeared.
+type initSection struct {
+	url       string
+	byteRange *byteRange
+	key       *m3u8.Key
+	iv        []byte
+}
+
+// segmentJobs resolves the url, key and IV of every segment up front, so the segments can be fetched in any order.
+func segmentJobs(segments []*m3u8.MediaSegment, seqNo uint64, playlistURL *url.URL) ([]segmentJob, error) {
+	if len(segments) == 0 {
+		return nil, retry.Fatal(fmt.Errorf("playlist has no segments"))
+	}
+	jobs := make([]segmentJob, 0, len(segments))
+
+	// The key stays active until the next key tag, METHOD=NONE switches encryption off again.
+	// explicitIV is nil if the IV has to be derived from the media sequence number of each segment.
+	var activeKey *m3u8.Key
+	var explicitIV []byte
+
+	// The init section stays active until the next map tag
+	var activeInit *initSection
+	var activeMap m3u8.Map
+	period := 0
+
+	// A byte range without offset continues where the previous one of the same resource ended
+	var lastRangeURL string
+	var lastRangeEnd int64
+
+	for i, segment := range segments {
+		if segment.Key != nil {
+			key, iv, err := parseKey(segment.Key, playlistURL)
+			if err != nil {
+				return nil, retry.Fatal(fmt.Errorf("segment %d: %w", i, err))
+			}
+			activeKey, explicitIV = key, iv
+		}
+		iv := explicitIV
+		if activeKey != nil && iv == nil {
+			iv = sequenceIV(seqNo + uint64(i))
+		}
+
+		newPeriod := i > 0 && segment.Discontinuity
+		if segment.Map != nil && (activeInit == nil || *segment.Map != activeMap) {
+			mapURL, err := playlistURL.Parse(segment.Map.URI)
+			if err != nil {
+				return nil, retry.Fatal(err)
+			}
+			activeMap = *segment.Map
+			activeInit = &initSection{url: mapURL.String()}
+			if segment.Map.Limit > 0 {
+				activeInit.byteRange = &byteRange{offset: segment.Map.Offset, length: segment.Map.Limit}
+			}
+			// SAMPLE-AES leaves the init section in the clear
+			if activeKey != nil && activeKey.Method == "AES-128" {
+				activeInit.key = activeKey
+				activeInit.iv = iv
+			}
+			newPeriod = newPeriod || i > 0
+		}
+		if newPeriod {
+			period++
+		}
+
+		segmentURL, err := playlistURL.Parse(segment.URI)
+		if err != nil {
+			return nil, retry.Fatal(err)
+		}
+
+		job := segmentJob{index: i, url: segmentURL.String(), duration: segment.Duration, period: period}
+		if segment.Limit > 0 {
+			offset := segment.Offset
+			if offset == 0 && lastRangeURL == job.url {
+				offset = lastRangeEnd
+			}
+			job.byteRange = &byteRange{offset: offset, length: segment.Limit}
+			lastRangeURL, lastRangeEnd = job.url, offset+segment.Limit
+		}
+		if activeKey != nil {
+			job.key = activeKey
+			job.iv = iv
+		}
+		if activeInit != nil && (i == 0 || newPeriod) {
+			job.init = activeInit
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// resourceCache fetches every key and init section only once, even if several segment workers need it at the same time.
+// Keys are cached by their URI, so a playlist that rotates keys only fetches each of them once.
+type resourceCache struct {
+	d       *Downloader
+	referer string
+	mu      sync.Mutex
+	data    map[string][]byte
+}
+
+func newResourceCache(d *Downloader, referer string) *resourceCache {
+	return &resourceCache{d: d, referer: referer, data: make(map[string][]byte)}
+}
+
+func (c *resourceCache) get(ctx context.Context, uri string, r *byteRange) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := uri
+	if r != nil {
+		id += "#" + r.header()
+	}
+	if data, ok := c.data[id]; ok {
+		return data, nil
+	}
+	data, err := c.d.getBytesRange(ctx, uri, c.referer, r)
+	if err != nil {
+		return nil, err
+	}
+	c.data[id] = data
+	return data, nil
+}
+
+// fetchSegment streams a single segment into w, decrypting it on the way, with the init section in front if it starts a period.
+func (d *Downloader) fetchSegment(ctx context.Context, job segmentJob, resources *resourceCache, referer string, w io.Writer) error {
+	if job.init != nil {
+		data, err := resources.get(ctx, job.init.url, job.init.byteRange)
+		if err != nil {
+			return fmt.Errorf("init section: %w", err)
+		}
+		data, err = decryptResource(ctx, resources, data, job.init.key, job.init.iv)
+		if err != nil {
+			return fmt.Errorf("init section: %w", err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return retry.Fatal(err)
+		}
+	}
+
+	body, err := d.openRange(ctx, job.url, referer, job.byteRange)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var src io.Reader = body
+	if job.key != nil {
+		keyBytes, err := resources.key(ctx, job.key)
+		if err != nil {
+			return err
+		}
+		if job.key.Method == "SAMPLE-AES" {
+			// The segment is demuxed while it streams in, only the frames that are still incomplete are held
+			err := decryptSampleAESStream(body, w, keyBytes, job.iv)
+			if errors.Is(err, errSampleAES) {
+				return retry.Fatal(err)
+			}
+			return err
+		}
+		block, err := aes.NewCipher(keyBytes)
+		if err != nil {
+			return retry.Fatal(err)
+		}
+		src = newCBCReader(body, block, job.iv)
+	}
+
+	_, err = io.Copy(w, src)
+	return err
+}
+
+// fetchSegmentsOrdered fetches the segments with the configured number of workers and hands them to write in playlist order.
+// Every segment is streamed into a spill file in dir until it is its turn, so memory use doesn't depend on the segment size.
+// The spill files live next to the download rather than in the temp directory, which often is a RAM disk.
+// At most twice the number of workers segments are waiting at the same time.
+func (d *Downloader) fetchSegmentsOrdered(ctx context.Context, jobs []segmentJob, dir string, fetch func(context.Context, segmentJob, io.Writer) error, write func(segmentJob, io.Reader) error) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	workers := d.segmentWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	workers = min(workers, len(jobs))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type segmentResult struct {
+		pos  int
+		file *os.File
+		err  error
+	}
+
+	positions := make(chan int)
+	results := make(chan segmentResult, workers)
+	// A slot is taken when a segment is handed to a worker and given back once it's written
+	window := make(chan struct{}, workers*2)
+
+	go func() {
+		defer close(positions)
+		for pos := range jobs {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case positions <- pos:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pos := range positions {
+				file, err := d.spillSegment(ctx, dir, jobs[pos], fetch)
+				select {
+				case results <- segmentResult{pos: pos, file: file, err: err}:
+				case <-ctx.Done():
+					removeSpill(file)
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var firstErr error
+	pending := make(map[int]*os.File)
+	defer func() {
+		for _, file := range pending {
+			removeSpill(file)
+		}
+	}()
+	next := 0
+	for res := range results {
+		if firstErr != nil {
+			removeSpill(res.file)
+			continue
+		}
+		if res.err != nil {
+			firstErr = retry.Fatal(fmt.Errorf("segment %d: %w", jobs[res.pos].index, res.err))
+			cancel()
+			continue
+		}
+
+		pending[res.pos] = res.file
+		for {
+			file, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			err := write(jobs[next], file)
+			removeSpill(file)
+			if err != nil {
+				firstErr = err
+				cancel()
+				break
+			}
+			<-window
+			next++
+		}
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// spillSegment fetches a segment into a new spill file, starting over if an attempt fails halfway.
+// The returned file is positioned at its start.
+func (d *Downloader) spillSegment(ctx context.Context, dir string, job segmentJob, fetch func(context.Context, segmentJob, io.Writer) error) (*os.File, error) {
+	// The part suffix keeps leftovers of a crash out of the directory cache
+	file, err := os.CreateTemp(dir, ".segment-*"+PartSuffix)
+	if err != nil {
+		return nil, retry.Fatal(err)
+	}
+
+	err = d.retry.Do(ctx, fmt.Sprintf("fetch segment %d", job.index), func() error {
+		if err := file.Truncate(0); err != nil {
+			return retry.Fatal(err)
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return retry.Fatal(err)
+		}
+		w := bufio.NewWriter(file)
+		if err := fetchRecovered(ctx, fetch, job, w); err != nil {
+			return err
+		}
+		return w.Flush()
+	})
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeSpill(file)
+		return nil, err
+	}
+	return file, nil
+}
+
+func removeSpill(file *os.File) {
+	if file == nil {
+		return
+	}
+	file.Close()
+	os.Remove(file.Name())
+}
+
+// fetchRecovered turns a panic while fetching or decrypting a segment into an error for that segment,
+// so a bug in the parsers fails the download instead of the whole program. Tests crash on it instead.
+func fetchRecovered(ctx context.Context, fetch func(context.Context, segmentJob, io.Writer) error, job segmentJob, w io.Writer) (err error) {
+	if testing.Testing() {
+		return fetch(ctx, job, w)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = retry.Fatal(fmt.Errorf("panic: %v\n%s", r, debug.Stack()))
+		}
+	}()
+	return fetch(ctx, job, w)
+}
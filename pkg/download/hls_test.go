@@ -0,0 +1,191 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+func TestFetchSegmentsOrdered(t *testing.T) {
+	const workers = 3
+	jobs := make([]segmentJob, 20)
+	for i := range jobs {
+		jobs[i] = segmentJob{index: i}
+	}
+	errSegment := errors.New("segment is gone")
+
+	tests := []struct {
+		name string
+		// failAt is the segment that fails, -1 if none does
+		failAt int
+		// cancelAt cancels the context once the segment is fetched, -1 to let it run
+		cancelAt int
+	}{
+		{"complete", -1, -1},
+		{"failing segment", 7, -1},
+		{"canceled", -1, 9},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		d := NewDownloader("", false, 0)
+		d.SetSegmentWorkers(workers)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var mu sync.Mutex
+		var written []int
+		started, maxWaiting := 0, 0
+		fetch := func(ctx context.Context, job segmentJob, w io.Writer) error {
+			mu.Lock()
+			started++
+			maxWaiting = max(maxWaiting, started-len(written))
+			mu.Unlock()
+
+			// Every third segment takes longer, so the ones after it finish first
+			if job.index%3 == 0 {
+				time.Sleep(5 * time.Millisecond)
+			}
+			switch job.index {
+			case tt.failAt:
+				return errSegment
+			case tt.cancelAt:
+				cancel()
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			_, err := fmt.Fprintf(w, "segment %d", job.index)
+			return err
+		}
+		write := func(job segmentJob, r io.Reader) error {
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if want := fmt.Sprintf("segment %d", job.index); string(data) != want {
+				t.Errorf("%s: segment %d got %q", tt.name, job.index, data)
+			}
+			mu.Lock()
+			written = append(written, job.index)
+			mu.Unlock()
+			return nil
+		}
+
+		err := d.fetchSegmentsOrdered(ctx, jobs, dir, fetch, write)
+		cancel()
+		switch {
+		case tt.failAt >= 0 && !errors.Is(err, errSegment):
+			t.Errorf("%s: got %v, want the error of the segment", tt.name, err)
+		case tt.cancelAt >= 0 && !errors.Is(err, context.Canceled):
+			t.Errorf("%s: got %v, want the context error", tt.name, err)
+		case tt.failAt < 0 && tt.cancelAt < 0 && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		}
+
+		for i, index := range written {
+			if index != i {
+				t.Fatalf("%s: segments were written in the order %v", tt.name, written)
+			}
+		}
+		if stop := max(tt.failAt, tt.cancelAt); stop >= 0 && len(written) > stop {
+			t.Errorf("%s: %d segments were written, the ones after %d shouldn't", tt.name, len(written), stop)
+		}
+		if stop := max(tt.failAt, tt.cancelAt); stop < 0 && len(written) != len(jobs) {
+			t.Errorf("%s: %d of %d segments were written", tt.name, len(written), len(jobs))
+		}
+		if maxWaiting > 2*workers {
+			t.Errorf("%s: %d segments were fetched ahead, at most %d are allowed", tt.name, maxWaiting, 2*workers)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("%s: spill files were left behind: %v", tt.name, entries)
+		}
+	}
+}
+
+func TestSegmentJobsLayout(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:10
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+#EXTINF:10,
+#EXT-X-BYTERANGE:1000@720
+video.mp4
+#EXTINF:10,
+#EXT-X-BYTERANGE:1200
+video.mp4
+#EXT-X-DISCONTINUITY
+#EXTINF:10,
+#EXT-X-BYTERANGE:500@0
+other.mp4
+#EXTINF:10,
+#EXT-X-BYTERANGE:500
+other.mp4
+#EXT-X-MAP:URI="init2.mp4"
+#EXTINF:10,
+2.m4s
+#EXTINF:10,
+3.m4s
+#EXT-X-DISCONTINUITY
+#EXTINF:10,
+4.m4s
+#EXT-X-ENDLIST
+`
+	p, _, err := m3u8.DecodeFrom(strings.NewReader(playlist), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	media := p.(*m3u8.MediaPlaylist)
+	base, _ := url.Parse("https://example.com/hls/index.m3u8")
+
+	jobs, err := segmentJobs(hlsTrack{playlist: media}.segments(), media.SeqNo, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const prefix = "https://example.com/hls/"
+	tests := []struct {
+		url       string
+		byteRange *byteRange
+		period    int
+		// init is the url of the init section in front of the segment, "" if there is none
+		init      string
+		initRange *byteRange
+	}{
+		{"video.mp4", &byteRange{offset: 720, length: 1000}, 0, "init.mp4", &byteRange{offset: 0, length: 720}},
+		// Without an offset, the range continues after the one of the previous segment
+		{"video.mp4", &byteRange{offset: 1720, length: 1200}, 0, "", nil},
+		// A discontinuity starts a period, which gets the init section again
+		{"other.mp4", &byteRange{offset: 0, length: 500}, 1, "init.mp4", &byteRange{offset: 0, length: 720}},
+		{"other.mp4", &byteRange{offset: 500, length: 500}, 1, "", nil},
+		// So does a new init section
+		{"2.m4s", nil, 2, "init2.mp4", nil},
+		{"3.m4s", nil, 2, "", nil},
+		{"4.m4s", nil, 3, "init2.mp4", nil},
+	}
+	if len(jobs) != len(tests) {
+		t.Fatalf("got %d segments, want %d", len(jobs), len(tests))
+	}
+	for i, tt := range tests {
+		job := jobs[i]
+		if job.url != prefix+tt.url || !equalRange(job.byteRange, tt.byteRange) || job.period != tt.period {
+			t.Errorf("segment %d: got %s %v in period %d, want %s %v in period %d", i, job.url, job.byteRange, job.period, tt.url, tt.byteRange, tt.period)
+		}
+		switch {
+		case tt.init == "" && job.init != nil:
+			t.Errorf("segment %d: unexpected init section %s", i, job.init.url)
+		case tt.init != "" && (job.init == nil || job.init.url != prefix+tt.init || !equalRange(job.init.byteRange, tt.initRange)):
+			t.Errorf("segment %d: got init section %+v, want %s %v", i, job.init, tt.init, tt.initRange)
+		}
+	}
+}
+
+func equalRange(a, b *byteRange) bool {
+	return a == nil && b == nil || a != nil && b != nil && *a == *b
+}
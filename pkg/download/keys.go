@@ -0,0 +1,192 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/bugmaschine/gad/pkg/retry"
+	"github.com/grafov/m3u8"
+)
+
+// parseKey resolves the URI of an EXT-X-KEY tag and parses its IV. It returns a nil key for METHOD=NONE,
+// and a nil IV if the IV has to be derived from the media sequence number.
+func parseKey(key *m3u8.Key, playlistURL *url.URL) (*m3u8.Key, []byte, error) {
+	switch key.Method {
+	case "", "NONE":
+		return nil, nil, nil
+	case "AES-128", "SAMPLE-AES":
+	default:
+		return nil, nil, fmt.Errorf("unsupported encryption method: %s", key.Method)
+	}
+	if key.Keyformat != "" && key.Keyformat != "identity" {
+		return nil, nil, fmt.Errorf("DRM key format %s isn't supported", key.Keyformat)
+	}
+	if key.URI == "" {
+		return nil, nil, errors.New("key without URI")
+	}
+
+	resolved := *key
+	keyURL, err := playlistURL.Parse(key.URI)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid key URI: %w", err)
+	}
+	resolved.URI = keyURL.String()
+
+	if key.IV == "" {
+		return &resolved, nil, nil
+	}
+	iv, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(key.IV, "0x"), "0X"))
+	if err != nil || len(iv) != aes.BlockSize {
+		return nil, nil, fmt.Errorf("invalid IV: %s", key.IV)
+	}
+	return &resolved, iv, nil
+}
+
+// sequenceIV is the IV of a segment whose key tag has no IV attribute: its media sequence number as a 128 bit big endian integer.
+func sequenceIV(seq uint64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], seq)
+	return iv
+}
+
+// key returns the 16 byte key behind a key URI. Some hosters serve the key hex encoded, which is accepted as well.
+func (c *resourceCache) key(ctx context.Context, key *m3u8.Key) ([]byte, error) {
+	data, err := c.get(ctx, key.URI, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch key: %w", err)
+	}
+	if len(data) == aes.BlockSize {
+		return data, nil
+	}
+	if decoded, err := hex.DecodeString(string(bytes.TrimSpace(data))); err == nil && len(decoded) == aes.BlockSize {
+		return decoded, nil
+	}
+	return nil, retry.Fatal(fmt.Errorf("key has %d bytes instead of %d", len(data), aes.BlockSize))
+}
+
+// decryptResource decrypts a segment or init section. Without a key the data is returned as is.
+func decryptResource(ctx context.Context, resources *resourceCache, data []byte, key *m3u8.Key, iv []byte) ([]byte, error) {
+	if key == nil {
+		return data, nil
+	}
+	if len(data) == 0 {
+		return nil, retry.Fatal(errors.New("encrypted data is empty"))
+	}
+
+	keyBytes, err := resources.key(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.Method {
+	case "AES-128":
+		return decryptAES128(data, keyBytes, iv)
+	case "SAMPLE-AES":
+		decrypted, err := decryptSampleAES(data, keyBytes, iv)
+		if err != nil {
+			return nil, retry.Fatal(err)
+		}
+		return decrypted, nil
+	default:
+		return nil, retry.Fatal(fmt.Errorf("unsupported encryption method: %s", key.Method))
+	}
+}
+
+// decryptAES128 decrypts a whole resource with AES-128 in CBC mode and removes its PKCS7 padding.
+func decryptAES128(data, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, retry.Fatal(err)
+	}
+	return io.ReadAll(newCBCReader(bytes.NewReader(data), block, iv))
+}
+
+// cbcReader decrypts an AES-128 stream while it is read, so a segment never has to be held in memory.
+// The last block is held back until the end of the stream, since it carries the PKCS7 padding.
+type cbcReader struct {
+	src  io.Reader
+	mode cipher.BlockMode
+	// buf holds rawLen bytes of ciphertext, plain the decrypted bytes that weren't read yet
+	buf    [32 * 1024]byte
+	rawLen int
+	plain  [32 * 1024]byte
+	out    []byte
+	err    error
+}
+
+func newCBCReader(src io.Reader, block cipher.Block, iv []byte) *cbcReader {
+	return &cbcReader{src: src, mode: cipher.NewCBCDecrypter(block, iv)}
+}
+
+func (r *cbcReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.fill()
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *cbcReader) fill() {
+	n, err := r.src.Read(r.buf[r.rawLen:])
+	r.rawLen += n
+
+	switch {
+	case err == io.EOF:
+		if r.rawLen == 0 {
+			r.err = retry.Fatal(errors.New("encrypted data is empty"))
+			return
+		}
+		if r.rawLen%aes.BlockSize != 0 {
+			r.err = retry.Fatal(fmt.Errorf("encrypted data doesn't end on a block boundary (%d bytes left)", r.rawLen%aes.BlockSize))
+			return
+		}
+		r.mode.CryptBlocks(r.plain[:r.rawLen], r.buf[:r.rawLen])
+		padding, err := pkcs7Padding(r.plain[:r.rawLen])
+		if err != nil {
+			r.err = retry.Fatal(err)
+			return
+		}
+		r.out = r.plain[:r.rawLen-padding]
+		r.rawLen = 0
+		r.err = io.EOF
+	case err != nil:
+		r.err = err
+	default:
+		// Everything but the last full block and the incomplete rest
+		if ready := (r.rawLen/aes.BlockSize - 1) * aes.BlockSize; ready > 0 {
+			r.mode.CryptBlocks(r.plain[:ready], r.buf[:ready])
+			r.out = r.plain[:ready]
+			r.rawLen = copy(r.buf[:], r.buf[ready:r.rawLen])
+		}
+	}
+}
+
+// pkcs7Padding returns the length of the padding at the end of decrypted data. Broken padding almost always means a wrong key or IV.
+func pkcs7Padding(decrypted []byte) (int, error) {
+	if len(decrypted) == 0 {
+		return 0, errors.New("decrypted data is empty")
+	}
+	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > aes.BlockSize || padding > len(decrypted) {
+		return 0, errors.New("invalid padding, the key or IV is probably wrong")
+	}
+	for _, b := range decrypted[len(decrypted)-padding:] {
+		if int(b) != padding {
+			return 0, errors.New("invalid padding, the key or IV is probably wrong")
+		}
+	}
+	return padding, nil
+}
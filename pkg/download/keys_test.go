@@ -0,0 +1,307 @@
+package download
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/grafov/m3u8"
+)
+
+func TestSegmentJobsKeys(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:10
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-KEY:METHOD=AES-128,URI="a.key"
+#EXTINF:10,
+0.ts
+#EXTINF:10,
+1.ts
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:10,
+2.ts
+#EXT-X-KEY:METHOD=AES-128,URI="b.key",IV=0x000102030405060708090a0b0c0d0e0f
+#EXTINF:10,
+3.ts
+#EXTINF:10,
+4.ts
+#EXT-X-ENDLIST
+`
+	p, _, err := m3u8.DecodeFrom(strings.NewReader(playlist), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	media := p.(*m3u8.MediaPlaylist)
+	base, _ := url.Parse("https://example.com/hls/index.m3u8")
+
+	jobs, err := segmentJobs(hlsTrack{playlist: media}.segments(), media.SeqNo, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	explicit := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	tests := []struct {
+		key string
+		iv  []byte
+	}{
+		{"https://example.com/hls/a.key", sequenceIV(7)},
+		{"https://example.com/hls/a.key", sequenceIV(8)},
+		{"", nil},
+		{"https://example.com/hls/b.key", explicit},
+		{"https://example.com/hls/b.key", explicit},
+	}
+	for i, tt := range tests {
+		job := jobs[i]
+		var key string
+		if job.key != nil {
+			key = job.key.URI
+		}
+		if key != tt.key || !bytes.Equal(job.iv, tt.iv) {
+			t.Errorf("segment %d: got key %q, IV %x, want %q, %x", i, key, job.iv, tt.key, tt.iv)
+		}
+	}
+}
+
+func TestPKCS7Padding(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want int
+		ok   bool
+	}{
+		{append(bytes.Repeat([]byte{1}, 13), 3, 3, 3), 3, true},
+		{bytes.Repeat([]byte{16}, 16), 16, true},
+		{append(bytes.Repeat([]byte{1}, 15), 0), 0, false},
+		{append(bytes.Repeat([]byte{1}, 14), 2, 3), 0, false},
+		{nil, 0, false},
+	}
+	for i, tt := range tests {
+		got, err := pkcs7Padding(tt.data)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("%d: got %d, %v, want %d", i, got, err, tt.want)
+		}
+	}
+}
+
+func TestCBCReader(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 16)
+	block, _ := aes.NewCipher(key)
+	iv := sequenceIV(1)
+
+	for _, size := range []int{0, 1, 15, 16, 17, 32*1024 - 1, 100000} {
+		plain := make([]byte, size)
+		for i := range plain {
+			plain[i] = byte(i * 13)
+		}
+		padding := 16 - size%16
+		encrypted := append(append([]byte(nil), plain...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+		for _, src := range []io.Reader{bytes.NewReader(encrypted), iotest.OneByteReader(bytes.NewReader(encrypted))} {
+			got, err := io.ReadAll(newCBCReader(src, block, iv))
+			if err != nil {
+				t.Fatalf("%d bytes: %v", size, err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Errorf("%d bytes: decrypted data differs", size)
+			}
+		}
+	}
+
+	if _, err := io.ReadAll(newCBCReader(bytes.NewReader(make([]byte, 20)), block, iv)); err == nil {
+		t.Error("expected an error for a partial block")
+	}
+	if _, err := io.ReadAll(newCBCReader(bytes.NewReader(nil), block, iv)); err == nil {
+		t.Error("expected an error for empty data")
+	}
+}
+
+func TestDecryptSampleAES(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 16)
+	iv := sequenceIV(3)
+	block, _ := aes.NewCipher(key)
+
+	// A slice with runs of zeros, so the ciphertext and plaintext need different emulation prevention bytes
+	slice := []byte{0x65}
+	for i := 0; len(slice) < 600; i++ {
+		if i%40 < 6 {
+			slice = append(slice, 0)
+		} else {
+			slice = append(slice, byte(i))
+		}
+	}
+	sps := []byte{0x67, 0x64, 0x00, 0x1f, 0xac}
+	plainVideo := append(append(append([]byte{0, 0, 0, 1}, sps...), 0, 0, 0, 1), escapeNAL(slice)...)
+
+	encryptedSlice := unescapeNAL(escapeNAL(slice))
+	mode := cipher.NewCBCEncrypter(block, iv)
+	for pos := 32; len(encryptedSlice)-pos > 16; pos += 160 {
+		mode.CryptBlocks(encryptedSlice[pos:pos+16], encryptedSlice[pos:pos+16])
+	}
+	encryptedVideo := append(append(append([]byte{0, 0, 0, 1}, sps...), 0, 0, 0, 1), escapeNAL(encryptedSlice)...)
+
+	var plainAudio, encryptedAudio []byte
+	for f := 0; f < 3; f++ {
+		frame := adtsFrame(70 + f*20)
+		plainAudio = append(plainAudio, frame...)
+		encrypted := append([]byte(nil), frame...)
+		payload := encrypted[7+16:]
+		payload = payload[:len(payload)/16*16]
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(payload, payload)
+		encryptedAudio = append(encryptedAudio, encrypted...)
+	}
+
+	segment := testTS(map[uint16][]byte{0x100: encryptedVideo, 0x101: encryptedAudio})
+	decrypted, err := decryptSampleAES(segment, key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decrypted)%tsPacketSize != 0 {
+		t.Fatalf("output of %d bytes isn't made of packets", len(decrypted))
+	}
+
+	var streamed bytes.Buffer
+	if err := decryptSampleAESStream(iotest.OneByteReader(bytes.NewReader(segment)), &streamed, key, iv); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(streamed.Bytes(), decrypted) {
+		t.Errorf("streaming the segment gave a different output")
+	}
+	if err := decryptSampleAESStream(bytes.NewReader(segment[:len(segment)-1]), io.Discard, key, iv); err == nil || errors.Is(err, errSampleAES) {
+		t.Errorf("a cut off segment should fail like a broken download, got %v", err)
+	}
+
+	streams, types := demuxTestTS(t, decrypted)
+	if types[0x100] != 0x1b || types[0x101] != 0x0f {
+		t.Errorf("stream types weren't rewritten: %x", types)
+	}
+	if !bytes.Equal(streams[0x100], plainVideo) {
+		t.Errorf("video wasn't decrypted:\n%x\nwant\n%x", streams[0x100], plainVideo)
+	}
+	if !bytes.Equal(streams[0x101], plainAudio) {
+		t.Errorf("audio wasn't decrypted")
+	}
+}
+
+func adtsFrame(size int) []byte {
+	frame := make([]byte, size)
+	frame[0], frame[1] = 0xff, 0xf1
+	frame[3] = byte(size >> 11 & 0x03)
+	frame[4] = byte(size >> 3)
+	frame[5] = byte(size<<5) | 0x1f
+	for i := 7; i < size; i++ {
+		frame[i] = byte(i * 7)
+	}
+	return frame
+}
+
+// testTS muxes one PES packet per stream into a segment with a PAT and a SAMPLE-AES PMT.
+func testTS(streams map[uint16][]byte) []byte {
+	pat := []byte{0x00, 0xb0, 13, 0, 1, 0xc1, 0, 0, 0, 1, 0xf0, 0x00}
+	pat = binary.BigEndian.AppendUint32(pat, mpegCRC32(pat))
+	pmt := []byte{0x02, 0xb0, 13 + 2*5, 0, 1, 0xc1, 0, 0, 0xe1, 0x00, 0xf0, 0x00,
+		0xdb, 0xe1, 0x00, 0xf0, 0x00,
+		0xcf, 0xe1, 0x01, 0xf0, 0x00}
+	pmt = binary.BigEndian.AppendUint32(pmt, mpegCRC32(pmt))
+
+	m := &sampleAESMuxer{counters: make(map[uint16]byte)}
+	var out []byte
+	for _, section := range []struct {
+		pid  uint16
+		data []byte
+	}{{0, pat}, {0x1000, pmt}} {
+		for _, packet := range m.packetize(section.pid, []byte{0x47, 0x40, 0, 0x10}, append([]byte{0}, section.data...)) {
+			out = append(out, packet...)
+		}
+	}
+	for _, pid := range []uint16{0x100, 0x101} {
+		pes := append([]byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5, 0x21, 0, 1, 0, 1}, streams[pid]...)
+		if pid == 0x101 {
+			pes[3] = 0xc0
+			binary.BigEndian.PutUint16(pes[4:6], uint16(len(pes)-6))
+		}
+		for _, packet := range m.packetize(pid, []byte{0x47, 0x40, 0, 0x10}, pes) {
+			out = append(out, packet...)
+		}
+	}
+	return out
+}
+
+// demuxTestTS returns the PES payloads and stream types of a segment.
+func demuxTestTS(t *testing.T, data []byte) (map[uint16][]byte, map[uint16]byte) {
+	m := &sampleAESMuxer{tsTables: newTSTables()}
+	pes := make(map[uint16][]byte)
+	for offset := 0; offset < len(data); offset += tsPacketSize {
+		packet := data[offset : offset+tsPacketSize]
+		pid := binary.BigEndian.Uint16(packet[1:3]) & 0x1fff
+		switch {
+		case pid == 0:
+			m.parsePAT(tsPayload(packet))
+		case m.pmtPIDs[pid]:
+			section := psiSection(tsPayload(packet))
+			end := 3 + int(binary.BigEndian.Uint16(section[1:3])&0x0fff) - 4
+			if mpegCRC32(section[:end]) != binary.BigEndian.Uint32(section[end:end+4]) {
+				t.Error("PMT has a wrong CRC")
+			}
+			if _, err := m.rewritePMT(packet); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			pes[pid] = append(pes[pid], tsPayload(packet)...)
+		}
+	}
+
+	streams := make(map[uint16][]byte)
+	for pid, data := range pes {
+		streams[pid] = data[9+int(data[8]):]
+		if length := binary.BigEndian.Uint16(data[4:6]); length != 0 && int(length) != len(data)-6 {
+			t.Errorf("PID %d: PES length %d, want %d", pid, length, len(data)-6)
+		}
+	}
+	return streams, m.streamTypes
+}
+
+func TestDecryptSampleAESCorrupted(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 16)
+	iv := sequenceIV(3)
+	video := append([]byte{0, 0, 0, 1, 0x65}, bytes.Repeat([]byte{0x11}, 400)...)
+	audio := append(adtsFrame(90), adtsFrame(120)...)
+	segment := testTS(map[uint16][]byte{0x100: video, 0x101: audio})
+
+	// An adaptation field longer than its packet, in front of a PES packet that looks fine
+	broken := append([]byte{0x47, 0x41, 0x00, 0x30, 200}, bytes.Repeat([]byte{0xff}, tsPacketSize-5)...)
+	m := &sampleAESMuxer{counters: make(map[uint16]byte)}
+	pes := append([]byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 0}, video...)
+	for _, packet := range m.packetize(0x100, []byte{0x47, 0x00, 0, 0x10}, pes) {
+		broken = append(broken, packet...)
+	}
+	if _, err := decryptSampleAES(append(segment[:2*tsPacketSize:2*tsPacketSize], broken...), key, iv); !errors.Is(err, errSampleAES) {
+		t.Errorf("an adaptation field longer than its packet should fail, got %v", err)
+	}
+
+	// Broken segments have to fail with an error, a panic would take the whole program down
+	rng := rand.New(rand.NewPCG(1, 2))
+	for range 20000 {
+		corrupted := append([]byte(nil), segment...)
+		for range 1 + rng.IntN(4) {
+			// Mostly the packet headers and adaptation fields, anything else is just payload
+			i := rng.IntN(len(corrupted)/tsPacketSize)*tsPacketSize + 1 + rng.IntN(8)
+			if rng.IntN(4) == 0 {
+				i = rng.IntN(len(corrupted))
+			}
+			if i%tsPacketSize == 0 {
+				continue
+			}
+			corrupted[i] = byte(rng.IntN(256))
+		}
+		decryptSampleAES(corrupted, key, iv)
+	}
+}
@@ -0,0 +1,76 @@
+package download
+
+import (
+	"log/slog"
+	"path/filepath"
+	"sync"
+
+	"github.com/bugmaschine/gad/pkg/naming"
+)
+
+// Library decides where the episodes and films of a series are saved, and finds the ones that already exist.
+type Library struct {
+	dir      string
+	template *naming.Template
+	// Films are season 0 on the sites. They are saved like episodes if filmTemplate is nil
+	filmDir      string
+	filmTemplate *naming.Template
+
+	mu     sync.Mutex
+	caches map[string]*DirectoryCache
+}
+
+// NewLibrary saves the episodes below dir, with the paths the template gives them.
+func NewLibrary(dir string, template *naming.Template) *Library {
+	return &Library{dir: dir, template: template, caches: make(map[string]*DirectoryCache)}
+}
+
+// SetFilms saves the films below dir with a template of their own, so media servers don't take them for specials.
+func (l *Library) SetFilms(dir string, template *naming.Template) *Library {
+	l.filmDir = dir
+	l.filmTemplate = template
+	return l
+}
+
+// IsFilm reports whether the episode of the season is saved as a film.
+func (l *Library) IsFilm(season uint32) bool {
+	return season == 0 && l.filmTemplate != nil
+}
+
+// Path returns the path of the episode without the extension.
+func (l *Library) Path(fields naming.Fields) string {
+	dir, template := l.layout(fields)
+	return filepath.Join(dir, template.Render(fields))
+}
+
+// Exists reports whether the episode was saved in any container and in any folder below the one of its series.
+// Templates with a series folder only have that one searched, other series can have files of the same name.
+func (l *Library) Exists(fields naming.Fields) bool {
+	dir, template := l.layout(fields)
+	cache := l.cache(filepath.Join(dir, template.SeriesPath(fields.Series)))
+	return cache != nil && cache.CheckIfEpisodeExists(template, fields)
+}
+
+func (l *Library) layout(fields naming.Fields) (string, *naming.Template) {
+	if l.IsFilm(fields.Season) {
+		return l.filmDir, l.filmTemplate
+	}
+	return l.dir, l.template
+}
+
+// cache reads the files below dir the first time they are needed. Films and episodes share it if they are saved
+// into the same folder.
+func (l *Library) cache(dir string) *DirectoryCache {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if cache, ok := l.caches[dir]; ok {
+		return cache
+	}
+	cache, err := NewDirectoryCache(dir)
+	if err != nil {
+		slog.Warn("Failed to read existing files", "directory", dir, "error", err)
+	}
+	l.caches[dir] = cache
+	return cache
+}
@@ -0,0 +1,84 @@
+package download
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bugmaschine/gad/pkg/naming"
+)
+
+func TestLibrary(t *testing.T) {
+	dir, films := t.TempDir(), t.TempDir()
+	library := NewLibrary(dir, naming.Default().WithSeasonFolders()).
+		SetFilms(films, naming.MustParse(naming.FilmFolderTemplate))
+
+	episode := naming.Fields{Series: "Show", Season: 1, Episode: 2, Type: "GerDub"}
+	if got, want := library.Path(episode), filepath.Join(dir, "Season 01", "Show - S01E02 - GerDub"); got != want {
+		t.Errorf("episode: got %q, want %q", got, want)
+	}
+	film := naming.Fields{Series: "Show", Episode: 1, Type: "GerDub", Title: "The Film"}
+	if got, want := library.Path(film), filepath.Join(films, "Show - Film 1 (The Film)", "Show - Film 1 (The Film) - GerDub"); got != want {
+		t.Errorf("film: got %q, want %q", got, want)
+	}
+
+	// The episode was saved flat by an earlier run, the film is looked for in the movies folder
+	if err := os.WriteFile(filepath.Join(dir, "Show - S01E02 - GerDub.mp4"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !library.Exists(episode) {
+		t.Errorf("episode outside of its season folder wasn't found")
+	}
+	if library.Exists(film) {
+		t.Errorf("film was found before it was saved")
+	}
+}
+
+func TestLibraryAbsoluteFilms(t *testing.T) {
+	dir := t.TempDir()
+	library := NewLibrary(dir, naming.MustParse("{series} - {absolute:03}[ - {type}]")).
+		SetFilms(dir, naming.MustParse(naming.FilmTemplate))
+
+	first := naming.Fields{Series: "Show", Episode: 1, Type: "GerDub", Title: "First"}
+	second := naming.Fields{Series: "Show", Episode: 2, Type: "GerDub", Title: "Second"}
+	if got, want := library.Path(first), filepath.Join(dir, "Show - Film 1 (First) - GerDub"); got != want {
+		t.Errorf("film: got %q, want %q", got, want)
+	}
+	if library.Path(first) == library.Path(second) {
+		t.Errorf("films got the same path")
+	}
+
+	// An episode with an absolute number must not count as a film
+	if err := os.WriteFile(filepath.Join(dir, "Show - 001 - GerDub.mp4"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if library.Exists(first) {
+		t.Errorf("film was found before it was saved")
+	}
+}
+
+func TestLibrarySeriesFolders(t *testing.T) {
+	dir := t.TempDir()
+	library := NewLibrary(dir, naming.MustParse("{series}/Season {season:02}/{season}x{episode:02}[ - {type}]"))
+
+	// Both series have a season 1, but only the other one has its first episode
+	for _, path := range []string{"Other/Season 01/1x01 - GerDub.mkv", "Show/Season 01/1x02 - GerDub.mkv"} {
+		path = filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if library.Exists(naming.Fields{Series: "Show", Season: 1, Episode: 1, Type: "GerDub"}) {
+		t.Errorf("the episode of the other series counted for this one")
+	}
+	if !library.Exists(naming.Fields{Series: "Show", Season: 1, Episode: 2, Type: "GerDub"}) {
+		t.Errorf("the episode in the series folder wasn't found")
+	}
+	if !library.Exists(naming.Fields{Series: "Other", Season: 1, Episode: 1, Unknown: []string{"type"}}) {
+		t.Errorf("the episode of the other series wasn't found in its own folder")
+	}
+}
@@ -2,16 +2,19 @@ package download
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"os"
 	"path/filepath"
 	"sync"
 
 	"github.com/bugmaschine/gad/internal/downloaders"
+	"github.com/bugmaschine/gad/pkg/nfo"
 )
 
 type ManagerTask struct {
-	DownloadUrl string
-	Referer     string
+	// Candidates are tried in order until one of them downloads successfully
+	Candidates  []downloaders.StreamCandidate
 	Language    downloaders.Language
 	VideoType   downloaders.VideoType
 	EpisodeInfo downloaders.EpisodeInfo
@@ -21,12 +24,14 @@ type DownloadManager struct {
 	downloader    *Downloader
 	tasks         chan ManagerTask
 	maxConcurrent int
-	saveDir       string
+	library       *Library
 	seriesInfo    downloaders.SeriesInfo
 	skipExisting  bool
+	writeNfo      bool
+	includeTitles bool
 }
 
-func NewDownloadManager(d *Downloader, maxConcurrent int, saveDir string, info downloaders.SeriesInfo, skip bool) *DownloadManager {
+func NewDownloadManager(d *Downloader, maxConcurrent int, library *Library, info downloaders.SeriesInfo, skip bool) *DownloadManager {
 	if maxConcurrent <= 0 {
 		maxConcurrent = 1
 	}
@@ -34,12 +39,22 @@ func NewDownloadManager(d *Downloader, maxConcurrent int, saveDir string, info d
 		downloader:    d,
 		tasks:         make(chan ManagerTask, 100),
 		maxConcurrent: maxConcurrent,
-		saveDir:       saveDir,
+		library:       library,
 		seriesInfo:    info,
 		skipExisting:  skip,
 	}
 }
 
+// SetWriteNfo writes an .nfo file next to every finished episode.
+func (m *DownloadManager) SetWriteNfo(write bool) {
+	m.writeNfo = write
+}
+
+// SetIncludeTitles puts the episode titles into the file names.
+func (m *DownloadManager) SetIncludeTitles(include bool) {
+	m.includeTitles = include
+}
+
 func (m *DownloadManager) Submit(task ManagerTask) {
 	m.tasks <- task
 }
@@ -49,42 +64,38 @@ func (m *DownloadManager) Close() {
 }
 
 func (m *DownloadManager) ProgressDownloads(ctx context.Context) error {
-	seriesName := PrepareSeriesNameForFile(m.seriesInfo.Title)
-	cache, _ := NewDirectoryCache(m.saveDir)
-
 	var wg sync.WaitGroup
 	sem := make(chan struct{}, m.maxConcurrent)
 	errChan := make(chan error, 1)
 
 	for task := range m.tasks {
-		slog.Debug("Download manager received task", "url", task.DownloadUrl, "ep", task.EpisodeInfo)
+		slog.Debug("Download manager received task", "candidates", len(task.Candidates), "ep", task.EpisodeInfo)
 		wg.Add(1)
 		go func(t ManagerTask) {
 			defer wg.Done()
 			sem <- struct{}{}
 			defer func() { <-sem }()
 
-			outputName := GetEpisodeName(seriesName, &t.VideoType, &t.EpisodeInfo, false)
+			// The title is what tells films apart, so they always get it
+			includeTitle := m.includeTitles || m.library.IsFilm(t.EpisodeInfo.Season)
+			fields := EpisodeFields(m.seriesInfo.Title, &t.VideoType, &t.EpisodeInfo, includeTitle)
+			outputPath := m.library.Path(fields)
+			outputName := filepath.Base(outputPath)
 
-			if m.skipExisting && cache != nil && cache.CheckIfEpisodeExists(outputName) {
+			// Files with and without the title count, so turning titles on doesn't download everything again
+			if m.skipExisting && m.library.Exists(EpisodeFields(m.seriesInfo.Title, &t.VideoType, &t.EpisodeInfo, true)) {
 				slog.Info("skipping download for file: already exists", "file", outputName)
-				slog.Debug("File exists check passed", "file", outputName)
+				slog.Debug("File exists check passed", "file", outputPath)
 				return
 			}
 
-			dt := NewDownloadTask(filepath.Join(m.saveDir, outputName), t.DownloadUrl).
-				SetSkipExisting(m.skipExisting).
-				SetReferer(t.Referer)
-
-			if err := m.downloader.DownloadToFile(ctx, dt); err != nil {
+			if err := m.downloadCandidates(ctx, t, outputPath); err != nil {
 				slog.Warn("Failed download", "file", outputName, "error", err)
 
 				select {
 				case errChan <- err:
 				default:
 				}
-			} else {
-				slog.Debug("Download finished successfully", "file", outputName)
 			}
 		}(task)
 	}
@@ -97,5 +108,58 @@ func (m *DownloadManager) ProgressDownloads(ctx context.Context) error {
 	default:
 		return nil
 	}
+}
+
+// downloadCandidates tries every hoster of the task in order and stops at the first successful download.
+func (m *DownloadManager) downloadCandidates(ctx context.Context, t ManagerTask, outputPath string) error {
+	if len(t.Candidates) == 0 {
+		return fmt.Errorf("no download candidates")
+	}
+
+	outputName := filepath.Base(outputPath)
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return err
+	}
+
+	var lastErr error
+	for i, candidate := range t.Candidates {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		dt := NewDownloadTask(outputPath, candidate.Url).
+			SetSkipExisting(m.skipExisting).
+			SetReferer(candidate.Referer).
+			SetVerify(true).
+			SetMetadata(m.metadata(t))
+
+		err := m.downloader.DownloadToFile(ctx, dt)
+		if err == nil {
+			slog.Info("Download finished", "file", outputName, "hoster", candidate.Hoster)
+			if m.writeNfo {
+				if err := nfo.WriteEpisode(outputPath+".nfo", m.seriesInfo.Title, t.EpisodeInfo); err != nil {
+					slog.Warn("Failed to write episode .nfo", "file", outputName, "error", err)
+				}
+			}
+			return nil
+		}
+
+		lastErr = err
+		if i < len(t.Candidates)-1 {
+			slog.Warn("Download failed, trying next hoster", "file", outputName, "hoster", candidate.Hoster, "next", t.Candidates[i+1].Hoster, "error", err)
+		}
+	}
 
+	return fmt.Errorf("all %d hosters failed: %w", len(t.Candidates), lastErr)
+}
+
+// metadata returns the tags of the task's episode.
+func (m *DownloadManager) metadata(t ManagerTask) *Metadata {
+	return &Metadata{
+		Show:     m.seriesInfo.Title,
+		Season:   t.EpisodeInfo.Season,
+		Episode:  t.EpisodeInfo.Episode,
+		Title:    t.EpisodeInfo.Title,
+		Language: t.VideoType.AudioLanguage().ISO6392(),
+	}
 }
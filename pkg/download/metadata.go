@@ -0,0 +1,33 @@
+package download
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Metadata is written into the container of finished episodes, so media servers and players don't have to rely on the filename.
+type Metadata struct {
+	Show    string
+	Season  uint32
+	Episode uint32
+	// Title is the episode title, "" if it isn't known
+	Title string
+	// Language is the ISO 639-2 code of the audio, "" if it isn't known
+	Language string
+}
+
+// ffmpegArgs returns the FFmpeg options for the container tags. The names are the ones FFmpeg's MP4 muxer maps
+// to the iTunes TV tags, Matroska takes them as they are.
+func (m *Metadata) ffmpegArgs() []string {
+	title := m.Title
+	if title == "" {
+		title = fmt.Sprintf("%s - S%02dE%02d", m.Show, m.Season, m.Episode)
+	}
+	return []string{
+		"-metadata", "title=" + title,
+		"-metadata", "show=" + m.Show,
+		"-metadata", "season_number=" + strconv.FormatUint(uint64(m.Season), 10),
+		"-metadata", "episode_sort=" + strconv.FormatUint(uint64(m.Episode), 10),
+		"-metadata", fmt.Sprintf("episode_id=S%02dE%02d", m.Season, m.Episode),
+	}
+}
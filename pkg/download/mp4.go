@@ -0,0 +1,507 @@
+package download
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A small MP4 muxer for the built-in remuxer. The samples are written to a temporary mdat file while the
+// transport streams are read, and only their sizes and timestamps are kept in memory. At the end the moov box
+// goes in front of the samples, so players can start without reading the whole file.
+
+const (
+	movieTimescale = 1000
+	tsTimescale    = 90000
+	aacFrameSize   = 1024
+)
+
+type mp4Track struct {
+	id       uint32
+	video    bool
+	language string
+
+	// H.264
+	sps, pps      []byte
+	width, height int
+	// AAC
+	audioConfig []byte
+	sampleRate  int
+	channels    int
+
+	timescale uint32
+	// start is the presentation time of the first sample in 90 kHz, used to line up the tracks
+	start      int64
+	dts        []int64
+	ctsOffsets []int32
+	sizes      []uint32
+	keyframes  []uint32
+	chunks     []mp4Chunk
+}
+
+// mp4Chunk is a run of samples of one track that were written right after each other.
+type mp4Chunk struct {
+	offset  int64
+	samples uint32
+}
+
+type mp4Muxer struct {
+	mdat   *os.File
+	size   int64
+	last   *mp4Track
+	tracks []*mp4Track
+}
+
+func newMP4Muxer(dir string) (*mp4Muxer, error) {
+	mdat, err := os.CreateTemp(dir, ".mdat-*"+PartSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &mp4Muxer{mdat: mdat}, nil
+}
+
+func (m *mp4Muxer) addTrack(video bool, language string) *mp4Track {
+	track := &mp4Track{id: uint32(len(m.tracks) + 1), video: video, language: language, start: noTimestamp}
+	m.tracks = append(m.tracks, track)
+	return track
+}
+
+// writeSample appends a sample made of the given parts to the mdat.
+func (m *mp4Muxer) writeSample(track *mp4Track, dts int64, ctsOffset int32, keyframe bool, parts ...[]byte) error {
+	var size int
+	for _, part := range parts {
+		if _, err := m.mdat.Write(part); err != nil {
+			return err
+		}
+		size += len(part)
+	}
+
+	if m.last == track {
+		track.chunks[len(track.chunks)-1].samples++
+	} else {
+		track.chunks = append(track.chunks, mp4Chunk{offset: m.size, samples: 1})
+	}
+	m.last = track
+	m.size += int64(size)
+
+	track.sizes = append(track.sizes, uint32(size))
+	track.dts = append(track.dts, dts)
+	track.ctsOffsets = append(track.ctsOffsets, ctsOffset)
+	if keyframe {
+		track.keyframes = append(track.keyframes, uint32(len(track.sizes)))
+	}
+	return nil
+}
+
+func (m *mp4Muxer) close() {
+	m.mdat.Close()
+	os.Remove(m.mdat.Name())
+}
+
+// finish writes the MP4 file with the moov box in front of the samples.
+func (m *mp4Muxer) finish(path string) error {
+	var tracks []*mp4Track
+	for _, track := range m.tracks {
+		if len(track.sizes) > 0 {
+			tracks = append(tracks, track)
+		}
+	}
+	if len(tracks) == 0 {
+		return errors.New("no samples to remux")
+	}
+	for _, track := range tracks {
+		if track.video && (track.sps == nil || track.pps == nil) {
+			return errors.New("no SPS or PPS in the video stream")
+		}
+		if !track.video && track.audioConfig == nil {
+			return errors.New("no AAC configuration in the audio stream")
+		}
+	}
+
+	ftyp := mp4Box("ftyp", []byte("isom"), u32(512), []byte("isomiso2avc1mp41"))
+	mdatHeader := mp4Box("mdat")
+	if m.size+8 > 0xffffffff {
+		mdatHeader = append(u32(1), []byte("mdat")...)
+		mdatHeader = binary.BigEndian.AppendUint64(mdatHeader, uint64(m.size+16))
+	} else {
+		binary.BigEndian.PutUint32(mdatHeader, uint32(m.size+8))
+	}
+
+	// The size of the moov box doesn't depend on the offsets, so it's built once to learn where the samples start
+	large := int64(len(ftyp))+int64(len(mdatHeader))+m.size > 0xffffffff
+	moov := m.moov(tracks, 0, large)
+	base := int64(len(ftyp)) + int64(len(moov)) + int64(len(mdatHeader))
+	large = base+m.size > 0xffffffff
+	moov = m.moov(tracks, base, large)
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for _, data := range [][]byte{ftyp, moov, mdatHeader} {
+		if _, err := file.Write(data); err != nil {
+			return err
+		}
+	}
+	if _, err := m.mdat.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, m.mdat); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func (m *mp4Muxer) moov(tracks []*mp4Track, base int64, large bool) []byte {
+	// The track that starts first defines the start of the movie, the others are delayed with an empty edit
+	start := tracks[0].start
+	for _, track := range tracks {
+		start = min(start, track.start)
+	}
+
+	var duration int64
+	traks := make([][]byte, 0, len(tracks))
+	for _, track := range tracks {
+		delay := (track.start - start) * movieTimescale / tsTimescale
+		duration = max(duration, delay+track.mediaDuration()*movieTimescale/int64(track.timescale))
+		traks = append(traks, track.trak(base, large, delay))
+	}
+
+	mvhd := mp4FullBox("mvhd", 0, 0, u32(0), u32(0), u32(movieTimescale), u32(uint32(duration)),
+		u32(0x00010000), u16(0x0100), make([]byte, 10), identityMatrix(), make([]byte, 24), u32(uint32(len(tracks)+1)))
+	return mp4Box("moov", append([][]byte{mvhd}, traks...)...)
+}
+
+// mediaDuration is the duration of the track in its own timescale. The last sample lasts as long as the one before.
+func (t *mp4Track) mediaDuration() int64 {
+	n := len(t.dts)
+	if n == 1 {
+		return int64(t.defaultDuration())
+	}
+	return t.dts[n-1] - t.dts[0] + (t.dts[n-1] - t.dts[n-2])
+}
+
+func (t *mp4Track) defaultDuration() uint32 {
+	if t.video {
+		return tsTimescale / 25
+	}
+	return aacFrameSize
+}
+
+func (t *mp4Track) trak(base int64, large bool, delay int64) []byte {
+	duration := t.mediaDuration()
+	movieDuration := uint32(duration * movieTimescale / int64(t.timescale))
+
+	var width, height uint32
+	var volume uint16
+	if t.video {
+		width, height = uint32(t.width)<<16, uint32(t.height)<<16
+	} else {
+		volume = 0x0100
+	}
+	tkhd := mp4FullBox("tkhd", 0, 3, u32(0), u32(0), u32(t.id), u32(0), u32(movieDuration),
+		make([]byte, 8), u16(0), u16(0), u16(volume), u16(0), identityMatrix(), u32(width), u32(height))
+
+	// Skip the composition offset of the first sample, so the presentation starts right away
+	var edits [][]byte
+	if delay > 0 {
+		edits = append(edits, u32(uint32(delay)), u32(0xffffffff), u32(0x00010000))
+	}
+	edits = append(edits, u32(movieDuration), u32(uint32(t.ctsOffsets[0])), u32(0x00010000))
+	edts := mp4Box("edts", mp4FullBox("elst", 0, 0, append([][]byte{u32(uint32(len(edits) / 3))}, edits...)...))
+
+	handler, handlerName, mediaHeader := "soun", "SoundHandler", mp4FullBox("smhd", 0, 0, u16(0), u16(0))
+	if t.video {
+		handler, handlerName, mediaHeader = "vide", "VideoHandler", mp4FullBox("vmhd", 0, 1, u16(0), make([]byte, 6))
+	}
+	mdhd := mp4FullBox("mdhd", 0, 0, u32(0), u32(0), u32(t.timescale), u32(uint32(duration)), u16(mp4Language(t.language)), u16(0))
+	hdlr := mp4FullBox("hdlr", 0, 0, u32(0), []byte(handler), make([]byte, 12), append([]byte(handlerName), 0))
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, u32(1), mp4FullBox("url ", 0, 1)))
+	minf := mp4Box("minf", mediaHeader, dinf, t.stbl(base, large))
+
+	return mp4Box("trak", tkhd, edts, mp4Box("mdia", mdhd, hdlr, minf))
+}
+
+func (t *mp4Track) stbl(base int64, large bool) []byte {
+	boxes := [][]byte{mp4FullBox("stsd", 0, 0, u32(1), t.sampleEntry())}
+
+	// Sample durations, run length encoded
+	var stts [][]byte
+	var count, last uint32
+	for i := range t.dts {
+		delta := t.defaultDuration()
+		if i+1 < len(t.dts) {
+			delta = uint32(t.dts[i+1] - t.dts[i])
+		} else if i > 0 {
+			delta = uint32(t.dts[i] - t.dts[i-1])
+		}
+		if count > 0 && delta == last {
+			count++
+			continue
+		}
+		if count > 0 {
+			stts = append(stts, u32(count), u32(last))
+		}
+		count, last = 1, delta
+	}
+	stts = append(stts, u32(count), u32(last))
+	boxes = append(boxes, mp4FullBox("stts", 0, 0, append([][]byte{u32(uint32(len(stts) / 2))}, stts...)...))
+
+	var hasOffsets bool
+	for _, offset := range t.ctsOffsets {
+		hasOffsets = hasOffsets || offset != 0
+	}
+	if hasOffsets {
+		var ctts [][]byte
+		count, last = 0, 0
+		for _, offset := range t.ctsOffsets {
+			if count > 0 && uint32(offset) == last {
+				count++
+				continue
+			}
+			if count > 0 {
+				ctts = append(ctts, u32(count), u32(last))
+			}
+			count, last = 1, uint32(offset)
+		}
+		ctts = append(ctts, u32(count), u32(last))
+		boxes = append(boxes, mp4FullBox("ctts", 0, 0, append([][]byte{u32(uint32(len(ctts) / 2))}, ctts...)...))
+	}
+
+	if t.video {
+		stss := [][]byte{u32(uint32(len(t.keyframes)))}
+		for _, sample := range t.keyframes {
+			stss = append(stss, u32(sample))
+		}
+		boxes = append(boxes, mp4FullBox("stss", 0, 0, stss...))
+	}
+
+	// Chunks with the same number of samples in a row share an entry
+	var stsc [][]byte
+	for i, chunk := range t.chunks {
+		if i == 0 || chunk.samples != t.chunks[i-1].samples {
+			stsc = append(stsc, u32(uint32(i+1)), u32(chunk.samples), u32(1))
+		}
+	}
+	boxes = append(boxes, mp4FullBox("stsc", 0, 0, append([][]byte{u32(uint32(len(stsc) / 3))}, stsc...)...))
+
+	stsz := make([]byte, 0, 4*len(t.sizes))
+	for _, size := range t.sizes {
+		stsz = binary.BigEndian.AppendUint32(stsz, size)
+	}
+	boxes = append(boxes, mp4FullBox("stsz", 0, 0, u32(0), u32(uint32(len(t.sizes))), stsz))
+
+	offsets := u32(uint32(len(t.chunks)))
+	for _, chunk := range t.chunks {
+		if large {
+			offsets = binary.BigEndian.AppendUint64(offsets, uint64(base+chunk.offset))
+		} else {
+			offsets = binary.BigEndian.AppendUint32(offsets, uint32(base+chunk.offset))
+		}
+	}
+	if large {
+		boxes = append(boxes, mp4FullBox("co64", 0, 0, offsets))
+	} else {
+		boxes = append(boxes, mp4FullBox("stco", 0, 0, offsets))
+	}
+
+	return mp4Box("stbl", boxes...)
+}
+
+func (t *mp4Track) sampleEntry() []byte {
+	if t.video {
+		avcC := mp4Box("avcC", []byte{1, t.sps[1], t.sps[2], t.sps[3], 0xff, 0xe1}, u16(uint16(len(t.sps))), t.sps,
+			[]byte{1}, u16(uint16(len(t.pps))), t.pps)
+		return mp4Box("avc1", make([]byte, 6), u16(1), make([]byte, 16), u16(uint16(t.width)), u16(uint16(t.height)),
+			u32(0x00480000), u32(0x00480000), u32(0), u16(1), make([]byte, 32), u16(0x0018), u16(0xffff), avcC)
+	}
+
+	decoderSpecific := mp4Descriptor(0x05, t.audioConfig)
+	decoderConfig := mp4Descriptor(0x04, append([]byte{0x40, 0x15, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, decoderSpecific...))
+	es := mp4Descriptor(0x03, append(append([]byte{0, 0, 0}, decoderConfig...), mp4Descriptor(0x06, []byte{0x02})...))
+	return mp4Box("mp4a", make([]byte, 6), u16(1), make([]byte, 8), u16(uint16(t.channels)), u16(16), u16(0), u16(0),
+		u32(uint32(t.sampleRate)<<16), mp4FullBox("esds", 0, 0, es))
+}
+
+func mp4Box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	box := make([]byte, 0, size)
+	box = binary.BigEndian.AppendUint32(box, uint32(size))
+	box = append(box, typ...)
+	for _, p := range payload {
+		box = append(box, p...)
+	}
+	return box
+}
+
+func mp4FullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := u32(uint32(version)<<24 | flags&0xffffff)
+	return mp4Box(typ, append([][]byte{header}, payload...)...)
+}
+
+// mp4Descriptor is an MPEG-4 descriptor with a size of up to 127 bytes.
+func mp4Descriptor(tag byte, payload []byte) []byte {
+	return append([]byte{tag, byte(len(payload))}, payload...)
+}
+
+// mp4Language packs an ISO 639-2 code into 15 bits, "und" if the code doesn't have three letters.
+func mp4Language(language string) uint16 {
+	if len(language) != 3 {
+		language = "und"
+	}
+	var packed uint16
+	for i := 0; i < 3; i++ {
+		c := language[i] | 0x20
+		if c < 'a' || c > 'z' {
+			return mp4Language("und")
+		}
+		packed = packed<<5 | uint16(c-0x60)
+	}
+	return packed
+}
+
+func identityMatrix() []byte {
+	var matrix []byte
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		matrix = binary.BigEndian.AppendUint32(matrix, v)
+	}
+	return matrix
+}
+
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+
+// parseSPS returns the picture size of an H.264 sequence parameter set.
+func parseSPS(sps []byte) (width, height int, err error) {
+	if len(sps) < 4 {
+		return 0, 0, errors.New("SPS too short")
+	}
+	r := &bitReader{data: unescapeNAL(sps[1:])}
+	profile := r.bits(8)
+	r.bits(16) // constraint flags and level
+	r.ue()     // seq_parameter_set_id
+
+	chromaFormat := uint32(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			r.bits(1) // separate_colour_plane_flag
+		}
+		r.ue()    // bit_depth_luma_minus8
+		r.ue()    // bit_depth_chroma_minus8
+		r.bits(1) // qpprime_y_zero_transform_bypass_flag
+		if r.bits(1) == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bits(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bits(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		for n := r.ue(); n > 0 && r.err == nil; n-- {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.bits(1) // gaps_in_frame_num_value_allowed_flag
+	widthMbs := int(r.ue()) + 1
+	heightMapUnits := int(r.ue()) + 1
+	frameMbsOnly := int(r.bits(1))
+	if frameMbsOnly == 0 {
+		r.bits(1) // mb_adaptive_frame_field_flag
+	}
+	r.bits(1) // direct_8x8_inference_flag
+
+	width = widthMbs * 16
+	height = (2 - frameMbsOnly) * heightMapUnits * 16
+	if r.bits(1) == 1 {
+		left, right, top, bottom := int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+		cropX, cropY := 1, 2-frameMbsOnly
+		switch chromaFormat {
+		case 1:
+			cropX, cropY = 2, 2*(2-frameMbsOnly)
+		case 2:
+			cropX = 2
+		}
+		width -= (left + right) * cropX
+		height -= (top + bottom) * cropY
+	}
+
+	if r.err != nil || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid SPS")
+	}
+	return width, height, nil
+}
+
+// bitReader reads the Exp-Golomb coded fields of H.264 parameter sets.
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			r.err = io.ErrUnexpectedEOF
+			return 0
+		}
+		v = v<<1 | uint32(r.data[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.bits(1) == 0 {
+		if r.err != nil || zeros > 31 {
+			r.err = errors.New("invalid Exp-Golomb code")
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v%2 == 1 {
+		return int32(v/2 + 1)
+	}
+	return -int32(v / 2)
+}
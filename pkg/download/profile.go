@@ -0,0 +1,175 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/bugmaschine/gad/pkg/retry"
+)
+
+// Container is the file format finished episodes are saved in.
+type Container string
+
+const (
+	ContainerMP4 Container = "mp4"
+	ContainerMKV Container = "mkv"
+	ContainerTS  Container = "ts"
+)
+
+// containerExtensions holds the extension of every container. A finished episode is recognized by any of them,
+// so switching the container doesn't download the existing episodes again.
+var containerExtensions = []string{".mp4", ".mkv", ".ts"}
+
+func ParseContainer(input string) (Container, error) {
+	switch container := Container(strings.TrimPrefix(strings.ToLower(strings.TrimSpace(input)), ".")); container {
+	case ContainerMP4, ContainerMKV, ContainerTS:
+		return container, nil
+	case "":
+		return ContainerMP4, nil
+	default:
+		return "", fmt.Errorf("unknown container: %s", input)
+	}
+}
+
+// Ext returns the file extension of the container.
+func (c Container) Ext() string {
+	return "." + string(c)
+}
+
+// x264Presets are the presets the encode profile accepts, from fastest to smallest.
+var x264Presets = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow"}
+
+// encodeCRF is the quality the encode profile re-encodes with. x264's default keeps the quality close to the source.
+const encodeCRF = "23"
+
+// Profile decides the container of finished episodes and how FFmpeg post-processes them.
+type Profile struct {
+	Name      string
+	Container Container
+	// FastStart moves the MP4 index to the front, so players can start before the whole file is read
+	FastStart bool
+	// Preset re-encodes the video with x264 at this preset, the streams are copied if it is empty
+	Preset string
+}
+
+// ParseProfile parses a profile name: copy, mkv, faststart or encode[:preset].
+// The container applies to copy and encode, and has to match the one of the other profiles if it is set.
+func ParseProfile(input, container string) (Profile, error) {
+	var c Container
+	if strings.TrimSpace(container) != "" {
+		var err error
+		if c, err = ParseContainer(container); err != nil {
+			return Profile{}, err
+		}
+	}
+
+	name, preset, hasPreset := strings.Cut(strings.ToLower(strings.TrimSpace(input)), ":")
+	profile := Profile{Name: name, Container: c}
+	switch name {
+	case "", "copy":
+		profile.Name = "copy"
+	case "mkv":
+		profile.Container = ContainerMKV
+	case "faststart":
+		profile.Container = ContainerMP4
+		profile.FastStart = true
+	case "encode":
+		profile.Preset = "medium"
+		if hasPreset {
+			if !slices.Contains(x264Presets, preset) {
+				return Profile{}, fmt.Errorf("unknown x264 preset: %s (one of %s)", preset, strings.Join(x264Presets, ", "))
+			}
+			profile.Preset = preset
+		}
+	default:
+		return Profile{}, fmt.Errorf("unknown profile: %s", input)
+	}
+	if hasPreset && name != "encode" {
+		return Profile{}, fmt.Errorf("only the encode profile takes a preset: %s", input)
+	}
+	if c != "" && c != profile.Container {
+		return Profile{}, fmt.Errorf("the %s profile saves %s files, not %s", profile.Name, profile.Container, c)
+	}
+	if profile.Container == "" {
+		profile.Container = ContainerMP4
+	}
+	return profile, nil
+}
+
+// NeedsFFmpeg reports whether plain file downloads have to go through FFmpeg. Hosters serve MP4 files,
+// so only the copy profile into MP4 can keep them as they are.
+func (p Profile) NeedsFFmpeg() bool {
+	return p.Container != ContainerMP4 || p.FastStart || p.Preset != ""
+}
+
+// ffmpegArgs returns the codec and muxer arguments for an output with the extension ext.
+func (p Profile) ffmpegArgs(ext string, subtitles bool) []string {
+	ext = strings.ToLower(ext)
+	args := []string{"-c", "copy"}
+	if p.Preset != "" {
+		args = append(args, "-c:v", "libx264", "-preset", p.Preset, "-crf", encodeCRF)
+	}
+	if subtitles && ext == ".mp4" {
+		// MP4 only takes subtitles as mov_text
+		args = append(args, "-c:s", "mov_text")
+	}
+	if muxer, ok := ffmpegMuxers[ext]; ok {
+		if p.FastStart && (muxer == "mp4" || muxer == "mov") {
+			args = append(args, "-movflags", "+faststart")
+		}
+		args = append(args, "-f", muxer)
+	}
+	return args
+}
+
+// canEmbedSubtitles reports whether FFmpeg can mux text subtitles into the container.
+func canEmbedSubtitles(ext string) bool {
+	return !strings.EqualFold(ext, ".ts")
+}
+
+// finishFile post-processes a plain file download if the profile asks for it or there are tags to write, and then
+// verifies it and moves it into place. Hosters don't report a duration for their files, so only the container and
+// streams are checked. The downloaded .part file is kept if FFmpeg fails, so the next attempt doesn't have to
+// download it again.
+func (d *Downloader) finishFile(task *DownloadTask, partPath, outputPath string) error {
+	process := d.profile.NeedsFFmpeg() || task.Metadata != nil && d.ffmpegPath != ""
+	if task.OutputPathHasExtension || !process {
+		return d.finalize(partPath, outputPath, task.Verify, 0)
+	}
+	if d.ffmpegPath == "" {
+		return retry.Fatal(fmt.Errorf("the %s profile needs FFmpeg", d.profile.Name))
+	}
+
+	tempPath := outputPath + ".processed" + PartSuffix
+	slog.Debug("Post-processing with FFmpeg", "profile", d.profile.Name, "in", partPath, "out", tempPath)
+	args := []string{"-y", "-i", partPath}
+	if meta := task.Metadata; meta != nil {
+		args = append(args, meta.ffmpegArgs()...)
+		if meta.Language != "" {
+			args = append(args, "-metadata:s:a", "language="+meta.Language)
+		}
+	}
+	args = append(args, d.profile.ffmpegArgs(filepath.Ext(outputPath), false)...)
+	cmd := exec.Command(d.ffmpegPath, append(args, tempPath)...)
+	if !d.debug {
+		cmd.Stdout = nil
+		cmd.Stderr = nil
+	}
+	if err := cmd.Run(); err != nil {
+		os.Remove(tempPath)
+		return retry.Fatal(fmt.Errorf("FFmpeg post-processing failed: %w", err))
+	}
+
+	err := d.finalize(tempPath, outputPath, task.Verify, 0)
+	if err != nil && !errors.Is(err, errVerification) {
+		return err
+	}
+	os.Remove(partPath)
+	return err
+}
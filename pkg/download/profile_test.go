@@ -0,0 +1,31 @@
+package download
+
+import "testing"
+
+func TestParseProfile(t *testing.T) {
+	tests := []struct {
+		profile   string
+		container string
+		want      Profile
+		ok        bool
+	}{
+		{"copy", "", Profile{Name: "copy", Container: ContainerMP4}, true},
+		{"", "mkv", Profile{Name: "copy", Container: ContainerMKV}, true},
+		{"mkv", "", Profile{Name: "mkv", Container: ContainerMKV}, true},
+		{"mkv", "mkv", Profile{Name: "mkv", Container: ContainerMKV}, true},
+		{"mkv", "ts", Profile{}, false},
+		{"faststart", "", Profile{Name: "faststart", Container: ContainerMP4, FastStart: true}, true},
+		{"encode", "", Profile{Name: "encode", Container: ContainerMP4, Preset: "medium"}, true},
+		{"encode:slow", ".mkv", Profile{Name: "encode", Container: ContainerMKV, Preset: "slow"}, true},
+		{"encode:fastest", "", Profile{}, false},
+		{"copy:slow", "", Profile{}, false},
+		{"copy", "avi", Profile{}, false},
+		{"shrink", "", Profile{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseProfile(tt.profile, tt.container)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("%q in %q: got %+v, %v", tt.profile, tt.container, got, err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/bugmaschine/gad/pkg/retry"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+// minSplitSize is the smallest file that gets downloaded over multiple connections.
+const minSplitSize = 8 << 20
+
+var errRangesUnsupported = errors.New("server doesn't support range requests")
+
+// canSplit reports whether the response announces a file that can be fetched in byte ranges.
+func (d *Downloader) canSplit(task *DownloadTask, resp *http.Response) bool {
+	return !task.disableSplit &&
+		d.connections > 1 &&
+		resp.StatusCode == http.StatusOK &&
+		strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes") &&
+		resp.ContentLength >= minSplitSize
+}
+
+// splitDownload fetches the chunks at the same time into the preallocated .part file.
+// Every chunk is retried on its own and picks up where it stopped.
+func (d *Downloader) splitDownload(ctx context.Context, task *DownloadTask, chunks *chunkResume, partPath, message string) error {
+	targetFile, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return retry.Fatal(err)
+	}
+	defer targetFile.Close()
+
+	if err := targetFile.Truncate(chunks.Size); err != nil {
+		return retry.Fatal(err)
+	}
+	if err := chunks.save(); err != nil {
+		return retry.Fatal(err)
+	}
+
+	done := chunks.done()
+	d.ensureTotalBar()
+	d.addTotalSize(chunks.Size - done)
+
+	bar := d.progress.AddBar(chunks.Size,
+		mpb.PrependDecorators(
+			decor.Name(message, decor.WC{W: len(message) + 1}),
+			decor.CountersKibiByte("% .2f / % .2f"),
+		),
+		d.downloadInfo(),
+	)
+	bar.SetCurrent(done)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+
+	for i := range chunks.Chunks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := d.retry.Do(ctx, fmt.Sprintf("chunk %d of %s", i, task.Filename()), func() error {
+				return d.fetchChunk(ctx, task, targetFile, chunks, i, bar)
+			})
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Keep the progress for the next run, even if a chunk failed
+	if err := chunks.save(); err != nil {
+		slog.Debug("Failed to save split download state", "path", chunks.path, "error", err)
+	}
+
+	if firstErr != nil {
+		bar.Abort(true)
+		return firstErr
+	}
+	if err := targetFile.Close(); err != nil {
+		bar.Abort(true)
+		return err
+	}
+
+	bar.SetTotal(chunks.Size, true)
+	return nil
+}
+
+func (d *Downloader) fetchChunk(ctx context.Context, task *DownloadTask, targetFile *os.File, chunks *chunkResume, i int, bar *mpb.Bar) error {
+	chunks.mu.Lock()
+	chunk := chunks.Chunks[i]
+	chunks.mu.Unlock()
+
+	start := chunk.Start + chunk.Done
+	if start >= chunk.End {
+		return nil
+	}
+
+	resp, err := d.getRange(ctx, task.Url, task.Referer, fmt.Sprintf("bytes=%d-%d", start, chunk.End-1), chunks.Source.ifRange())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return retry.Fatal(errRangesUnsupported)
+	}
+	rangeStart, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || rangeStart != start || (total >= 0 && total != chunks.Size) {
+		// A different file or a server that ignores our range, both mean starting over
+		return retry.Fatal(fmt.Errorf("%w: unexpected content range %q", errRangesUnsupported, resp.Header.Get("Content-Range")))
+	}
+
+	writer := &chunkWriter{file: targetFile, offset: start, chunks: chunks, chunk: i, bar: bar, d: d}
+	remaining := chunk.End - start
+	n, err := io.Copy(writer, io.LimitReader(d.limitReader(ctx, resp.Body), remaining))
+	if err != nil {
+		return err
+	}
+	if n < remaining {
+		return fmt.Errorf("chunk %d ended early, got %d of %d bytes: %w", i, n, remaining, io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+// chunkWriter writes a chunk at its position in the file and keeps the progress up to date.
+type chunkWriter struct {
+	file   *os.File
+	offset int64
+	chunks *chunkResume
+	chunk  int
+	bar    *mpb.Bar
+	d      *Downloader
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	if n > 0 {
+		w.offset += int64(n)
+		w.chunks.advance(w.chunk, int64(n))
+		w.bar.IncrBy(n)
+		w.d.addTotalPos(int64(n))
+	}
+	return n, err
+}
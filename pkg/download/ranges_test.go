@@ -0,0 +1,220 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bugmaschine/gad/pkg/retry"
+)
+
+func TestNewChunkResume(t *testing.T) {
+	tests := []struct {
+		size   int64
+		chunks int
+		want   []chunkRecord
+	}{
+		{10, 3, []chunkRecord{{Start: 0, End: 3}, {Start: 3, End: 6}, {Start: 6, End: 10}}},
+		{12, 4, []chunkRecord{{Start: 0, End: 3}, {Start: 3, End: 6}, {Start: 6, End: 9}, {Start: 9, End: 12}}},
+		{5, 1, []chunkRecord{{Start: 0, End: 5}}},
+	}
+	for _, tt := range tests {
+		r := newChunkResume("episode.mp4.part", partSource{Size: tt.size}, tt.chunks)
+		if !slices.Equal(r.Chunks, tt.want) {
+			t.Errorf("%d bytes in %d chunks: got %v, want %v", tt.size, tt.chunks, r.Chunks, tt.want)
+		}
+	}
+}
+
+// rangeServer serves the file, and answers range requests with the whole file if ignoreRanges is set.
+type rangeServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	ranges []string
+}
+
+func newRangeServer(file []byte, ignoreRanges bool) *rangeServer {
+	s := &rangeServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("ETag", `"v1"`)
+		if ignoreRanges {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", strconv.Itoa(len(file)))
+			w.Write(file)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(file))
+	}))
+	return s
+}
+
+// requested returns the ranges of the requests so far, without the ones for the whole file.
+func (s *rangeServer) requested() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ranges []string
+	for _, r := range s.ranges {
+		if r != "" {
+			ranges = append(ranges, r)
+		}
+	}
+	slices.Sort(ranges)
+	return ranges
+}
+
+func testFile(size int) []byte {
+	file := make([]byte, size)
+	for i := range file {
+		file[i] = byte(i * 7 / 3)
+	}
+	return file
+}
+
+// chunkRanges returns the sorted Range headers that fetch the rest of the chunks.
+func chunkRanges(chunks []chunkRecord) []string {
+	var ranges []string
+	for _, c := range chunks {
+		ranges = append(ranges, fmt.Sprintf("bytes=%d-%d", c.Start+c.Done, c.End-1))
+	}
+	slices.Sort(ranges)
+	return ranges
+}
+
+func TestSplitDownload(t *testing.T) {
+	file := testFile(minSplitSize + 2)
+	server := newRangeServer(file, false)
+	defer server.Close()
+
+	outputPath := filepath.Join(t.TempDir(), "episode")
+	d := NewDownloader("", false, 0)
+	d.SetConnections(3)
+	if err := d.DownloadToFile(context.Background(), NewDownloadTask(outputPath, server.URL+"/episode.mp4")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(outputPath + ".mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, file) {
+		t.Errorf("the chunks weren't put together into the file")
+	}
+
+	// The last chunk takes the bytes that don't divide evenly
+	third := int64(len(file)) / 3
+	want := chunkRanges([]chunkRecord{{Start: 0, End: third}, {Start: third, End: 2 * third}, {Start: 2 * third, End: int64(len(file))}})
+	if got := server.requested(); !slices.Equal(got, want) {
+		t.Errorf("requested %v, want %v", got, want)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(outputPath)); len(entries) != 1 {
+		t.Errorf("files were left behind: %v", entries)
+	}
+}
+
+func TestSplitDownloadIgnoredRanges(t *testing.T) {
+	file := testFile(minSplitSize + 2)
+	server := newRangeServer(file, true)
+	defer server.Close()
+
+	outputPath := filepath.Join(t.TempDir(), "episode")
+	d := NewDownloader("", false, 0)
+	d.SetConnections(3)
+	task := NewDownloadTask(outputPath, server.URL+"/episode.mp4")
+
+	// The server announces ranges but sends the whole file, so the next attempt uses a single connection
+	err := d.DownloadToFile(context.Background(), task)
+	if err == nil || !retry.IsRetryable(err) || !task.disableSplit {
+		t.Fatalf("got %v, want a retryable error that turns splitting off", err)
+	}
+	if _, err := os.Stat(outputPath + ".mp4" + PartSuffix); !os.IsNotExist(err) {
+		t.Errorf("the .part file of the split download was kept")
+	}
+
+	if err := d.DownloadToFile(context.Background(), task); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(outputPath + ".mp4")
+	if err != nil || !bytes.Equal(got, file) {
+		t.Errorf("the single connection download didn't get the file: %v", err)
+	}
+}
+
+func TestResumeSplitDownload(t *testing.T) {
+	file := testFile(minSplitSize + 2)
+	server := newRangeServer(file, false)
+	defer server.Close()
+	url := server.URL + "/episode.mp4"
+
+	tests := []struct {
+		name string
+		// cut is the number of bytes the manifest lost while it was saved, 0 if it is complete
+		cut     int
+		resumed bool
+	}{
+		{"half done", 0, true},
+		// The progress can't be trusted, so the download starts over
+		{"broken manifest", 20, false},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		outputPath := filepath.Join(dir, "episode")
+		partPath := outputPath + ".mp4" + PartSuffix
+
+		// The first half of every chunk is in the .part file
+		chunks := newChunkResume(partPath, partSource{URL: url, Size: int64(len(file)), ETag: `"v1"`}, 3)
+		part := make([]byte, len(file))
+		for i := range chunks.Chunks {
+			c := &chunks.Chunks[i]
+			c.Done = (c.End - c.Start) / 2
+			copy(part[c.Start:c.Start+c.Done], file[c.Start:])
+		}
+		manifest, err := json.Marshal(chunks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(partPath, part, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(chunks.path, manifest[:len(manifest)-tt.cut], 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		want := chunkRanges(chunks.Chunks)
+		if !tt.resumed {
+			for i := range chunks.Chunks {
+				chunks.Chunks[i].Done = 0
+			}
+			want = chunkRanges(chunks.Chunks)
+		}
+
+		server.mu.Lock()
+		server.ranges = nil
+		server.mu.Unlock()
+		d := NewDownloader("", false, 0)
+		d.SetConnections(3)
+		if err := d.DownloadToFile(context.Background(), NewDownloadTask(outputPath, url)); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		got, err := os.ReadFile(outputPath + ".mp4")
+		if err != nil || !bytes.Equal(got, file) {
+			t.Errorf("%s: the resumed file doesn't match: %v", tt.name, err)
+		}
+		if got := server.requested(); !slices.Equal(got, want) {
+			t.Errorf("%s: requested %v, want %v", tt.name, got, want)
+		}
+	}
+}
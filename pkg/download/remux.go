@@ -0,0 +1,258 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errRemuxUnsupported is returned by the built-in remuxer for streams it can't handle.
+var errRemuxUnsupported = errors.New("the built-in remuxer only supports H.264 and AAC in MPEG-TS")
+
+// Stream types of the codecs the built-in remuxer understands.
+const (
+	streamTypeAAC  = 0x0f
+	streamTypeH264 = 0x1b
+)
+
+// canRemuxTS reports whether the built-in remuxer can turn the tracks into the output file.
+func canRemuxTS(tracks []downloadedTrack, outputPath string) bool {
+	switch strings.ToLower(filepath.Ext(outputPath)) {
+	case ".mp4", ".m4v", ".mov":
+	default:
+		return false
+	}
+	for _, track := range tracks {
+		for _, partPath := range track.partPaths {
+			if !strings.HasSuffix(partPath, ".ts"+PartSuffix) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// remuxTS turns MPEG-TS tracks into an MP4 file without FFmpeg. The first track holds the video, and its own audio
+// is kept if muxedAudio is set. The periods of a track are joined, with the timestamps continuing across them.
+func remuxTS(tracks []downloadedTrack, muxedAudio bool, outputPath string) error {
+	muxer, err := newMP4Muxer(filepath.Dir(outputPath))
+	if err != nil {
+		return err
+	}
+	defer muxer.close()
+
+	video := muxer.addTrack(true, "")
+	var muxed *mp4Track
+	if muxedAudio {
+		muxed = muxer.addTrack(false, "")
+	}
+
+	for i, track := range tracks {
+		demuxer := &tsTrackDemuxer{muxer: muxer}
+		if i == 0 {
+			demuxer.video, demuxer.audio = video, muxed
+		} else {
+			demuxer.audio = muxer.addTrack(false, track.language)
+		}
+		for _, partPath := range track.partPaths {
+			if err := demuxer.readPeriod(partPath); err != nil {
+				return fmt.Errorf("%s: %w", filepath.Base(partPath), err)
+			}
+		}
+	}
+
+	if len(video.sizes) == 0 {
+		return fmt.Errorf("%w: no H.264 video found", errRemuxUnsupported)
+	}
+	return muxer.finish(outputPath)
+}
+
+// tsTrackDemuxer moves the samples of the periods of one downloaded track into the MP4 tracks.
+type tsTrackDemuxer struct {
+	muxer *mp4Muxer
+	video *mp4Track
+	audio *mp4Track
+
+	// The first video and audio stream of the transport stream are used
+	videoPID, audioPID uint16
+
+	// offset moves the timestamps of the current period behind the previous one
+	offset    int64
+	newPeriod bool
+	lastDTS   int64
+	lastDelta int64
+
+	// AAC timestamps are counted in frames, so gaps between PES packets don't matter
+	audioFrames int64
+}
+
+func (d *tsTrackDemuxer) readPeriod(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	d.videoPID, d.audioPID = 0, 0
+	d.newPeriod = d.video != nil && len(d.video.sizes) > 0
+	return readTS(file, d.pes)
+}
+
+func (d *tsTrackDemuxer) pes(pid uint16, streamType byte, pes []byte) error {
+	switch {
+	case streamType == streamTypeH264 && d.video != nil && (d.videoPID == 0 || d.videoPID == pid):
+		d.videoPID = pid
+		return d.videoPES(pes)
+	case streamType == streamTypeAAC && d.audio != nil && (d.audioPID == 0 || d.audioPID == pid):
+		d.audioPID = pid
+		return d.audioPES(pes)
+	case d.video != nil && d.videoPID == 0 && isVideoStreamType(streamType):
+		return fmt.Errorf("%w: video stream type 0x%x", errRemuxUnsupported, streamType)
+	}
+	return nil
+}
+
+func isVideoStreamType(streamType byte) bool {
+	switch streamType {
+	case 0x01, 0x02, 0x10, 0x24, 0x42, 0xea:
+		return true
+	}
+	return false
+}
+
+func (d *tsTrackDemuxer) videoPES(pes []byte) error {
+	pts, dts, payload, err := parsePES(pes)
+	if err != nil {
+		return err
+	}
+
+	var nals [][]byte
+	keyframe := false
+	for _, nal := range splitAnnexB(payload) {
+		if len(nal.data) == 0 {
+			continue
+		}
+		switch nal.data[0] & 0x1f {
+		case 7:
+			if d.video.sps == nil {
+				width, height, err := parseSPS(nal.data)
+				if err != nil {
+					return err
+				}
+				d.video.sps = append([]byte(nil), nal.data...)
+				d.video.width, d.video.height = width, height
+			}
+		case 8:
+			if d.video.pps == nil {
+				d.video.pps = append([]byte(nil), nal.data...)
+			}
+		case 9:
+			// Access unit delimiters aren't used in MP4
+		default:
+			if nal.data[0]&0x1f == 5 {
+				keyframe = true
+			}
+			nals = append(nals, u32(uint32(len(nal.data))), nal.data)
+		}
+	}
+	if len(nals) == 0 {
+		return nil
+	}
+	if dts == noTimestamp {
+		if len(d.video.dts) == 0 {
+			return nil
+		}
+		// Without timestamps the access unit follows the previous one
+		dts = d.lastDTS + d.lastDelta - d.offset
+		pts = dts
+	}
+	// Samples before the first keyframe can't be decoded
+	if len(d.video.sizes) == 0 && !keyframe {
+		return nil
+	}
+
+	dts, pts = d.timestamp(dts), d.timestamp(pts)
+	if len(d.video.dts) > 0 && dts <= d.lastDTS {
+		dts = d.lastDTS + 1
+	}
+	if len(d.video.dts) > 0 {
+		d.lastDelta = dts - d.lastDTS
+	}
+	d.lastDTS = dts
+	if d.video.start == noTimestamp {
+		d.video.timescale = tsTimescale
+		d.video.start = pts
+	}
+	return d.muxer.writeSample(d.video, dts, int32(max(pts-dts, 0)), keyframe, nals...)
+}
+
+// timestamp unwraps the 33 bit timestamps and moves them behind the previous period.
+func (d *tsTrackDemuxer) timestamp(ts int64) int64 {
+	if d.newPeriod {
+		d.newPeriod = false
+		delta := d.lastDelta
+		if delta <= 0 {
+			delta = tsTimescale / 25
+		}
+		d.offset = d.lastDTS + delta - ts
+	}
+	ts += d.offset
+	for d.lastDTS > 0 && ts < d.lastDTS-1<<32 {
+		ts += 1 << 33
+		d.offset += 1 << 33
+	}
+	return ts
+}
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+func (d *tsTrackDemuxer) audioPES(pes []byte) error {
+	pts, _, payload, err := parsePES(pes)
+	if err != nil {
+		return err
+	}
+
+	for len(payload) >= 7 {
+		if payload[0] != 0xff || payload[1]&0xf0 != 0xf0 {
+			return errors.New("invalid ADTS frame")
+		}
+		headerSize := 7
+		if payload[1]&0x01 == 0 {
+			headerSize = 9
+		}
+		frameSize := int(payload[3]&0x03)<<11 | int(payload[4])<<3 | int(payload[5])>>5
+		if frameSize < headerSize || frameSize > len(payload) {
+			// The rest of a frame that is cut off at the end of a segment
+			break
+		}
+
+		if d.audio.audioConfig == nil {
+			rateIndex := int(payload[2] >> 2 & 0x0f)
+			if rateIndex >= len(aacSampleRates) {
+				return errors.New("invalid AAC sample rate")
+			}
+			profile := payload[2]>>6 + 1
+			channels := payload[2]&0x01<<2 | payload[3]>>6
+			d.audio.audioConfig = []byte{profile<<3 | byte(rateIndex)>>1, byte(rateIndex)<<7 | channels<<3}
+			d.audio.sampleRate = aacSampleRates[rateIndex]
+			d.audio.channels = int(channels)
+			d.audio.timescale = uint32(d.audio.sampleRate)
+		}
+		if d.audio.start == noTimestamp {
+			if pts == noTimestamp {
+				return nil
+			}
+			d.audio.start = pts + d.offset
+		}
+
+		dts := d.audioFrames * aacFrameSize
+		d.audioFrames++
+		if err := d.muxer.writeSample(d.audio, dts, 0, false, payload[headerSize:frameSize]); err != nil {
+			return err
+		}
+		payload = payload[frameSize:]
+	}
+	return nil
+}
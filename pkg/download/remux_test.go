@@ -0,0 +1,227 @@
+package download
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// bitWriter writes the Exp-Golomb coded fields of test parameter sets.
+type bitWriter struct {
+	data []byte
+	n    int
+}
+
+func (w *bitWriter) bits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[len(w.data)-1] |= byte(v>>i&1) << (7 - w.n%8)
+		w.n++
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	v++
+	size := 0
+	for x := v; x > 1; x >>= 1 {
+		size++
+	}
+	w.bits(0, size)
+	w.bits(v, size+1)
+}
+
+// testSPS builds a baseline SPS, with frame cropping if the height isn't a multiple of 16.
+func testSPS(width, height int) []byte {
+	w := &bitWriter{}
+	w.bits(66, 8) // profile_idc
+	w.bits(0, 8)
+	w.bits(31, 8) // level_idc
+	w.ue(0)       // seq_parameter_set_id
+	w.ue(0)       // log2_max_frame_num_minus4
+	w.ue(2)       // pic_order_cnt_type
+	w.ue(1)       // max_num_ref_frames
+	w.bits(0, 1)
+	w.ue(uint32(width/16 - 1))
+	w.ue(uint32((height+15)/16 - 1))
+	w.bits(1, 1) // frame_mbs_only_flag
+	w.bits(1, 1) // direct_8x8_inference_flag
+	if crop := (height+15)/16*16 - height; crop > 0 {
+		w.bits(1, 1)
+		w.ue(0)
+		w.ue(0)
+		w.ue(0)
+		w.ue(uint32(crop / 2))
+	} else {
+		w.bits(0, 1)
+	}
+	w.bits(0, 1) // vui_parameters_present_flag
+	w.bits(1, 1) // rbsp_stop_one_bit
+	return append([]byte{0x67}, w.data...)
+}
+
+func TestParseSPS(t *testing.T) {
+	for _, size := range [][2]int{{1280, 720}, {1920, 1080}, {640, 360}} {
+		width, height, err := parseSPS(testSPS(size[0], size[1]))
+		if err != nil || width != size[0] || height != size[1] {
+			t.Errorf("%dx%d: got %dx%d, %v", size[0], size[1], width, height, err)
+		}
+	}
+}
+
+func TestRemuxTS(t *testing.T) {
+	dir := t.TempDir()
+
+	sps, pps := testSPS(1280, 720), []byte{0x68, 0xce, 0x38, 0x80}
+	frames := [][]byte{
+		append([]byte{0x65}, bytes.Repeat([]byte{0x11}, 3000)...),
+		append([]byte{0x41}, bytes.Repeat([]byte{0x22}, 500)...),
+		append([]byte{0x41}, bytes.Repeat([]byte{0x33}, 400)...),
+	}
+
+	var stream []testPES
+	for i, frame := range frames {
+		es := []byte{0, 0, 0, 1, 0x09, 0xf0}
+		if i == 0 {
+			es = append(append(append(es, 0, 0, 0, 1), sps...), append([]byte{0, 0, 0, 1}, pps...)...)
+		}
+		es = append(append(es, 0, 0, 0, 1), frame...)
+		dts := int64(900000 + i*3600)
+		stream = append(stream, testPES{pid: 0x100, streamID: 0xe0, pts: dts + 3600, dts: dts, data: es})
+
+		var audio []byte
+		for f := 0; f < 2; f++ {
+			audio = append(audio, adtsFrame(100)...)
+		}
+		stream = append(stream, testPES{pid: 0x101, streamID: 0xc0, pts: dts, dts: dts, data: audio})
+	}
+
+	partPath := filepath.Join(dir, "episode.ts"+PartSuffix)
+	if err := os.WriteFile(partPath, muxTestTS(stream), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	outputPath := filepath.Join(dir, "episode.mp4")
+	tracks := []downloadedTrack{{partPaths: []string{partPath}}}
+	if !canRemuxTS(tracks, outputPath) {
+		t.Fatal("expected the tracks to be remuxable")
+	}
+	if err := remuxTS(tracks, true, outputPath); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	top := mp4Children(data)
+	if len(top) != 3 || top[0].typ != "ftyp" || top[1].typ != "moov" || top[2].typ != "mdat" {
+		t.Fatalf("unexpected top level boxes: %v", top)
+	}
+
+	traks := mp4Find(top[1].payload, "trak")
+	if len(traks) != 2 {
+		t.Fatalf("got %d tracks, want 2", len(traks))
+	}
+	stbl := mp4Path(traks[0], "mdia", "minf", "stbl")
+	if count := binary.BigEndian.Uint32(mp4Path(stbl, "stsz")[8:]); count != 3 {
+		t.Errorf("got %d video samples, want 3", count)
+	}
+	if stss := mp4Path(stbl, "stss"); binary.BigEndian.Uint32(stss[4:]) != 1 || binary.BigEndian.Uint32(stss[8:]) != 1 {
+		t.Errorf("only the first sample should be a keyframe")
+	}
+	avc1 := mp4Path(stbl, "stsd")[8:]
+	if width, height := binary.BigEndian.Uint16(avc1[32:]), binary.BigEndian.Uint16(avc1[34:]); width != 1280 || height != 720 {
+		t.Errorf("got %dx%d, want 1280x720", width, height)
+	}
+
+	// The first chunk starts with the length prefixed IDR slice
+	offset := binary.BigEndian.Uint32(mp4Path(stbl, "stco")[8:])
+	if length := binary.BigEndian.Uint32(data[offset:]); int(length) != len(frames[0]) || data[offset+4] != 0x65 {
+		t.Errorf("first sample starts with length %d and NAL header 0x%x", length, data[offset+4])
+	}
+
+	audioStbl := mp4Path(traks[1], "mdia", "minf", "stbl")
+	if count := binary.BigEndian.Uint32(mp4Path(audioStbl, "stsz")[8:]); count != 6 {
+		t.Errorf("got %d audio samples, want 6", count)
+	}
+}
+
+type testPES struct {
+	pid      uint16
+	streamID byte
+	pts, dts int64
+	data     []byte
+}
+
+// muxTestTS muxes H.264 on PID 0x100 and AAC on PID 0x101 into a transport stream.
+func muxTestTS(stream []testPES) []byte {
+	pat := []byte{0x00, 0xb0, 13, 0, 1, 0xc1, 0, 0, 0, 1, 0xf0, 0x00}
+	pat = binary.BigEndian.AppendUint32(pat, mpegCRC32(pat))
+	pmt := []byte{0x02, 0xb0, 13 + 2*5, 0, 1, 0xc1, 0, 0, 0xe1, 0x00, 0xf0, 0x00,
+		streamTypeH264, 0xe1, 0x00, 0xf0, 0x00,
+		streamTypeAAC, 0xe1, 0x01, 0xf0, 0x00}
+	pmt = binary.BigEndian.AppendUint32(pmt, mpegCRC32(pmt))
+
+	m := &sampleAESMuxer{counters: make(map[uint16]byte)}
+	first := []byte{0x47, 0x40, 0, 0x10}
+	var out []byte
+	for _, packet := range append(m.packetize(0, first, append([]byte{0}, pat...)), m.packetize(0x1000, first, append([]byte{0}, pmt...))...) {
+		out = append(out, packet...)
+	}
+	for _, pes := range stream {
+		header := []byte{0, 0, 1, pes.streamID, 0, 0, 0x80, 0xc0, 10}
+		header = append(header, testTimestamp(0x30, pes.pts)...)
+		header = append(header, testTimestamp(0x10, pes.dts)...)
+		for _, packet := range m.packetize(pes.pid, first, append(header, pes.data...)) {
+			out = append(out, packet...)
+		}
+	}
+	return out
+}
+
+func testTimestamp(prefix byte, ts int64) []byte {
+	return []byte{prefix | byte(ts>>29&0x0e) | 1, byte(ts >> 22), byte(ts>>14) | 1, byte(ts >> 7), byte(ts<<1) | 1}
+}
+
+type testBox struct {
+	typ     string
+	payload []byte
+}
+
+func mp4Children(data []byte) []testBox {
+	var boxes []testBox
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			break
+		}
+		boxes = append(boxes, testBox{typ: string(data[4:8]), payload: data[8:size]})
+		data = data[size:]
+	}
+	return boxes
+}
+
+func mp4Find(data []byte, typ string) [][]byte {
+	var found [][]byte
+	for _, box := range mp4Children(data) {
+		if box.typ == typ {
+			found = append(found, box.payload)
+		}
+	}
+	return found
+}
+
+func mp4Path(data []byte, path ...string) []byte {
+	for _, typ := range path {
+		found := mp4Find(data, typ)
+		if len(found) == 0 {
+			return nil
+		}
+		data = found[0]
+	}
+	return data
+}
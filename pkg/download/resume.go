@@ -0,0 +1,304 @@
+package download
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// resumeSuffix is appended to the .part file of a segmented or split download for its resume manifest.
+const resumeSuffix = ".json"
+
+// sourceSuffix is appended to the .part file of a plain file download for the partSource it came from.
+const sourceSuffix = ".source.json"
+
+// partSource identifies the file the bytes of a .part file came from. A download is only resumed from the same
+// file, so the bytes of another hoster or of a file that changed on the server are never appended.
+type partSource struct {
+	URL          string `json:"url"`
+	Size         int64  `json:"size"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// newPartSource returns the source of a response to a request for url. The size is -1 if the server didn't send it.
+func newPartSource(url string, resp *http.Response, size int64) partSource {
+	return partSource{
+		URL:          url,
+		Size:         size,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+}
+
+// matches reports whether url points to the same file. Hoster urls often carry tokens that change between runs,
+// so the query isn't compared, the size and the If-Range validator catch a different file behind the same path.
+func (s partSource) matches(rawURL string) bool {
+	saved, err := url.Parse(s.URL)
+	if err != nil || s.URL == "" {
+		return false
+	}
+	current, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(saved.Host, current.Host) && saved.Path == current.Path
+}
+
+// ifRange returns the validator for the If-Range header, "" if the server sent none that can be used.
+// Weak ETags aren't allowed in If-Range.
+func (s partSource) ifRange() string {
+	if s.ETag != "" && !strings.HasPrefix(s.ETag, "W/") {
+		return s.ETag
+	}
+	return s.LastModified
+}
+
+// loadPartSource reads the source of a plain .part file, false if there is none.
+func loadPartSource(partPath string) (partSource, bool) {
+	data, err := os.ReadFile(partPath + sourceSuffix)
+	if err != nil {
+		return partSource{}, false
+	}
+	var source partSource
+	if err := json.Unmarshal(data, &source); err != nil {
+		slog.Debug("Ignoring broken partial download source", "path", partPath+sourceSuffix, "error", err)
+		return partSource{}, false
+	}
+	return source, true
+}
+
+func savePartSource(partPath string, source partSource) error {
+	data, err := json.Marshal(source)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(partPath+sourceSuffix, data, 0644)
+}
+
+func removePartSource(partPath string) {
+	if err := os.Remove(partPath + sourceSuffix); err != nil && !os.IsNotExist(err) {
+		slog.Debug("Failed to remove partial download source", "path", partPath+sourceSuffix, "error", err)
+	}
+}
+
+// segmentResume records which segments of an HLS or DASH track are already in the .part files.
+// Segments are written in playlist order, so the done segments are always a prefix of the playlist.
+type segmentResume struct {
+	path        string
+	Fingerprint string          `json:"fingerprint"`
+	Segments    []segmentRecord `json:"segments"`
+}
+
+type segmentRecord struct {
+	Index  int `json:"index"`
+	Period int `json:"period"`
+	// Offset is the position in the .part file of the period
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+// loadSegmentResume reads the resume manifest next to the .part file of the first period.
+// If it belongs to a different playlist or doesn't match the .part files, the download starts over.
+func loadSegmentResume(partPaths []string, jobs []segmentJob) *segmentResume {
+	fresh := &segmentResume{
+		path:        partPaths[0] + resumeSuffix,
+		Fingerprint: playlistFingerprint(jobs),
+	}
+
+	data, err := os.ReadFile(fresh.path)
+	if err != nil {
+		return fresh
+	}
+
+	var saved segmentResume
+	if err := json.Unmarshal(data, &saved); err != nil {
+		slog.Debug("Ignoring broken segment resume state", "path", fresh.path, "error", err)
+		return fresh
+	}
+	if saved.Fingerprint != fresh.Fingerprint {
+		slog.Debug("Playlist changed since the last run, starting over", "path", fresh.path)
+		return fresh
+	}
+
+	// Only keep the records that form a contiguous prefix and are backed by data on disk
+	period := 0
+	var offset, periodSize int64
+	for i, record := range saved.Segments {
+		if i >= len(jobs) || record.Index != i || record.Period != jobs[i].period {
+			break
+		}
+		if i == 0 || record.Period != period {
+			info, err := os.Stat(partPaths[record.Period])
+			if err != nil {
+				break
+			}
+			period, offset, periodSize = record.Period, 0, info.Size()
+		}
+		if record.Offset != offset || record.Offset+record.Size > periodSize {
+			break
+		}
+		fresh.Segments = append(fresh.Segments, record)
+		offset += record.Size
+	}
+	return fresh
+}
+
+// position returns the period and offset right after the last complete segment.
+func (r *segmentResume) position() (int, int64) {
+	if len(r.Segments) == 0 {
+		return 0, 0
+	}
+	last := r.Segments[len(r.Segments)-1]
+	return last.Period, last.Offset + last.Size
+}
+
+// size returns the number of bytes written over all periods.
+func (r *segmentResume) size() int64 {
+	var size int64
+	for _, record := range r.Segments {
+		size += record.Size
+	}
+	return size
+}
+
+func (r *segmentResume) save() error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.path, data, 0644)
+}
+
+func (r *segmentResume) remove() {
+	if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+		slog.Debug("Failed to remove segment resume state", "path", r.path, "error", err)
+	}
+}
+
+// playlistFingerprint identifies a playlist across runs. Segment urls often contain expiring tokens,
+// so only the segment count, durations, byte ranges, periods and encryption methods are used.
+func playlistFingerprint(jobs []segmentJob) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d", len(jobs))
+	for _, job := range jobs {
+		fmt.Fprintf(h, "|%.3f/%d", job.duration, job.period)
+		if job.byteRange != nil {
+			fmt.Fprintf(h, "@%d+%d", job.byteRange.offset, job.byteRange.length)
+		}
+		if job.key != nil {
+			fmt.Fprintf(h, ":%s", job.key.Method)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// chunkResume records how far each chunk of a split download got, and which file the chunks are from.
+type chunkResume struct {
+	path    string
+	mu      sync.Mutex
+	unsaved int64
+	Size    int64         `json:"size"`
+	Source  partSource    `json:"source"`
+	Chunks  []chunkRecord `json:"chunks"`
+}
+
+type chunkRecord struct {
+	Start int64 `json:"start"`
+	// End is exclusive
+	End  int64 `json:"end"`
+	Done int64 `json:"done"`
+}
+
+// chunkSaveInterval is the amount of bytes written before the progress is saved again.
+const chunkSaveInterval = 4 << 20
+
+func newChunkResume(partPath string, source partSource, chunks int) *chunkResume {
+	size := source.Size
+	r := &chunkResume{path: partPath + resumeSuffix, Size: source.Size, Source: source}
+	chunkSize := size / int64(chunks)
+	for i := 0; i < chunks; i++ {
+		start := int64(i) * chunkSize
+		end := start + chunkSize
+		if i == chunks-1 {
+			end = size
+		}
+		r.Chunks = append(r.Chunks, chunkRecord{Start: start, End: end})
+	}
+	return r
+}
+
+// loadChunkResume reads the manifest of a split download, and returns nil if there is none that fits the .part file.
+func loadChunkResume(partPath string) *chunkResume {
+	path := partPath + resumeSuffix
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	r := &chunkResume{path: path}
+	if err := json.Unmarshal(data, r); err != nil || r.Size <= 0 || len(r.Chunks) == 0 {
+		slog.Debug("Ignoring broken split download state", "path", path, "error", err)
+		return nil
+	}
+	if info, err := os.Stat(partPath); err != nil || info.Size() != r.Size {
+		return nil
+	}
+	for _, c := range r.Chunks {
+		if c.Start < 0 || c.End > r.Size || c.Done < 0 || c.Start+c.Done > c.End {
+			return nil
+		}
+	}
+	return r
+}
+
+// done returns the number of bytes downloaded over all chunks.
+func (r *chunkResume) done() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var done int64
+	for _, c := range r.Chunks {
+		done += c.Done
+	}
+	return done
+}
+
+// advance records n more bytes for the chunk, and saves the progress every few megabytes.
+func (r *chunkResume) advance(chunk int, n int64) {
+	r.mu.Lock()
+	r.Chunks[chunk].Done += n
+	r.unsaved += n
+	save := r.unsaved >= chunkSaveInterval
+	r.mu.Unlock()
+
+	if save {
+		if err := r.save(); err != nil {
+			slog.Debug("Failed to save split download state", "path", r.path, "error", err)
+		}
+	}
+}
+
+func (r *chunkResume) save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	r.unsaved = 0
+	return os.WriteFile(r.path, data, 0644)
+}
+
+func (r *chunkResume) remove() {
+	if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+		slog.Debug("Failed to remove split download state", "path", r.path, "error", err)
+	}
+}
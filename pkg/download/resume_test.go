@@ -0,0 +1,259 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResumePlainDownload(t *testing.T) {
+	files := map[string][]byte{
+		"/a/episode.mp4": bytes.Repeat([]byte("a"), 1000),
+		"/b/episode.mp4": bytes.Repeat([]byte("b"), 1000),
+	}
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		w.Header().Set("ETag", `"`+strings.Trim(r.URL.Path, "/")[:1]+`"`)
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(files[r.URL.Path]))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		// source is the file the first 400 bytes of the .part file came from, "" if there is no sidecar
+		source    string
+		sourceTag string
+		url       string
+		wantRange string
+	}{
+		{"same file", "/a/episode.mp4", `"a"`, "/a/episode.mp4", "bytes=400-"},
+		{"other hoster", "/a/episode.mp4", `"a"`, "/b/episode.mp4", ""},
+		{"no sidecar", "", "", "/b/episode.mp4", ""},
+		// The server sends the whole file if the If-Range validator doesn't match
+		{"changed file", "/b/episode.mp4", `"a"`, "/b/episode.mp4", "bytes=400-"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		outputPath := filepath.Join(dir, "episode")
+		partPath := outputPath + ".mp4" + PartSuffix
+		if err := os.WriteFile(partPath, bytes.Repeat([]byte("a"), 400), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if tt.source != "" {
+			if err := savePartSource(partPath, partSource{URL: server.URL + tt.source + "?token=old", Size: 1000, ETag: tt.sourceTag}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ranges = nil
+
+		d := NewDownloader("", false, 0)
+		if err := d.DownloadToFile(context.Background(), NewDownloadTask(outputPath, server.URL+tt.url+"?token=new")); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := os.ReadFile(outputPath + ".mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, files[tt.url]) {
+			t.Errorf("%s: the file isn't the one of %s", tt.name, tt.url)
+		}
+		if len(ranges) != 1 || ranges[0] != tt.wantRange {
+			t.Errorf("%s: got requests with ranges %q, want %q", tt.name, ranges, tt.wantRange)
+		}
+		if _, err := os.Stat(partPath + sourceSuffix); !os.IsNotExist(err) {
+			t.Errorf("%s: the source sidecar wasn't removed", tt.name)
+		}
+	}
+}
+
+// hlsServer serves a media playlist with the segments, and a discontinuity before every index in breaks.
+// The segment failAt answers with an error, -1 lets all of them through.
+type hlsServer struct {
+	*httptest.Server
+	segments [][]byte
+
+	mu        sync.Mutex
+	failAt    int
+	requested []int
+}
+
+func newHLSServer(segments [][]byte, breaks ...int) *hlsServer {
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:0\n")
+	for i := range segments {
+		if slices.Contains(breaks, i) {
+			playlist.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&playlist, "#EXTINF:10,\nseg%d.ts\n", i)
+	}
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+
+	s := &hlsServer{segments: segments, failAt: -1}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/playlist.m3u8" {
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			io.WriteString(w, playlist.String())
+			return
+		}
+		var i int
+		if _, err := fmt.Sscanf(r.URL.Path, "/seg%d.ts", &i); err != nil || i >= len(segments) {
+			http.NotFound(w, r)
+			return
+		}
+		s.mu.Lock()
+		s.requested = append(s.requested, i)
+		fail := i == s.failAt
+		s.mu.Unlock()
+		if fail {
+			http.Error(w, "gone", http.StatusNotFound)
+			return
+		}
+		w.Write(segments[i])
+	}))
+	return s
+}
+
+// fail makes the segment fail from now on and forgets the requests so far.
+func (s *hlsServer) fail(segment int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failAt = segment
+	s.requested = nil
+}
+
+// firstRequested returns the lowest segment that was requested since the last call to fail.
+func (s *hlsServer) firstRequested() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requested) == 0 {
+		return -1
+	}
+	return slices.Min(s.requested)
+}
+
+func testSegments(count int) [][]byte {
+	segments := make([][]byte, count)
+	for i := range segments {
+		segments[i] = bytes.Repeat([]byte{byte('a' + i)}, 1000+i*100)
+	}
+	return segments
+}
+
+func TestResumeHLSToTS(t *testing.T) {
+	segments := testSegments(6)
+	server := newHLSServer(segments)
+	defer server.Close()
+
+	dir := t.TempDir()
+	outputPath := filepath.Join(dir, "episode")
+	profile, err := ParseProfile("copy", "ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDownloader("", false, 0)
+	d.SetProfile(profile)
+	d.SetSegmentWorkers(1)
+
+	server.fail(3)
+	if err := d.DownloadToFile(context.Background(), NewDownloadTask(outputPath, server.URL+"/playlist.m3u8")); err == nil {
+		t.Fatal("the download didn't fail")
+	}
+
+	// The plain file download must leave the .part file of the stream alone
+	server.fail(-1)
+	if err := d.DownloadToFile(context.Background(), NewDownloadTask(outputPath, server.URL+"/playlist.m3u8")); err != nil {
+		t.Fatal(err)
+	}
+	if first := server.firstRequested(); first != 3 {
+		t.Errorf("the download restarted at segment %d, want 3", first)
+	}
+	got, err := os.ReadFile(outputPath + ".ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, bytes.Join(segments, nil)) {
+		t.Errorf("the resumed download doesn't match the stream")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("files were left behind: %v", entries)
+	}
+}
+
+func TestResumeSegments(t *testing.T) {
+	segments := testSegments(6)
+	server := newHLSServer(segments)
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		periods []int
+	}{
+		{"one period", []int{0, 0, 0, 0, 0, 0}},
+		{"periods", []int{0, 0, 1, 1, 1, 2}},
+	}
+	for _, tt := range tests {
+		jobs := make([]segmentJob, len(segments))
+		for i := range jobs {
+			jobs[i] = segmentJob{index: i, url: fmt.Sprintf("%s/seg%d.ts", server.URL, i), duration: 10, period: tt.periods[i]}
+		}
+		d := NewDownloader("", false, 0)
+		d.SetSegmentWorkers(2)
+		ctx := context.Background()
+
+		server.fail(-1)
+		want, err := d.downloadSegments(ctx, jobs, ".ts", "", filepath.Join(t.TempDir(), "episode"), "episode")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		server.fail(4)
+		base := filepath.Join(t.TempDir(), "episode")
+		got, err := d.downloadSegments(ctx, jobs, ".ts", "", base, "episode")
+		if err == nil {
+			t.Fatalf("%s: the download didn't fail", tt.name)
+		}
+		if len(got.resume.Segments) != 4 {
+			t.Fatalf("%s: %d segments were recorded, want 4", tt.name, len(got.resume.Segments))
+		}
+
+		// Cut the last segment that was written in half, like a crash while writing it
+		last := got.resume.Segments[3]
+		if err := os.Truncate(got.partPaths[last.Period], last.Offset+last.Size/2); err != nil {
+			t.Fatal(err)
+		}
+
+		server.fail(-1)
+		got, err = d.downloadSegments(ctx, jobs, ".ts", "", base, "episode")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if first := server.firstRequested(); first != 3 {
+			t.Errorf("%s: the download restarted at segment %d, want 3", tt.name, first)
+		}
+		if len(got.partPaths) != len(want.partPaths) {
+			t.Fatalf("%s: got %d periods, want %d", tt.name, len(got.partPaths), len(want.partPaths))
+		}
+		for i := range want.partPaths {
+			wantData, _ := os.ReadFile(want.partPaths[i])
+			gotData, err := os.ReadFile(got.partPaths[i])
+			if err != nil || !bytes.Equal(gotData, wantData) {
+				t.Errorf("%s: period %d doesn't match the uninterrupted download (%v)", tt.name, i, err)
+			}
+		}
+	}
+}
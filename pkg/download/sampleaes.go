@@ -0,0 +1,369 @@
+package download
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SAMPLE-AES only encrypts the audio and video samples of an MPEG-TS segment, and marks the streams
+// with their own stream types. After decryption the segment is a plain MPEG-TS segment again.
+// See Apple's "MPEG-2 Stream Encryption Format for HTTP Live Streaming".
+
+// sampleAESStreamTypes maps the stream types of encrypted streams to the plain ones.
+var sampleAESStreamTypes = map[byte]byte{
+	0xdb: 0x1b, // H.264
+	0xcf: 0x0f, // AAC in ADTS
+	0xc1: 0x81, // AC-3
+	0xc2: 0x87, // E-AC-3
+}
+
+// errSampleAES marks segments that can't be decrypted, as opposed to failures reading or writing them.
+var errSampleAES = errors.New("SAMPLE-AES")
+
+// decryptSampleAES decrypts a whole MPEG-TS segment, like an init section that was fetched in one piece.
+func decryptSampleAES(data, key, iv []byte) ([]byte, error) {
+	var out bytes.Buffer
+	if err := decryptSampleAESStream(bytes.NewReader(data), &out, key, iv); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// decryptSampleAESStream decrypts an MPEG-TS segment while it is read. The PES packets of the encrypted streams
+// are collected, decrypted and written back into the packets they came from, with more or less packets if their
+// size changed. Only the packets from the oldest incomplete PES packet on are held in memory, usually a frame,
+// everything before it is written to w right away.
+func decryptSampleAESStream(r io.Reader, w io.Writer, key, iv []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errSampleAES, err)
+	}
+
+	m := &sampleAESMuxer{
+		tsTables: newTSTables(),
+		block:    block,
+		iv:       iv,
+		pes:      make(map[uint16]*pesBuffer),
+		counters: make(map[uint16]byte),
+	}
+
+	var offset int64
+	for ; ; offset += tsPacketSize {
+		// The packets are kept in the slots until they are written, so every one needs its own buffer
+		packet := make([]byte, tsPacketSize)
+		if _, err := io.ReadFull(r, packet); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if packet[0] != 0x47 {
+			if offset == 0 {
+				return fmt.Errorf("%w is only supported for MPEG-TS segments", errSampleAES)
+			}
+			return fmt.Errorf("%w: lost MPEG-TS sync at byte %d", errSampleAES, offset)
+		}
+		if err := m.packet(packet); err != nil {
+			return fmt.Errorf("%w: %w", errSampleAES, err)
+		}
+		if err := m.emit(w); err != nil {
+			return err
+		}
+	}
+	if offset == 0 {
+		return fmt.Errorf("%w: the segment is empty", errSampleAES)
+	}
+
+	for pid := range m.pes {
+		if err := m.flush(pid); err != nil {
+			return fmt.Errorf("%w: %w", errSampleAES, err)
+		}
+	}
+	return m.emit(w)
+}
+
+type sampleAESMuxer struct {
+	tsTables
+	block cipher.Block
+	iv    []byte
+
+	pes      map[uint16]*pesBuffer
+	counters map[uint16]byte
+
+	// slots holds the output in the order of the input packets that wasn't written yet, base is the number of
+	// the first of them. The slot of an encrypted packet is filled, emptied or extended once its PES packet is complete.
+	slots [][][]byte
+	base  int
+}
+
+// pesBuffer collects the packets of a PES packet of an encrypted stream.
+type pesBuffer struct {
+	first   []byte
+	slots   []int
+	payload []byte
+}
+
+func (m *sampleAESMuxer) packet(packet []byte) error {
+	pid := binary.BigEndian.Uint16(packet[1:3]) & 0x1fff
+	start := packet[1]&0x40 != 0
+	if packet[3]&0x20 != 0 && 5+int(packet[4]) > tsPacketSize {
+		// packetize copies the adaptation field of the first packet of a PES packet
+		return fmt.Errorf("adaptation field longer than its packet on PID %d", pid)
+	}
+	payload := tsPayload(packet)
+
+	switch {
+	case pid == 0 && start:
+		m.parsePAT(payload)
+	case m.pmtPIDs[pid] && start:
+		rewritten, err := m.rewritePMT(packet)
+		if err != nil {
+			return err
+		}
+		packet = rewritten
+	case sampleAESStreamTypes[m.streamTypes[pid]] != 0:
+		if start {
+			if err := m.flush(pid); err != nil {
+				return err
+			}
+			m.pes[pid] = &pesBuffer{first: packet}
+		}
+		buf := m.pes[pid]
+		if buf == nil {
+			// The PES packet started in an earlier segment, there is nothing to decrypt it with
+			break
+		}
+		if _, ok := m.counters[pid]; !ok {
+			m.counters[pid] = packet[3] & 0x0f
+		}
+		buf.slots = append(buf.slots, m.base+len(m.slots))
+		buf.payload = append(buf.payload, payload...)
+		m.slots = append(m.slots, nil)
+		return nil
+	}
+
+	m.slots = append(m.slots, [][]byte{packet})
+	return nil
+}
+
+// emit writes the slots in front of the oldest incomplete PES packet, they can't change anymore.
+func (m *sampleAESMuxer) emit(w io.Writer) error {
+	ready := len(m.slots)
+	for _, buf := range m.pes {
+		if buf != nil && len(buf.slots) > 0 {
+			ready = min(ready, buf.slots[0]-m.base)
+		}
+	}
+	for _, slot := range m.slots[:ready] {
+		for _, packet := range slot {
+			if _, err := w.Write(packet); err != nil {
+				return err
+			}
+		}
+	}
+	m.slots = m.slots[ready:]
+	m.base += ready
+	return nil
+}
+
+// rewritePMT records the stream types and replaces the SAMPLE-AES ones, so demuxers recognize the decrypted streams.
+func (m *sampleAESMuxer) rewritePMT(packet []byte) ([]byte, error) {
+	packet = append([]byte(nil), packet...)
+	section := psiSection(tsPayload(packet))
+	positions, err := m.parsePMT(section)
+	if err != nil || len(positions) == 0 {
+		return packet, err
+	}
+
+	for _, i := range positions {
+		if plain, ok := sampleAESStreamTypes[section[i]]; ok {
+			section[i] = plain
+		}
+	}
+	end := 3 + int(binary.BigEndian.Uint16(section[1:3])&0x0fff) - 4
+	binary.BigEndian.PutUint32(section[end:end+4], mpegCRC32(section[:end]))
+	return packet, nil
+}
+
+// flush decrypts the collected PES packet of the stream and packs it into its slots again.
+func (m *sampleAESMuxer) flush(pid uint16) error {
+	buf := m.pes[pid]
+	if buf == nil {
+		return nil
+	}
+	delete(m.pes, pid)
+
+	pes := buf.payload
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return fmt.Errorf("invalid PES packet on PID %d", pid)
+	}
+	headerEnd := 9 + int(pes[8])
+	if headerEnd > len(pes) {
+		return fmt.Errorf("invalid PES header on PID %d", pid)
+	}
+
+	var es []byte
+	var err error
+	switch m.streamTypes[pid] {
+	case 0xdb:
+		es = decryptH264(m.block, m.iv, pes[headerEnd:])
+	case 0xcf:
+		es, err = decryptADTS(m.block, m.iv, pes[headerEnd:])
+	default:
+		err = fmt.Errorf("SAMPLE-AES stream type 0x%x isn't supported", m.streamTypes[pid])
+	}
+	if err != nil {
+		return err
+	}
+
+	out := append(append([]byte(nil), pes[:headerEnd]...), es...)
+	if binary.BigEndian.Uint16(out[4:6]) != 0 {
+		if len(out)-6 > 0xffff {
+			binary.BigEndian.PutUint16(out[4:6], 0)
+		} else {
+			binary.BigEndian.PutUint16(out[4:6], uint16(len(out)-6))
+		}
+	}
+
+	packets := m.packetize(pid, buf.first, out)
+	for i, slot := range buf.slots {
+		switch {
+		case i == len(buf.slots)-1:
+			m.slots[slot-m.base] = packets[min(i, len(packets)):]
+		case i < len(packets):
+			m.slots[slot-m.base] = packets[i : i+1]
+		}
+	}
+	return nil
+}
+
+// packetize splits a PES packet into TS packets. The first packet keeps the header and adaptation field
+// of the original one, since it can carry the PCR. The last packet is padded with adaptation field stuffing.
+func (m *sampleAESMuxer) packetize(pid uint16, first []byte, pes []byte) [][]byte {
+	var packets [][]byte
+	for i := 0; len(pes) > 0 || i == 0; i++ {
+		header := []byte{0x47, byte(pid>>8) & 0x1f, byte(pid), 0}
+		var adaptation []byte
+		if i == 0 {
+			header[1] |= first[1] & 0xe0
+			if control := first[3] >> 4 & 0x03; control&0x02 != 0 {
+				adaptation = append([]byte{}, first[5:5+int(first[4])]...)
+			}
+		}
+
+		capacity := tsPacketSize - 4
+		if adaptation != nil {
+			capacity -= 1 + len(adaptation)
+		}
+		n := min(capacity, len(pes))
+		if stuffing := capacity - n; stuffing > 0 {
+			switch {
+			case adaptation != nil && len(adaptation) > 0:
+				adaptation = append(adaptation, repeatByte(0xff, stuffing)...)
+			case adaptation != nil:
+				// An empty adaptation field needs its flags byte before the stuffing
+				adaptation = append([]byte{0x00}, repeatByte(0xff, stuffing-1)...)
+			case stuffing == 1:
+				adaptation = []byte{}
+			default:
+				adaptation = append([]byte{0x00}, repeatByte(0xff, stuffing-2)...)
+			}
+		}
+
+		control := byte(0x10)
+		if adaptation != nil {
+			control = 0x30
+		}
+		header[3] = control | m.counters[pid]&0x0f
+		m.counters[pid]++
+
+		packet := header
+		if adaptation != nil {
+			packet = append(packet, byte(len(adaptation)))
+			packet = append(packet, adaptation...)
+		}
+		packet = append(packet, pes[:n]...)
+		pes = pes[n:]
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+func repeatByte(b byte, n int) []byte {
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = b
+	}
+	return out
+}
+
+// decryptH264 decrypts the slice NAL units of an Annex B stream. A NAL unit is encrypted without its emulation
+// prevention bytes: after 32 clear bytes, every 16 byte block is followed by up to 144 clear bytes.
+func decryptH264(block cipher.Block, iv []byte, es []byte) []byte {
+	out := make([]byte, 0, len(es))
+	for _, nal := range splitAnnexB(es) {
+		if len(nal.data) <= 48 || nal.data[0]&0x1f != 1 && nal.data[0]&0x1f != 5 {
+			out = append(out, nal.prefix...)
+			out = append(out, nal.data...)
+			continue
+		}
+
+		raw := unescapeNAL(nal.data)
+		mode := cipher.NewCBCDecrypter(block, iv)
+		for pos := 32; len(raw)-pos > 16; pos += 16 + 144 {
+			mode.CryptBlocks(raw[pos:pos+16], raw[pos:pos+16])
+		}
+		out = append(out, nal.prefix...)
+		out = append(out, escapeNAL(raw)...)
+	}
+	return out
+}
+
+// escapeNAL inserts emulation prevention bytes where the payload would look like a start code.
+func escapeNAL(nal []byte) []byte {
+	out := make([]byte, 0, len(nal)+len(nal)/64)
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// decryptADTS decrypts AAC frames: after the ADTS header and 16 clear bytes, all full blocks are encrypted.
+func decryptADTS(block cipher.Block, iv []byte, es []byte) ([]byte, error) {
+	out := append([]byte(nil), es...)
+	for pos := 0; pos < len(out); {
+		if pos+7 > len(out) || out[pos] != 0xff || out[pos+1]&0xf0 != 0xf0 {
+			return nil, errors.New("invalid ADTS frame")
+		}
+		headerSize := 7
+		if out[pos+1]&0x01 == 0 {
+			headerSize = 9
+		}
+		frameSize := int(out[pos+3]&0x03)<<11 | int(out[pos+4])<<3 | int(out[pos+5])>>5
+		if frameSize < headerSize || pos+frameSize > len(out) {
+			return nil, errors.New("invalid ADTS frame size")
+		}
+
+		frame := out[pos+headerSize : pos+frameSize]
+		if len(frame) > 16 {
+			encrypted := frame[16 : 16+(len(frame)-16)/16*16]
+			cipher.NewCBCDecrypter(block, iv).CryptBlocks(encrypted, encrypted)
+		}
+		pos += frameSize
+	}
+	return out, nil
+}
@@ -0,0 +1,318 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// SubtitleFormat is the format of the subtitle files saved next to an episode.
+type SubtitleFormat string
+
+const (
+	SubtitlesNone SubtitleFormat = "none"
+	SubtitlesSrt  SubtitleFormat = "srt"
+	SubtitlesVtt  SubtitleFormat = "vtt"
+)
+
+func ParseSubtitleFormat(input string) (SubtitleFormat, error) {
+	switch format := SubtitleFormat(strings.ToLower(strings.TrimSpace(input))); format {
+	case SubtitlesNone, SubtitlesSrt, SubtitlesVtt:
+		return format, nil
+	case "":
+		return SubtitlesNone, nil
+	default:
+		return "", fmt.Errorf("unknown subtitle format: %s", input)
+	}
+}
+
+// subtitleFile is a subtitle rendition that was saved to disk.
+type subtitleFile struct {
+	path     string
+	language string
+	// sidecar is false for files that were only written to be embedded
+	sidecar bool
+}
+
+// subtitleRenditions returns the subtitle renditions of the variant's subtitle group.
+func subtitleRenditions(v *m3u8.Variant) []*m3u8.Alternative {
+	if v.Subtitles == "" {
+		return nil
+	}
+
+	var renditions []*m3u8.Alternative
+	seen := make(map[string]bool)
+	for _, alt := range v.Alternatives {
+		if alt == nil || alt.Type != "SUBTITLES" || alt.GroupId != v.Subtitles || alt.URI == "" || seen[alt.URI] {
+			continue
+		}
+		seen[alt.URI] = true
+		renditions = append(renditions, alt)
+	}
+	return renditions
+}
+
+// downloadSubtitles saves the subtitle tracks next to base, like "Name - S01E01 - GerSub.de.srt".
+// Subtitles are a bonus, so a track that fails is skipped with a warning.
+func (d *Downloader) downloadSubtitles(ctx context.Context, tracks []hlsTrack, referer, base string) []subtitleFile {
+	format := d.subtitleFormat
+	sidecar := format != SubtitlesNone
+	if !sidecar {
+		// Only needed for embedding
+		format = SubtitlesVtt
+	}
+
+	var files []subtitleFile
+	used := make(map[string]bool)
+	for _, track := range tracks {
+		cues, err := d.fetchSubtitleCues(ctx, track, referer, filepath.Dir(base))
+		if err != nil {
+			slog.Warn("Failed to download subtitles", "name", track.subtitle.Name, "language", track.subtitle.Language, "error", err)
+			continue
+		}
+
+		name := subtitleName(track.subtitle)
+		for i := 2; used[name]; i++ {
+			name = fmt.Sprintf("%s.%d", subtitleName(track.subtitle), i)
+		}
+		used[name] = true
+
+		path := fmt.Sprintf("%s.%s.%s", base, name, format)
+		var content string
+		if format == SubtitlesSrt {
+			content = formatSrt(cues)
+		} else {
+			content = formatWebVTT(cues)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			slog.Warn("Failed to save subtitles", "path", path, "error", err)
+			continue
+		}
+		slog.Debug("Saved subtitles", "path", path, "cues", len(cues))
+		files = append(files, subtitleFile{path: path, language: track.subtitle.Language, sidecar: sidecar})
+	}
+	return files
+}
+
+// subtitleName returns the part of the file name that tells the subtitle tracks apart.
+func subtitleName(rendition *m3u8.Alternative) string {
+	name := rendition.Language
+	if name == "" {
+		name = strings.ToLower(rendition.Name)
+	}
+	name = strings.Map(func(r rune) rune {
+		if r == '-' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, name)
+	if name == "" {
+		name = "sub"
+	}
+	if strings.EqualFold(rendition.Forced, "YES") {
+		name += ".forced"
+	}
+	return name
+}
+
+// fetchSubtitleCues downloads the WebVTT segments of a subtitle playlist and joins their cues.
+func (d *Downloader) fetchSubtitleCues(ctx context.Context, track hlsTrack, referer, dir string) ([]subtitleCue, error) {
+	jobs, err := segmentJobs(track.segments(), track.playlist.SeqNo, track.url)
+	if err != nil {
+		return nil, err
+	}
+
+	resources := newResourceCache(d, referer)
+	var documents []webVTTDocument
+	err = d.fetchSegmentsOrdered(ctx, jobs, dir, func(ctx context.Context, job segmentJob, w io.Writer) error {
+		return d.fetchSegment(ctx, job, resources, referer, w)
+	}, func(job segmentJob, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		documents = append(documents, parseWebVTT(string(data)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return joinWebVTT(documents), nil
+}
+
+type subtitleCue struct {
+	start    time.Duration
+	end      time.Duration
+	settings string
+	text     string
+}
+
+// webVTTDocument is a single WebVTT segment.
+type webVTTDocument struct {
+	cues []subtitleCue
+	// mpegts and local come from X-TIMESTAMP-MAP, which maps the cue times to the media timestamps
+	mpegts   int64
+	local    time.Duration
+	hasTsMap bool
+}
+
+var timestampMapRegex = regexp.MustCompile(`(MPEGTS|LOCAL):([0-9:.]+)`)
+
+func parseWebVTT(data string) webVTTDocument {
+	var doc webVTTDocument
+
+	data = strings.TrimPrefix(data, "\ufeff")
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+
+	for i, block := range strings.Split(data, "\n\n") {
+		block = strings.Trim(block, "\n")
+		if block == "" {
+			continue
+		}
+
+		if i == 0 && strings.HasPrefix(block, "WEBVTT") {
+			for _, line := range strings.Split(block, "\n") {
+				if !strings.HasPrefix(line, "X-TIMESTAMP-MAP=") {
+					continue
+				}
+				for _, match := range timestampMapRegex.FindAllStringSubmatch(line, -1) {
+					if match[1] == "MPEGTS" {
+						doc.mpegts, _ = strconv.ParseInt(match[2], 10, 64)
+					} else {
+						doc.local, _ = parseVTTTimestamp(match[2])
+					}
+				}
+				doc.hasTsMap = true
+			}
+			continue
+		}
+		if strings.HasPrefix(block, "NOTE") || strings.HasPrefix(block, "STYLE") || strings.HasPrefix(block, "REGION") {
+			continue
+		}
+
+		lines := strings.Split(block, "\n")
+		for j, line := range lines {
+			timing, settings, found := strings.Cut(line, "-->")
+			if !found {
+				// Cue identifier
+				continue
+			}
+			start, err := parseVTTTimestamp(strings.TrimSpace(timing))
+			if err != nil {
+				break
+			}
+			fields := strings.Fields(settings)
+			if len(fields) == 0 {
+				break
+			}
+			end, err := parseVTTTimestamp(fields[0])
+			if err != nil {
+				break
+			}
+			doc.cues = append(doc.cues, subtitleCue{
+				start:    start,
+				end:      end,
+				settings: strings.Join(fields[1:], " "),
+				text:     strings.Join(lines[j+1:], "\n"),
+			})
+			break
+		}
+	}
+	return doc
+}
+
+// parseVTTTimestamp parses "mm:ss.ttt" and "hh:mm:ss.ttt".
+func parseVTTTimestamp(value string) (time.Duration, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp: %s", value)
+	}
+
+	seconds, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp: %s", value)
+	}
+	total := time.Duration(seconds * float64(time.Second))
+	for i, unit := range []time.Duration{time.Minute, time.Hour}[:len(parts)-1] {
+		n, err := strconv.Atoi(parts[len(parts)-2-i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp: %s", value)
+		}
+		total += time.Duration(n) * unit
+	}
+	return total.Round(time.Millisecond), nil
+}
+
+// joinWebVTT joins the cues of the segments. Times are kept relative to the first segment's timestamp map,
+// and cues that are repeated in the next segment are only kept once.
+func joinWebVTT(documents []webVTTDocument) []subtitleCue {
+	var cues []subtitleCue
+	var base *webVTTDocument
+	seen := make(map[subtitleCue]bool)
+
+	for i := range documents {
+		doc := &documents[i]
+		var shift time.Duration
+		if doc.hasTsMap {
+			if base == nil {
+				base = doc
+			}
+			shift = time.Duration(doc.mpegts-base.mpegts)*time.Second/90000 - (doc.local - base.local)
+		}
+
+		for _, cue := range doc.cues {
+			cue.start += shift
+			cue.end += shift
+			if seen[cue] {
+				continue
+			}
+			seen[cue] = true
+			cues = append(cues, cue)
+		}
+	}
+	return cues
+}
+
+func formatWebVTT(cues []subtitleCue) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	for _, cue := range cues {
+		fmt.Fprintf(&b, "%s --> %s", formatCueTime(cue.start, '.'), formatCueTime(cue.end, '.'))
+		if cue.settings != "" {
+			b.WriteString(" " + cue.settings)
+		}
+		fmt.Fprintf(&b, "\n%s\n\n", cue.text)
+	}
+	return b.String()
+}
+
+// srtTagRegex matches the WebVTT tags SRT players don't understand, everything but <i>, <b> and <u>.
+var srtTagRegex = regexp.MustCompile(`</?(?:[^ibu/>][^>]*|[ibu][^>]+)>`)
+
+func formatSrt(cues []subtitleCue) string {
+	var b strings.Builder
+	for i, cue := range cues {
+		text := srtTagRegex.ReplaceAllString(cue.text, "")
+		text = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">", "&nbsp;", " ").Replace(text)
+		fmt.Fprintf(&b, "%d\n%s --> %s\n%s\n\n", i+1, formatCueTime(cue.start, ','), formatCueTime(cue.end, ','), text)
+	}
+	return b.String()
+}
+
+func formatCueTime(t time.Duration, separator byte) string {
+	if t < 0 {
+		t = 0
+	}
+	ms := t.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%c%03d", ms/3600000, ms/60000%60, ms/1000%60, separator, ms%1000)
+}
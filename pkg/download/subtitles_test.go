@@ -0,0 +1,34 @@
+package download
+
+import (
+	"testing"
+)
+
+func TestJoinWebVTT(t *testing.T) {
+	segments := []string{
+		"WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n1\n00:00:01.000 --> 00:00:03.500 align:start\n<i>Hallo</i> <c.yellow>Welt</c>\n\n00:05.000 --> 00:07.000\nZweite Zeile\nmit Umbruch\n",
+		// The second cue is repeated, since it spans both segments
+		"\ufeffWEBVTT\r\nX-TIMESTAMP-MAP=LOCAL:00:00:00.000,MPEGTS:900000\r\n\r\n00:00:05.000 --> 00:00:07.000\r\nZweite Zeile\r\nmit Umbruch\r\n\r\nNOTE ignored\r\n\r\n00:00:08.250 --> 00:00:09.000\r\nTom &amp; Jerry\r\n",
+		// After a discontinuity the cue times start over, the timestamp map moves them back in place
+		"WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:1800000,LOCAL:00:00:00.000\n\n00:00:00.500 --> 00:00:01.000\nDanach\n",
+	}
+
+	var documents []webVTTDocument
+	for _, segment := range segments {
+		documents = append(documents, parseWebVTT(segment))
+	}
+	cues := joinWebVTT(documents)
+
+	expectedSrt := "1\n00:00:01,000 --> 00:00:03,500\n<i>Hallo</i> Welt\n\n" +
+		"2\n00:00:05,000 --> 00:00:07,000\nZweite Zeile\nmit Umbruch\n\n" +
+		"3\n00:00:08,250 --> 00:00:09,000\nTom & Jerry\n\n" +
+		"4\n00:00:10,500 --> 00:00:11,000\nDanach\n\n"
+	if result := formatSrt(cues); result != expectedSrt {
+		t.Errorf("formatSrt() = %q, expected %q", result, expectedSrt)
+	}
+
+	expectedVtt := "WEBVTT\n\n00:00:01.000 --> 00:00:03.500 align:start\n<i>Hallo</i> <c.yellow>Welt</c>\n\n"
+	if result := formatWebVTT(cues[:1]); result != expectedVtt {
+		t.Errorf("formatWebVTT() = %q, expected %q", result, expectedVtt)
+	}
+}
@@ -0,0 +1,359 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bugmaschine/gad/pkg/retry"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+// downloadedTrack is a downloaded video or audio track, with the .part file of every period.
+type downloadedTrack struct {
+	// language is set for separate audio tracks
+	language  string
+	partPaths []string
+	resume    *segmentResume
+	// duration is the sum of the segment durations
+	duration time.Duration
+}
+
+// finishTracks remuxes the downloaded tracks into the output, verifies it and removes the .part files.
+// The .part files are kept if the remux fails, so the next attempt only has to remux again.
+// Without FFmpeg, H.264 and AAC in MPEG-TS are remuxed by the built-in remuxer, and a single file that already is in
+// the container of the output is kept as it is. Anything else fails, the .part files stay for when FFmpeg is there.
+func (d *Downloader) finishTracks(tracks []downloadedTrack, muxedAudio bool, subtitles []subtitleFile, outputPath, message string, task *DownloadTask) error {
+	var embedded []subtitleFile
+	if d.embedSubtitles {
+		embedded = subtitles
+	}
+
+	tempPath := outputPath + PartSuffix
+	switch {
+	case d.ffmpegPath != "":
+		muxed := embedded
+		if len(muxed) > 0 && !canEmbedSubtitles(filepath.Ext(outputPath)) {
+			slog.Warn("Subtitles can't be embedded into the container", "file", message, "container", filepath.Ext(outputPath))
+			muxed = nil
+		}
+		slog.Debug("Remuxing with FFmpeg", "profile", d.profile.Name, "tracks", len(tracks), "subtitles", len(muxed), "out", tempPath)
+		if err := d.remuxTracks(tracks, muxedAudio, muxed, task.Metadata, tempPath, filepath.Ext(outputPath)); err != nil {
+			os.Remove(tempPath)
+			return retry.Fatal(fmt.Errorf("FFmpeg remux failed: %w", err))
+		}
+	case canRemuxTS(tracks, outputPath):
+		slog.Debug("Remuxing with the built-in remuxer", "tracks", len(tracks), "out", tempPath)
+		if len(embedded) > 0 {
+			slog.Warn("Subtitles can only be embedded with FFmpeg", "file", message)
+			embedded = nil
+		}
+		err := remuxTS(tracks, muxedAudio, tempPath)
+		if errors.Is(err, errRemuxUnsupported) {
+			os.Remove(tempPath)
+			slog.Debug("Can't remux without FFmpeg", "file", message, "error", err)
+			return d.keepTrack(tracks, outputPath, task)
+		}
+		if err != nil {
+			os.Remove(tempPath)
+			return retry.Fatal(fmt.Errorf("remux failed: %w", err))
+		}
+	default:
+		return d.keepTrack(tracks, outputPath, task)
+	}
+
+	err := d.finalize(tempPath, outputPath, task.Verify, tracks[0].duration)
+	if err != nil && !errors.Is(err, errVerification) {
+		return err
+	}
+
+	// A file that failed verification is downloaded from scratch next time
+	for _, track := range tracks {
+		for _, partPath := range track.partPaths {
+			os.Remove(partPath)
+		}
+		track.resume.remove()
+	}
+	for _, subtitle := range embedded {
+		if !subtitle.sidecar {
+			os.Remove(subtitle.path)
+		}
+	}
+	return err
+}
+
+// keepTrack moves the .part file of a stream into place when it's the only one and already has the container of the output.
+// Separate tracks or periods would end up as loose files next to the episode, which the library doesn't know about.
+func (d *Downloader) keepTrack(tracks []downloadedTrack, outputPath string, task *DownloadTask) error {
+	partPath := tracks[0].partPaths[0]
+	if len(tracks) > 1 || len(tracks[0].partPaths) > 1 || !strings.EqualFold(filepath.Ext(strings.TrimSuffix(partPath, PartSuffix)), filepath.Ext(outputPath)) {
+		return retry.Fatal(fmt.Errorf("FFmpeg is required to turn this stream into %s", filepath.Base(outputPath)))
+	}
+
+	err := d.finalize(partPath, outputPath, task.Verify, tracks[0].duration)
+	if err != nil && !errors.Is(err, errVerification) {
+		return err
+	}
+	tracks[0].resume.remove()
+	return err
+}
+
+// downloadSegments downloads the segments of a track into the .part files next to base, one for every period.
+// The resume manifest is kept until the track was remuxed, so an interrupted remux doesn't start the download over.
+func (d *Downloader) downloadSegments(ctx context.Context, jobs []segmentJob, ext, referer, base, message string) (downloadedTrack, error) {
+	// Every period goes into its own file, the timestamps and init section can change at a discontinuity
+	tempPath := base + ext
+	partPaths := make([]string, jobs[len(jobs)-1].period+1)
+	for period := range partPaths {
+		partPaths[period] = periodPath(tempPath, period) + PartSuffix
+	}
+	result := downloadedTrack{partPaths: partPaths}
+	for _, job := range jobs {
+		result.duration += time.Duration(job.duration * float64(time.Second))
+	}
+
+	resume := loadSegmentResume(partPaths, jobs)
+	result.resume = resume
+	if len(resume.Segments) == len(jobs) {
+		slog.Debug("Track already downloaded", "file", message)
+		return result, nil
+	}
+
+	// Drop anything written after the last complete segment
+	writer := &periodWriter{paths: partPaths}
+	defer writer.close()
+	if err := writer.open(resume.position()); err != nil {
+		return result, err
+	}
+	downloadedBytes := resume.size()
+
+	var totalDuration float64
+	var downloadedDuration float64
+	for i, job := range jobs {
+		totalDuration += job.duration
+		if i < len(resume.Segments) {
+			downloadedDuration += job.duration
+		}
+	}
+
+	if len(resume.Segments) > 0 {
+		slog.Info("Resuming segmented download", "file", message, "done", len(resume.Segments), "segments", len(jobs))
+	}
+
+	d.ensureTotalBar()
+
+	// per episode bar
+
+	bar := d.progress.AddBar(0, // Total will be updated as we go
+		mpb.PrependDecorators(
+			decor.Name(message+" ", decor.WC{W: len(message) + 1}),
+			decor.CountersKibiByte("% .2f / % .2f"),
+		),
+		d.downloadInfo(),
+	)
+	bar.SetCurrent(downloadedBytes)
+
+	resources := newResourceCache(d, referer)
+
+	var lastEstimation int64
+	err := d.fetchSegmentsOrdered(ctx, jobs[len(resume.Segments):], filepath.Dir(base), func(ctx context.Context, job segmentJob, w io.Writer) error {
+		return d.fetchSegment(ctx, job, resources, referer, w)
+	}, func(job segmentJob, r io.Reader) error {
+		offset, n, err := writer.write(job.period, r)
+		if err != nil {
+			return err
+		}
+
+		resume.Segments = append(resume.Segments, segmentRecord{Index: job.index, Period: job.period, Offset: offset, Size: n})
+		if err := resume.save(); err != nil {
+			slog.Debug("Failed to save segment resume state", "path", resume.path, "error", err)
+		}
+
+		downloadedBytes += n
+		downloadedDuration += job.duration
+
+		// Estimation
+		estimatedTotal := int64((float64(downloadedBytes) * totalDuration) / downloadedDuration)
+		bar.SetTotal(estimatedTotal, false)
+
+		// Update total bar with the change in estimation
+		diff := estimatedTotal - lastEstimation
+		d.addTotalSize(diff)
+		lastEstimation = estimatedTotal
+
+		bar.SetCurrent(downloadedBytes)
+		d.addTotalPos(n)
+		return nil
+	})
+	if err != nil {
+		bar.Abort(true)
+		return result, err
+	}
+
+	bar.SetTotal(downloadedBytes, true)
+	bar.SetCurrent(downloadedBytes)
+
+	return result, writer.close()
+}
+
+// periodPath returns the file for a period. The first one keeps the plain name.
+func periodPath(path string, period int) string {
+	if period == 0 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(path, ext), period, ext)
+}
+
+// ffmpegMuxers maps output extensions to FFmpeg's muxer names.
+var ffmpegMuxers = map[string]string{
+	".mp4": "mp4",
+	".m4v": "mp4",
+	".mov": "mov",
+	".mkv": "matroska",
+	".ts":  "mpegts",
+}
+
+// remuxTracks remuxes the tracks and subtitles into one output. A track with several periods is joined with the concat demuxer.
+// If the variant has audio of its own, it is kept after the separate audio renditions.
+// The output is written to a .part file, so the muxer is picked from ext. meta is written into the container if it is set.
+func (d *Downloader) remuxTracks(tracks []downloadedTrack, muxedAudio bool, subtitles []subtitleFile, meta *Metadata, outputPath, ext string) error {
+	args := []string{"-y"}
+	for _, track := range tracks {
+		if len(track.partPaths) == 1 {
+			args = append(args, "-i", track.partPaths[0])
+			continue
+		}
+
+		listPath := track.partPaths[0] + ".txt"
+		var list strings.Builder
+		for _, partPath := range track.partPaths {
+			fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(filepath.Base(partPath), "'", `'\''`))
+		}
+		if err := os.WriteFile(listPath, []byte(list.String()), 0644); err != nil {
+			return err
+		}
+		defer os.Remove(listPath)
+		args = append(args, "-f", "concat", "-safe", "0", "-i", listPath)
+	}
+	for _, subtitle := range subtitles {
+		args = append(args, "-i", subtitle.path)
+	}
+
+	args = append(args, streamArgs(tracks, muxedAudio, subtitles, meta)...)
+	args = append(args, d.profile.ffmpegArgs(ext, len(subtitles) > 0)...)
+	args = append(args, outputPath)
+
+	cmd := exec.Command(d.ffmpegPath, args...)
+	if !d.debug {
+		cmd.Stdout = nil
+		cmd.Stderr = nil
+	}
+	return cmd.Run()
+}
+
+// streamArgs maps the inputs of remuxTracks to the output streams and tags them. The video comes first, then the
+// separate audio renditions and the variant's own audio, then the subtitles. Audio without a language of its own is
+// tagged with the language of meta.
+func streamArgs(tracks []downloadedTrack, muxedAudio bool, subtitles []subtitleFile, meta *Metadata) []string {
+	var args []string
+	language := ""
+	if meta != nil {
+		args = append(args, meta.ffmpegArgs()...)
+		language = meta.Language
+	}
+
+	if len(tracks) == 1 && len(subtitles) == 0 {
+		// FFmpeg picks the streams itself, with at most one audio stream
+		if muxedAudio && language != "" {
+			args = append(args, "-metadata:s:a:0", "language="+language)
+		}
+		return args
+	}
+
+	args = append(args, "-map", "0:v")
+	audio := 0
+	for i, track := range tracks[1:] {
+		args = append(args, "-map", fmt.Sprintf("%d:a", i+1))
+		trackLanguage := track.language
+		if trackLanguage == "" {
+			trackLanguage = language
+		}
+		if trackLanguage != "" {
+			args = append(args, fmt.Sprintf("-metadata:s:a:%d", audio), "language="+trackLanguage)
+		}
+		audio++
+	}
+	if muxedAudio {
+		args = append(args, "-map", "0:a?")
+		if language != "" {
+			args = append(args, fmt.Sprintf("-metadata:s:a:%d", audio), "language="+language)
+		}
+	}
+	for i, subtitle := range subtitles {
+		args = append(args, "-map", fmt.Sprintf("%d:s", len(tracks)+i))
+		if subtitle.language != "" {
+			args = append(args, fmt.Sprintf("-metadata:s:s:%d", i), "language="+subtitle.language)
+		}
+	}
+	return args
+}
+
+// periodWriter appends the segments to the file of their period.
+type periodWriter struct {
+	paths  []string
+	period int
+	file   *os.File
+	offset int64
+}
+
+// open continues the file of the period at offset, and drops everything after it.
+func (w *periodWriter) open(period int, offset int64) error {
+	if err := w.close(); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(w.paths[period], os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	w.file, w.period, w.offset = file, period, offset
+	return nil
+}
+
+// write appends a segment to the file of the period and returns the offset it was written at and its size.
+func (w *periodWriter) write(period int, r io.Reader) (offset, n int64, err error) {
+	if w.file == nil || period != w.period {
+		if err := w.open(period, 0); err != nil {
+			return 0, 0, err
+		}
+	}
+	offset = w.offset
+	n, err = io.Copy(w.file, r)
+	w.offset += n
+	return offset, n, err
+}
+
+func (w *periodWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
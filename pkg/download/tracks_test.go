@@ -0,0 +1,85 @@
+package download
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMetadataArgs(t *testing.T) {
+	tests := []struct {
+		meta     Metadata
+		expected string
+	}{
+		{
+			Metadata{Show: "Show", Season: 1, Episode: 2, Title: "Pilot"},
+			"-metadata title=Pilot -metadata show=Show -metadata season_number=1 -metadata episode_sort=2 -metadata episode_id=S01E02",
+		},
+		// Without a title, players would show the filename
+		{
+			Metadata{Show: "Show", Season: 0, Episode: 13},
+			"-metadata title=Show - S00E13 -metadata show=Show -metadata season_number=0 -metadata episode_sort=13 -metadata episode_id=S00E13",
+		},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(tt.meta.ffmpegArgs(), " "); got != tt.expected {
+			t.Errorf("%+v: got %q, want %q", tt.meta, got, tt.expected)
+		}
+	}
+}
+
+func TestStreamArgs(t *testing.T) {
+	video := downloadedTrack{}
+	english := downloadedTrack{language: "eng"}
+	unknown := downloadedTrack{}
+	subtitles := []subtitleFile{{language: "ger"}, {}}
+	meta := &Metadata{Show: "Show", Season: 1, Episode: 1, Title: "Pilot", Language: "jpn"}
+
+	tests := []struct {
+		name       string
+		tracks     []downloadedTrack
+		muxedAudio bool
+		subtitles  []subtitleFile
+		meta       *Metadata
+		expected   string
+	}{
+		{"single track", []downloadedTrack{video}, true, nil, meta, "-metadata:s:a:0 language=jpn"},
+		{"single track without audio", []downloadedTrack{video}, false, nil, meta, ""},
+		{"single track without metadata", []downloadedTrack{video}, true, nil, nil, ""},
+		{
+			"single track with subtitles", []downloadedTrack{video}, true, subtitles, meta,
+			"-map 0:v -map 0:a? -metadata:s:a:0 language=jpn -map 1:s -metadata:s:s:0 language=ger -map 2:s",
+		},
+		// The variant's own audio comes after the separate renditions
+		{
+			"separate and muxed audio", []downloadedTrack{video, english, unknown}, true, nil, meta,
+			"-map 0:v -map 1:a -metadata:s:a:0 language=eng -map 2:a -metadata:s:a:1 language=jpn -map 0:a? -metadata:s:a:2 language=jpn",
+		},
+		{
+			"separate audio only", []downloadedTrack{video, english}, false, subtitles, meta,
+			"-map 0:v -map 1:a -metadata:s:a:0 language=eng -map 2:s -metadata:s:s:0 language=ger -map 3:s",
+		},
+		{
+			"separate audio only without a language", []downloadedTrack{video, unknown}, false, nil, meta,
+			"-map 0:v -map 1:a -metadata:s:a:0 language=jpn",
+		},
+		{
+			"separate audio without metadata", []downloadedTrack{video, english, unknown}, true, nil, nil,
+			"-map 0:v -map 1:a -metadata:s:a:0 language=eng -map 2:a -map 0:a?",
+		},
+	}
+	for _, tt := range tests {
+		args := streamArgs(tt.tracks, tt.muxedAudio, tt.subtitles, tt.meta)
+		if tt.meta != nil {
+			metaArgs := tt.meta.ffmpegArgs()
+			if !slices.Equal(args[:len(metaArgs)], metaArgs) {
+				t.Errorf("%s: got %q, want the metadata first", tt.name, args)
+				continue
+			}
+			args = args[len(metaArgs):]
+		}
+		if got := strings.Join(args, " "); got != tt.expected {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.expected)
+		}
+	}
+}
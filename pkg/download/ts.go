@@ -0,0 +1,241 @@
+package download
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MPEG-TS helpers shared by the SAMPLE-AES decryption and the built-in remuxer.
+
+const tsPacketSize = 188
+
+// tsPayload returns the payload of a packet, behind the adaptation field.
+func tsPayload(packet []byte) []byte {
+	control := packet[3] >> 4 & 0x03
+	switch control {
+	case 1:
+		return packet[4:]
+	case 3:
+		if start := 5 + int(packet[4]); start < tsPacketSize {
+			return packet[start:]
+		}
+	}
+	return nil
+}
+
+// tsTables follows the PAT and PMT of a transport stream.
+type tsTables struct {
+	pmtPIDs     map[uint16]bool
+	streamTypes map[uint16]byte
+}
+
+func newTSTables() tsTables {
+	return tsTables{pmtPIDs: make(map[uint16]bool), streamTypes: make(map[uint16]byte)}
+}
+
+func (t *tsTables) parsePAT(payload []byte) {
+	section := psiSection(payload)
+	if len(section) < 12 {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(section[1:3]) & 0x0fff)
+	end := min(3+length-4, len(section))
+	for i := 8; i+4 <= end; i += 4 {
+		program := binary.BigEndian.Uint16(section[i : i+2])
+		if program != 0 {
+			t.pmtPIDs[binary.BigEndian.Uint16(section[i+2:i+4])&0x1fff] = true
+		}
+	}
+}
+
+// parsePMT records the stream types of a PMT section and returns the positions of the stream type bytes in it.
+func (t *tsTables) parsePMT(section []byte) ([]int, error) {
+	if len(section) < 12 {
+		return nil, nil
+	}
+	length := int(binary.BigEndian.Uint16(section[1:3]) & 0x0fff)
+	if 3+length > len(section) {
+		return nil, errors.New("PMT spans several packets")
+	}
+
+	var positions []int
+	programInfoLength := int(binary.BigEndian.Uint16(section[10:12]) & 0x0fff)
+	end := 3 + length - 4
+	for i := 12 + programInfoLength; i+5 <= end; {
+		pid := binary.BigEndian.Uint16(section[i+1:i+3]) & 0x1fff
+		t.streamTypes[pid] = section[i]
+		positions = append(positions, i)
+		i += 5 + int(binary.BigEndian.Uint16(section[i+3:i+5])&0x0fff)
+	}
+	return positions, nil
+}
+
+// psiSection skips the pointer field in front of a table section.
+func psiSection(payload []byte) []byte {
+	if len(payload) == 0 || 1+int(payload[0]) >= len(payload) {
+		return nil
+	}
+	return payload[1+int(payload[0]):]
+}
+
+type annexBNAL struct {
+	// prefix is the start code and anything in front of it
+	prefix []byte
+	data   []byte
+}
+
+func splitAnnexB(es []byte) []annexBNAL {
+	var nals []annexBNAL
+	var starts []int
+	for i := 0; i+3 <= len(es); i++ {
+		if es[i] == 0 && es[i+1] == 0 && es[i+2] == 1 {
+			starts = append(starts, i+3)
+			i += 2
+		}
+	}
+	if len(starts) == 0 {
+		return []annexBNAL{{prefix: es}}
+	}
+
+	prev := 0
+	for i, start := range starts {
+		end := len(es)
+		if i+1 < len(starts) {
+			// The next start code, and a leading zero byte of a four byte start code
+			end = starts[i+1] - 3
+			for end > start && es[end-1] == 0 {
+				end--
+			}
+		}
+		nals = append(nals, annexBNAL{prefix: es[prev:start], data: es[start:end]})
+		prev = end
+	}
+	return nals
+}
+
+// unescapeNAL removes the emulation prevention bytes (00 00 03).
+func unescapeNAL(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// mpegCRC32 is the CRC of MPEG-TS table sections.
+func mpegCRC32(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// readTS reads a transport stream and hands every complete PES packet to onPES, together with its stream type.
+// Only one PES packet per stream is held in memory.
+func readTS(r io.Reader, onPES func(pid uint16, streamType byte, pes []byte) error) error {
+	tables := newTSTables()
+	pending := make(map[uint16][]byte)
+	flush := func(pid uint16) error {
+		pes := pending[pid]
+		delete(pending, pid)
+		if len(pes) == 0 {
+			return nil
+		}
+		return onPES(pid, tables.streamTypes[pid], pes)
+	}
+
+	br := bufio.NewReaderSize(r, 64*tsPacketSize)
+	packet := make([]byte, tsPacketSize)
+	for offset := int64(0); ; offset += tsPacketSize {
+		if _, err := io.ReadFull(br, packet); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if packet[0] != 0x47 {
+			return fmt.Errorf("lost MPEG-TS sync at byte %d", offset)
+		}
+
+		pid := binary.BigEndian.Uint16(packet[1:3]) & 0x1fff
+		start := packet[1]&0x40 != 0
+		payload := tsPayload(packet)
+		switch {
+		case pid == 0:
+			if start {
+				tables.parsePAT(payload)
+			}
+		case tables.pmtPIDs[pid]:
+			if start {
+				if _, err := tables.parsePMT(psiSection(payload)); err != nil {
+					return err
+				}
+			}
+		case tables.streamTypes[pid] != 0:
+			if start {
+				if err := flush(pid); err != nil {
+					return err
+				}
+				pending[pid] = append(make([]byte, 0, 64*1024), payload...)
+			} else if pes, ok := pending[pid]; ok {
+				pending[pid] = append(pes, payload...)
+			}
+		}
+	}
+
+	for pid := range pending {
+		if err := flush(pid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// noTimestamp marks a PES packet without PTS or DTS.
+const noTimestamp = -1
+
+// parsePES splits a PES packet into its timestamps (90 kHz) and payload. Without a DTS it is the same as the PTS.
+func parsePES(pes []byte) (pts, dts int64, payload []byte, err error) {
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return 0, 0, nil, errors.New("invalid PES packet")
+	}
+	headerEnd := 9 + int(pes[8])
+	if headerEnd > len(pes) {
+		return 0, 0, nil, errors.New("invalid PES header")
+	}
+
+	pts, dts = noTimestamp, noTimestamp
+	flags := pes[7]
+	if flags&0x80 != 0 && headerEnd >= 14 {
+		pts = pesTimestamp(pes[9:14])
+		dts = pts
+	}
+	if flags&0x40 != 0 && headerEnd >= 19 {
+		dts = pesTimestamp(pes[14:19])
+	}
+	return pts, dts, pes[headerEnd:], nil
+}
+
+func pesTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
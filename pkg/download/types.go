@@ -1,9 +1,13 @@
 package download
 
 import (
+	"os"
 	"path/filepath"
 )
 
+// PartSuffix is appended to files that are still being downloaded.
+const PartSuffix = ".part"
+
 type DownloadTask struct {
 	Url                    string
 	OutputPath             string
@@ -12,6 +16,13 @@ type DownloadTask struct {
 	SkipExisting           bool
 	CustomMessage          string
 	Referer                string
+	// Verify checks the finished file with ffprobe before it is moved into place
+	Verify bool
+	// Metadata is written into the container by FFmpeg, nil for downloads that aren't episodes
+	Metadata *Metadata
+
+	// disableSplit is set once the server turned out to not support range requests
+	disableSplit bool
 }
 
 func NewDownloadTask(outputPath, url string) *DownloadTask {
@@ -41,6 +52,41 @@ func (t *DownloadTask) SetReferer(referer string) *DownloadTask {
 	return t
 }
 
+func (t *DownloadTask) SetVerify(verify bool) *DownloadTask {
+	t.Verify = verify
+	return t
+}
+
+func (t *DownloadTask) SetMetadata(meta *Metadata) *DownloadTask {
+	t.Metadata = meta
+	return t
+}
+
 func (t *DownloadTask) Filename() string {
 	return filepath.Base(t.OutputPath)
 }
+
+// FinalPath returns the path the finished download is saved to, with ext appended unless the output path has its own.
+func (t *DownloadTask) FinalPath(ext string) string {
+	if t.OutputPathHasExtension {
+		return t.OutputPath
+	}
+	return t.OutputPath + ext
+}
+
+// existingPath returns the finished file of the task in any container, or "" if there is none.
+func (t *DownloadTask) existingPath() string {
+	paths := []string{t.OutputPath}
+	if !t.OutputPathHasExtension {
+		paths = paths[:0]
+		for _, ext := range containerExtensions {
+			paths = append(paths, t.OutputPath+ext)
+		}
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
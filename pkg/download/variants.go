@@ -0,0 +1,196 @@
+package download
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// Quality decides which variant of an HLS master playlist or DASH manifest gets downloaded.
+type Quality struct {
+	// MaxHeight skips variants with a higher resolution, 0 means no limit
+	MaxHeight int
+	// Lowest picks the smallest variant instead of the best one
+	Lowest bool
+	// Codec prefers variants of a codec family (h264, h265, av1, vp9)
+	Codec string
+}
+
+// codecFamilies maps the codec names users type to the prefixes used in the CODECS attribute.
+var codecFamilies = map[string][]string{
+	"h264": {"avc1", "avc3"},
+	"avc":  {"avc1", "avc3"},
+	"h265": {"hvc1", "hev1"},
+	"hevc": {"hvc1", "hev1"},
+	"av1":  {"av01"},
+	"vp9":  {"vp09"},
+}
+
+// ParseQuality parses the quality option ("best", "lowest" or a codec name) and the maximum resolution
+// ("720", "720p" or "1280x720").
+func ParseQuality(quality, maxResolution string) (Quality, error) {
+	var q Quality
+
+	switch quality = strings.ToLower(strings.TrimSpace(quality)); quality {
+	case "", "best":
+	case "lowest", "worst":
+		q.Lowest = true
+	default:
+		if _, ok := codecFamilies[quality]; !ok {
+			return Quality{}, fmt.Errorf("unknown quality: %s", quality)
+		}
+		q.Codec = quality
+	}
+
+	maxResolution = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(maxResolution)), "p")
+	if maxResolution != "" {
+		if _, height, found := strings.Cut(maxResolution, "x"); found {
+			maxResolution = height
+		}
+		height, err := strconv.Atoi(maxResolution)
+		if err != nil || height <= 0 {
+			return Quality{}, fmt.Errorf("invalid maximum resolution: %s", maxResolution)
+		}
+		q.MaxHeight = height
+	}
+
+	return q, nil
+}
+
+// representation describes a video variant of an HLS master playlist or a DASH adaptation set.
+type representation struct {
+	// height is 0 if the resolution is unknown
+	height    int
+	bandwidth uint64
+	codecs    string
+}
+
+// variantHeight returns the height from the RESOLUTION attribute, or 0 if it is unknown.
+func variantHeight(v *m3u8.Variant) int {
+	_, height, found := strings.Cut(v.Resolution, "x")
+	if !found {
+		return 0
+	}
+	h, err := strconv.Atoi(height)
+	if err != nil {
+		return 0
+	}
+	return h
+}
+
+func (q Quality) matchesCodec(codecs string) bool {
+	for _, codec := range strings.Split(strings.ToLower(codecs), ",") {
+		for _, prefix := range codecFamilies[q.Codec] {
+			if strings.HasPrefix(strings.TrimSpace(codec), prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selectVariant picks the variant of a master playlist to download.
+func (q Quality) selectVariant(variants []*m3u8.Variant) *m3u8.Variant {
+	var candidates []*m3u8.Variant
+	var representations []representation
+	for _, v := range variants {
+		if v != nil && !v.Iframe && v.URI != "" {
+			candidates = append(candidates, v)
+			representations = append(representations, representation{height: variantHeight(v), bandwidth: uint64(v.Bandwidth), codecs: v.Codecs})
+		}
+	}
+
+	i := q.pick(representations)
+	if i < 0 {
+		return nil
+	}
+	return candidates[i]
+}
+
+// pick returns the index of the representation to download, or -1 if there are none. If none fits under the maximum
+// resolution, the smallest one is used, and a codec preference is dropped if no representation has that codec.
+func (q Quality) pick(representations []representation) int {
+	if len(representations) == 0 {
+		return -1
+	}
+
+	// Sort by resolution, then bandwidth (descending)
+	order := make([]int, len(representations))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		ri, rj := representations[order[i]], representations[order[j]]
+		if ri.height != rj.height {
+			return ri.height > rj.height
+		}
+		return ri.bandwidth > rj.bandwidth
+	})
+
+	candidates := order
+	if q.MaxHeight > 0 {
+		var fitting []int
+		for _, i := range candidates {
+			// Representations without a resolution can't be judged, so they are kept
+			if representations[i].height <= q.MaxHeight {
+				fitting = append(fitting, i)
+			}
+		}
+		if len(fitting) == 0 {
+			slog.Debug("Nothing fits the maximum resolution, using the smallest one", "max-height", q.MaxHeight)
+			return candidates[len(candidates)-1]
+		}
+		candidates = fitting
+	}
+
+	if q.Codec != "" {
+		var matching []int
+		for _, i := range candidates {
+			if q.matchesCodec(representations[i].codecs) {
+				matching = append(matching, i)
+			}
+		}
+		if len(matching) > 0 {
+			candidates = matching
+		} else {
+			slog.Debug("Nothing uses the preferred codec", "codec", q.Codec)
+		}
+	}
+
+	if q.Lowest {
+		return candidates[len(candidates)-1]
+	}
+	return candidates[0]
+}
+
+// audioRenditions returns the separate audio renditions of the variant's audio group.
+// Renditions without a URI are muxed into the variant itself and are reported through muxed.
+func audioRenditions(v *m3u8.Variant) (renditions []*m3u8.Alternative, muxed bool) {
+	if v.Audio == "" {
+		return nil, true
+	}
+
+	seen := make(map[string]bool)
+	for _, alt := range v.Alternatives {
+		if alt == nil || alt.Type != "AUDIO" || alt.GroupId != v.Audio {
+			continue
+		}
+		if alt.URI == "" {
+			muxed = true
+			continue
+		}
+		if seen[alt.URI] {
+			continue
+		}
+		seen[alt.URI] = true
+		renditions = append(renditions, alt)
+	}
+	if len(renditions) == 0 {
+		muxed = true
+	}
+	return renditions, muxed
+}
@@ -0,0 +1,71 @@
+package download
+
+import (
+	"testing"
+
+	"github.com/grafov/m3u8"
+)
+
+func TestSelectVariant(t *testing.T) {
+	variant := func(uri, resolution, codecs string, bandwidth uint32) *m3u8.Variant {
+		return &m3u8.Variant{URI: uri, VariantParams: m3u8.VariantParams{Resolution: resolution, Codecs: codecs, Bandwidth: bandwidth}}
+	}
+	variants := []*m3u8.Variant{
+		variant("720", "1280x720", "avc1.64001f,mp4a.40.2", 3000000),
+		variant("1080-hevc", "1920x1080", "hvc1.1.6.L120.90,mp4a.40.2", 4000000),
+		variant("1080", "1920x1080", "avc1.640028,mp4a.40.2", 6000000),
+		variant("480", "854x480", "avc1.64001e,mp4a.40.2", 1500000),
+		{URI: "iframe", VariantParams: m3u8.VariantParams{Resolution: "1920x1080", Bandwidth: 9000000, Iframe: true}},
+	}
+
+	tests := []struct {
+		name     string
+		quality  Quality
+		expected string
+	}{
+		{"best", Quality{}, "1080"},
+		{"lowest", Quality{Lowest: true}, "480"},
+		{"max height", Quality{MaxHeight: 720}, "720"},
+		{"max height between", Quality{MaxHeight: 1000}, "720"},
+		{"nothing fits", Quality{MaxHeight: 360}, "480"},
+		{"codec", Quality{Codec: "hevc"}, "1080-hevc"},
+		{"codec over max height", Quality{Codec: "hevc", MaxHeight: 720}, "720"},
+		{"unknown codec", Quality{Codec: "av1"}, "1080"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := tt.quality.selectVariant(variants)
+			if result == nil || result.URI != tt.expected {
+				t.Errorf("selectVariant(%+v) = %v, expected %s", tt.quality, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseQuality(t *testing.T) {
+	tests := []struct {
+		quality       string
+		maxResolution string
+		expected      Quality
+		wantErr       bool
+	}{
+		{"best", "", Quality{}, false},
+		{"lowest", "720p", Quality{Lowest: true, MaxHeight: 720}, false},
+		{"HEVC", "1920x1080", Quality{Codec: "hevc", MaxHeight: 1080}, false},
+		{"best", "hd", Quality{}, true},
+		{"huge", "", Quality{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.quality+"/"+tt.maxResolution, func(t *testing.T) {
+			result, err := ParseQuality(tt.quality, tt.maxResolution)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseQuality(%q, %q) error = %v", tt.quality, tt.maxResolution, err)
+			}
+			if result != tt.expected {
+				t.Errorf("ParseQuality(%q, %q) = %+v, expected %+v", tt.quality, tt.maxResolution, result, tt.expected)
+			}
+		})
+	}
+}
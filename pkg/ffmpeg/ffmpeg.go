@@ -3,6 +3,7 @@ package ffmpeg
 import (
 	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -31,7 +32,7 @@ func (f *Ffmpeg) AutoDownload(ctx context.Context, downloader Downloader) (strin
 		return path, nil
 	}
 
-	url, err := ffmpegDownloadUrl()
+	url, err := downloadUrl("ffmpeg")
 	if err != nil {
 		return "", err
 	}
@@ -60,8 +61,59 @@ func (f *Ffmpeg) AutoDownload(ctx context.Context, downloader Downloader) (strin
 	return ffmpegPath, nil
 }
 
+// AutoDownloadProbe returns the ffprobe next to ffmpegPath, or the one in the PATH, and downloads it into the data
+// directory if there is none. Without ffmpeg it isn't downloaded, the download would most likely fail the same way.
+func (f *Ffmpeg) AutoDownloadProbe(ctx context.Context, downloader Downloader, ffmpegPath string) (string, error) {
+	if path := ProbePath(ffmpegPath); path != "" {
+		return path, nil
+	}
+	if ffmpegPath == "" {
+		return "", errors.New("ffprobe isn't in the PATH, and it's only downloaded along with ffmpeg")
+	}
+
+	url, err := downloadUrl("ffprobe")
+	if err != nil {
+		return "", err
+	}
+
+	probePath := filepath.Join(f.dataDir, executableName("ffprobe"))
+	gzipPath := filepath.Join(f.dataDir, "ffprobe.gz")
+	task := download.NewDownloadTask(gzipPath, url).
+		SetOverwriteFile(true).
+		SetCustomMessage("Downloading FFprobe")
+
+	task.OutputPathHasExtension = true
+
+	if err := downloader.DownloadToFile(ctx, task); err != nil {
+		return "", fmt.Errorf("failed to download ffprobe: %w", err)
+	}
+
+	if err := f.decompressGzip(gzipPath, probePath); err != nil {
+		return "", err
+	}
+
+	_ = os.Remove(gzipPath)
+
+	return probePath, nil
+}
+
+// ProbePath looks for ffprobe next to the ffmpeg binary first, then in the PATH. It returns "" if there is none.
+func ProbePath(ffmpegPath string) string {
+	name := executableName("ffprobe")
+	if ffmpegPath != "" {
+		path := filepath.Join(filepath.Dir(ffmpegPath), name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	if path, err := exec.LookPath(name); err == nil {
+		return path
+	}
+	return ""
+}
+
 func (f *Ffmpeg) GetFfmpegPath() (string, error) {
-	exeName := ffmpegExecutableName()
+	exeName := executableName("ffmpeg")
 	path, err := exec.LookPath(exeName)
 	if err == nil {
 		return path, nil
@@ -76,7 +128,7 @@ func (f *Ffmpeg) GetFfmpegPath() (string, error) {
 }
 
 func (f *Ffmpeg) getFfmpegDataPath(gzip bool) string {
-	name := ffmpegExecutableName()
+	name := executableName("ffmpeg")
 	if gzip {
 		name = "ffmpeg.gz"
 	}
@@ -110,14 +162,15 @@ func (f *Ffmpeg) decompressGzip(src, dst string) error {
 	return nil
 }
 
-func ffmpegExecutableName() string {
+func executableName(tool string) string {
 	if runtime.GOOS == "windows" {
-		return "ffmpeg.exe"
+		return tool + ".exe"
 	}
-	return "ffmpeg"
+	return tool
 }
 
-func ffmpegDownloadUrl() (string, error) {
+// downloadUrl returns the static build of ffmpeg or ffprobe for this platform.
+func downloadUrl(tool string) (string, error) {
 	var platform string
 	switch runtime.GOOS {
 	case "linux":
@@ -162,5 +215,5 @@ func ffmpegDownloadUrl() (string, error) {
 		return "", fmt.Errorf("unsupported platform architecture combination: %s %s", runtime.GOOS, runtime.GOARCH)
 	}
 
-	return fmt.Sprintf("https://github.com/eugeneware/ffmpeg-static/releases/latest/download/ffmpeg-%s-%s.gz", platform, arch), nil
+	return fmt.Sprintf("https://github.com/eugeneware/ffmpeg-static/releases/latest/download/%s-%s-%s.gz", tool, platform, arch), nil
 }
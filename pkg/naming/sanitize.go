@@ -0,0 +1,76 @@
+package naming
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Sanitize turns a title into a valid file or folder name. Every field of a template goes through it,
+// so series folders and file names agree on how titles are written.
+func Sanitize(name string) string {
+	const NameLimit = 160
+
+	// Remove control characters
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+
+	// Replace whitespace with space
+	name = strings.Join(strings.Fields(name), " ")
+
+	// Remove quotes
+	name = strings.ReplaceAll(name, "\"", "")
+
+	// Colon regexes
+	colon1 := regexp.MustCompile(`([\p{L}\d]): +([\p{L}\d])`)
+	name = colon1.ReplaceAllString(name, "${1} - ${2}")
+	colon2 := regexp.MustCompile(`([\p{L}\d]):([\p{L}\d])`)
+	name = colon2.ReplaceAllString(name, "${1} ${2}")
+	name = strings.ReplaceAll(name, ":", "")
+
+	// Question marks
+	question := regexp.MustCompile(`([\p{L}\d])\?+ +([\p{L}\d])`)
+	name = question.ReplaceAllString(name, "${1} - ${2}")
+	name = strings.ReplaceAll(name, "?", "")
+
+	// Slashes
+	slash1 := regexp.MustCompile(`\b([\p{L}\d])/+([\p{L}\d])\b`)
+	name = slash1.ReplaceAllString(name, "${1}${2}")
+	slash2 := regexp.MustCompile(`([\p{L}\d])/+([\p{L}\d])`)
+	name = slash2.ReplaceAllString(name, "${1} ${2}")
+	name = strings.ReplaceAll(name, "/", "")
+
+	// Other special chars
+	chars := []string{"\\", "*", "<", ">", "|"}
+	for _, c := range chars {
+		name = strings.ReplaceAll(name, c, "")
+	}
+
+	// Multiple spaces
+	multipleSpaces := regexp.MustCompile(` {2,}`)
+	name = multipleSpaces.ReplaceAllString(name, " ")
+
+	// Trim space and dot
+	name = strings.Trim(name, " .")
+
+	if len(name) > NameLimit {
+		// Truncate safely at rune boundary
+		runes := []rune(name)
+		totalBytes := 0
+		var truncated []rune
+		for _, r := range runes {
+			totalBytes += len(string(r))
+			if totalBytes > NameLimit {
+				break
+			}
+			truncated = append(truncated, r)
+		}
+		name = string(truncated)
+	}
+
+	return name
+}
@@ -0,0 +1,343 @@
+// Package naming renders the paths of downloaded episodes from templates like
+// "{series}/Season {season:02}/{series} - S{season:02}E{episode:0w}[ - {type}]{ext}".
+//
+// A field is written as {name} or {name:format}. Numbers take a zero padded width as format, like 02,
+// or 0w for the width of the highest episode number of the season. Text in square brackets is optional
+// and left out if one of its fields is empty. Slashes separate folders.
+//
+// {absolute} is the episode number counted across all seasons, as anime libraries number them. Films and
+// specials have none, so it is empty for them, and a file name with it only fits them in square brackets.
+package naming
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Presets are the named templates.
+var Presets = map[string]string{
+	// sdl is the layout gad always had, and the default
+	"sdl":      "[{series} - ]S{season:02}E{episode:0w}[ - {type}][ - {title}]{ext}",
+	"jellyfin": "{series}/Season {season:02}/{series} - S{season:02}E{episode:02}[ - {title}][ - {type}]{ext}",
+	"plex":     "{series}/Season {season:02}/{series} - s{season:02}e{episode:02}[ - {title}][ - {type}]{ext}",
+}
+
+// DefaultPreset is the preset used if no template is given.
+const DefaultPreset = "sdl"
+
+// Templates of the films of a series, which are season 0 on the sites. Media servers take SxxEyy names for
+// specials, so films get names of their own, either next to the episodes or in a folder each below a movies root.
+const (
+	FilmTemplate       = "{series} - Film {episode}[ ({title})][ - {type}]{ext}"
+	FilmFolderTemplate = "{series} - Film {episode}[ ({title})]/{series} - Film {episode}[ ({title})][ - {type}]{ext}"
+)
+
+// Fields are the values a template is rendered with. Text fields are sanitized when they are rendered.
+type Fields struct {
+	Series  string
+	Season  uint32
+	Episode uint32
+	// Absolute is the episode number counted across all seasons, 0 if the episode has none
+	Absolute uint32
+	// MaxEpisodes is the highest episode number of the season, it decides the width of 0w
+	MaxEpisodes uint32
+	// Type is the video type, like GerDub
+	Type  string
+	Title string
+	// Unknown are the text fields that aren't known yet, like the title before the episode page is loaded.
+	// Patterns match any value for them.
+	Unknown []string
+}
+
+var fieldNames = map[string]bool{"series": false, "title": false, "type": false, "season": true, "episode": true, "absolute": true, "ext": false}
+
+var numberFormat = regexp.MustCompile(`^0(\d+|w)$`)
+
+type segment struct {
+	literal string
+	field   string
+	format  string
+	// group is the number of the optional group the segment is in, 0 if it isn't in one
+	group int
+}
+
+// Template is a parsed naming template.
+type Template struct {
+	source   string
+	segments []segment
+}
+
+// Default returns the template of the default preset.
+func Default() *Template {
+	return MustParse(DefaultPreset)
+}
+
+// MustParse is like Parse but panics if the template is invalid. It is meant for the templates of the program.
+func MustParse(input string) *Template {
+	t, err := Parse(input)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Parse parses a template, or returns the preset of that name.
+// The extension is always written at the end, so {ext} can only be the last field and is added if it is missing.
+func Parse(input string) (*Template, error) {
+	source := input
+	if preset, ok := Presets[strings.ToLower(input)]; ok {
+		source = preset
+	}
+	if strings.TrimSpace(source) == "" {
+		return nil, fmt.Errorf("empty naming template")
+	}
+
+	t := &Template{source: source}
+	group, groups := 0, 0
+	for rest := source; rest != ""; {
+		i := strings.IndexAny(rest, "{}[]")
+		if i < 0 {
+			t.segments = append(t.segments, segment{literal: rest, group: group})
+			break
+		}
+		if i > 0 {
+			t.segments = append(t.segments, segment{literal: rest[:i], group: group})
+		}
+
+		switch rest[i] {
+		case '[':
+			if group != 0 {
+				return nil, fmt.Errorf("optional parts can't be nested: %s", input)
+			}
+			groups++
+			group = groups
+			rest = rest[i+1:]
+		case ']':
+			if group == 0 {
+				return nil, fmt.Errorf("unexpected ] in template: %s", input)
+			}
+			group = 0
+			rest = rest[i+1:]
+		case '}':
+			return nil, fmt.Errorf("unexpected } in template: %s", input)
+		case '{':
+			end := strings.IndexByte(rest[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed { in template: %s", input)
+			}
+			name, format, _ := strings.Cut(rest[i+1:i+end], ":")
+			isNumber, ok := fieldNames[name]
+			switch {
+			case !ok:
+				return nil, fmt.Errorf("unknown field {%s} in template", name)
+			case format != "" && (!isNumber || !numberFormat.MatchString(format)):
+				return nil, fmt.Errorf("invalid format {%s:%s} in template", name, format)
+			}
+			t.segments = append(t.segments, segment{field: name, format: format, group: group})
+			rest = rest[i+end+1:]
+		}
+	}
+	if group != 0 {
+		return nil, fmt.Errorf("unclosed [ in template: %s", input)
+	}
+
+	// The extension is appended by the downloader, so it has to come last
+	for i, seg := range t.segments {
+		if seg.field == "ext" && (i != len(t.segments)-1 || seg.group != 0) {
+			return nil, fmt.Errorf("{ext} has to be at the end of the template: %s", input)
+		}
+	}
+	if n := len(t.segments); n > 0 && t.segments[n-1].field == "ext" {
+		t.segments = t.segments[:n-1]
+	}
+	if len(t.segments) == 0 {
+		return nil, fmt.Errorf("naming template without a name: %s", input)
+	}
+	return t, nil
+}
+
+func (t *Template) String() string {
+	return t.source
+}
+
+// HasFolder reports whether the template puts the files into folders of their own.
+func (t *Template) HasFolder() bool {
+	for _, seg := range t.segments {
+		if strings.Contains(seg.literal, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// HasField reports whether the template uses the field.
+func (t *Template) HasField(name string) bool {
+	for _, seg := range t.segments {
+		if seg.field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// WithSeasonFolders returns the template with the episodes in Season NN folders. Templates with folders of their
+// own are returned as they are.
+func (t *Template) WithSeasonFolders() *Template {
+	if t.HasFolder() {
+		return t
+	}
+	// The source already parsed, so the prefix can't make it invalid
+	return MustParse("Season {season:02}/" + t.source)
+}
+
+// SeriesFolder returns the folder the template puts all episodes of the series into, "" if there is none.
+func (t *Template) SeriesFolder(series string) string {
+	if !t.HasFolder() {
+		return ""
+	}
+	folder, _, _ := strings.Cut(t.render(Fields{Series: series}, false), "/")
+	return folder
+}
+
+// SeriesPath returns the folders at the start of the template that only depend on the series, "" if there are none.
+// Every episode of the series is saved below them, wherever the rest of the template puts it.
+func (t *Template) SeriesPath(series string) string {
+	var segments []segment
+	path := ""
+	for _, seg := range t.segments {
+		if seg.group != 0 || seg.field != "" && seg.field != "series" {
+			break
+		}
+		if j := strings.LastIndexByte(seg.literal, '/'); j >= 0 {
+			folders := &Template{segments: append(slices.Clip(segments), segment{literal: seg.literal[:j]})}
+			path = folders.Render(Fields{Series: series})
+		}
+		segments = append(segments, seg)
+	}
+	return path
+}
+
+// Render returns the path of the episode relative to the output folder, without the extension.
+func (t *Template) Render(f Fields) string {
+	return filepath.FromSlash(t.render(f, false))
+}
+
+// Pattern returns a regular expression that matches the file names the episode could have been saved under,
+// with any of the extensions. The folders aren't part of it, so files that were moved around are found as well.
+// Unknown fields match anything, and the title is never required, so files saved with and without the title are
+// found. Other empty fields only match without them, so films without a number don't match every episode.
+func (t *Template) Pattern(f Fields, exts []string) *regexp.Regexp {
+	quoted := make([]string, len(exts))
+	for i, ext := range exts {
+		quoted[i] = regexp.QuoteMeta(ext)
+	}
+	return regexp.MustCompile("^" + t.fileName().render(f, true) + "(?:" + strings.Join(quoted, "|") + ")$")
+}
+
+// fileName returns the part of the template after the last folder.
+func (t *Template) fileName() *Template {
+	for i := len(t.segments) - 1; i >= 0; i-- {
+		literal := t.segments[i].literal
+		if j := strings.LastIndexByte(literal, '/'); j >= 0 {
+			segments := append([]segment{{literal: literal[j+1:], group: t.segments[i].group}}, t.segments[i+1:]...)
+			return &Template{source: t.source, segments: segments}
+		}
+	}
+	return t
+}
+
+// render writes the segments, or an expression matching them if pattern is set. An optional part with an empty
+// field is left out. In patterns, an optional part with an unknown field or the title matches with or without it,
+// with anything in place of the unknown field.
+func (t *Template) render(f Fields, pattern bool) string {
+	var out, part strings.Builder
+	empty, missing, optional := false, false, false
+	for i, seg := range t.segments {
+		w := &out
+		if seg.group != 0 {
+			w = &part
+		}
+
+		text := seg.literal
+		if seg.field != "" {
+			text = f.value(seg)
+			empty = empty || text == ""
+			missing = missing || text == "" && !f.unknown(seg.field)
+			optional = optional || seg.field == "title"
+		}
+		switch {
+		case !pattern:
+			w.WriteString(text)
+		case seg.field != "" && f.unknown(seg.field):
+			w.WriteString("[^/]+")
+		default:
+			w.WriteString(regexp.QuoteMeta(text))
+		}
+
+		if seg.group == 0 {
+			empty, missing, optional = false, false, false
+		} else if i == len(t.segments)-1 || t.segments[i+1].group != seg.group {
+			switch {
+			case !pattern && !empty:
+				out.WriteString(part.String())
+			case !pattern || missing:
+			case empty || optional:
+				fmt.Fprintf(&out, "(?:%s)?", part.String())
+			default:
+				out.WriteString(part.String())
+			}
+			part.Reset()
+			empty, missing, optional = false, false, false
+		}
+	}
+	return out.String()
+}
+
+// unknown reports whether the value of the field isn't known yet. Numbers are always known.
+func (f Fields) unknown(field string) bool {
+	return !fieldNames[field] && slices.Contains(f.Unknown, field)
+}
+
+func (f Fields) value(seg segment) string {
+	switch seg.field {
+	case "series":
+		return Sanitize(f.Series)
+	case "title":
+		return Sanitize(f.Title)
+	case "type":
+		return Sanitize(f.Type)
+	case "season":
+		return formatNumber(f.Season, seg.format, f.MaxEpisodes)
+	case "episode":
+		return formatNumber(f.Episode, seg.format, f.MaxEpisodes)
+	case "absolute":
+		if f.Absolute == 0 {
+			return ""
+		}
+		return formatNumber(f.Absolute, seg.format, f.MaxEpisodes)
+	}
+	return ""
+}
+
+// formatNumber pads the number with zeros to the width of the format. 0w is the width of maxEpisodes, but at least 2.
+func formatNumber(n uint32, format string, maxEpisodes uint32) string {
+	width := 0
+	switch {
+	case format == "0w":
+		width = 2
+		if maxEpisodes > 0 {
+			width = int(math.Log10(float64(maxEpisodes))) + 1
+			if width < 2 {
+				width = 2
+			}
+		}
+	case format != "":
+		width, _ = strconv.Atoi(format[1:])
+	}
+	return fmt.Sprintf("%0*d", width, n)
+}
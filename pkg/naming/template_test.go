@@ -0,0 +1,132 @@
+package naming
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	fields := Fields{Series: "Re:ZERO - Starting Life", Season: 1, Episode: 7, MaxEpisodes: 112, Type: "GerDub", Title: "Who: Are You?"}
+	tests := []struct {
+		template string
+		fields   Fields
+		want     string
+	}{
+		{"sdl", fields, "Re ZERO - Starting Life - S01E007 - GerDub - Who - Are You"},
+		{"sdl", Fields{Series: "Show", Season: 2, Episode: 3}, "Show - S02E03"},
+		{"sdl", Fields{Season: 2, Episode: 3, Type: "EngSub"}, "S02E03 - EngSub"},
+		{"jellyfin", fields, "Re ZERO - Starting Life/Season 01/Re ZERO - Starting Life - S01E07 - Who - Are You - GerDub"},
+		{"plex", Fields{Series: "Show", Season: 1, Episode: 2}, "Show/Season 01/Show - s01e02"},
+		{"{series} {episode:03}{ext}", fields, "Re ZERO - Starting Life 007"},
+		{"{series}/{series}[ ({title})]", Fields{Series: "AC/DC"}, "AC DC/AC DC"},
+		{FilmTemplate, Fields{Series: "Show", Episode: 1, Title: "The Film", Type: "GerDub"}, "Show - Film 1 (The Film) - GerDub"},
+		{FilmFolderTemplate, Fields{Series: "Show", Episode: 2}, "Show - Film 2/Show - Film 2"},
+		{"{series} - [{absolute:03} - ]S{season:02}E{episode:02}", Fields{Series: "Show", Season: 2, Episode: 3, Absolute: 27}, "Show - 027 - S02E03"},
+		{"{series} - [{absolute:03} - ]S{season:02}E{episode:02}", Fields{Series: "Show", Episode: 1}, "Show - S00E01"},
+		{"{series}[ - {absolute:03}][ - {type}]", Fields{Series: "Show", Episode: 1, Type: "GerDub"}, "Show - GerDub"},
+	}
+	for _, tt := range tests {
+		template, err := Parse(tt.template)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.template, err)
+		}
+		if got := template.Render(tt.fields); got != filepath.FromSlash(tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestWithSeasonFolders(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"sdl", "Season 02/Show - S02E03"},
+		{"jellyfin", "Show/Season 02/Show - S02E03"},
+	}
+	for _, tt := range tests {
+		template, err := Parse(tt.template)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.template, err)
+		}
+		template = template.WithSeasonFolders()
+		if got := template.Render(Fields{Series: "Show", Season: 2, Episode: 3}); got != filepath.FromSlash(tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestSeriesPath(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"sdl", ""},
+		{"jellyfin", "Show"},
+		{"Anime/{series}/{season}x{episode:02}", "Anime/Show"},
+		{"Anime/{series} ({type})/{season}x{episode:02}", "Anime"},
+		{"Season {season:02}/{series} - {episode}", ""},
+		{FilmFolderTemplate, ""},
+	}
+	for _, tt := range tests {
+		template, err := Parse(tt.template)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.template, err)
+		}
+		if got := template.SeriesPath("Show"); got != filepath.FromSlash(tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, template := range []string{"", "{unknown}", "{series:02}", "{episode:2}", "[{series}", "{series}]", "[[{series}]]", "{series", "{ext}{series}", "[{ext}]", "{ext}"} {
+		if _, err := Parse(template); err == nil {
+			t.Errorf("%q: expected an error", template)
+		}
+	}
+}
+
+func TestPattern(t *testing.T) {
+	exts := []string{".mp4", ".mkv"}
+	tests := []struct {
+		template string
+		fields   Fields
+		name     string
+		want     bool
+	}{
+		{"sdl", Fields{Series: "Show", Season: 1, Episode: 1, Type: "GerDub"}, "Show - S01E01 - GerDub.mkv", true},
+		{"sdl", Fields{Series: "Show", Season: 1, Episode: 1, Type: "GerDub", Unknown: []string{"title"}}, "Show - S01E01 - GerDub - Title.mp4", true},
+		{"sdl", Fields{Series: "Show", Season: 1, Episode: 1, Type: "GerDub", Title: "Title"}, "Show - S01E01 - GerDub - Title.mp4", true},
+		{"sdl", Fields{Series: "Show", Season: 1, Episode: 1, Type: "GerDub", Title: "Title"}, "Show - S01E01 - GerDub.mp4", true},
+		{"sdl", Fields{Series: "Show", Season: 1, Episode: 1, Type: "GerDub", Title: "Title"}, "Show - S01E01 - GerDub - Other Title.mp4", false},
+		{"sdl", Fields{Series: "Show", Season: 1, Episode: 1, Type: "GerDub"}, "Show - S01E01 - GerDub - Title.mp4", false},
+		{"sdl", Fields{Series: "Show", Season: 1, Episode: 1, Type: "GerDub"}, "Show - S01E01 - EngDub.mp4", false},
+		{"sdl", Fields{Series: "Show", Season: 1, Episode: 1, Type: "GerDub"}, "Show - S01E01 - GerDub.nfo", false},
+		{"sdl", Fields{Series: "Show", Season: 1, Episode: 1, Unknown: []string{"type"}}, "Show - S01E01 - EngDub.mp4", true},
+		{"sdl", Fields{Series: "Show", Season: 1, Episode: 1, Unknown: []string{"type"}}, "Show - S01E01.mp4", true},
+		{"sdl", Fields{Series: "Show", Season: 1, Episode: 1}, "Show - S01E01 - EngDub.mp4", false},
+		{"sdl", Fields{Series: "Show", Season: 1, Episode: 10}, "Show - S01E105 - EngDub.mp4", false},
+		{"sdl", Fields{Series: "Show", Season: 1, Episode: 1}, "Other - S01E01.mp4", false},
+		{"jellyfin", Fields{Series: "Show", Season: 1, Episode: 1, Type: "GerSub", Unknown: []string{"title"}}, "Show - S01E01 - Title - GerSub.mkv", true},
+		{"jellyfin", Fields{Series: "Show", Season: 1, Episode: 1, Type: "GerSub"}, "Show - S01E01 - GerSub.mkv", true},
+		{"jellyfin", Fields{Series: "Show", Season: 1, Episode: 1, Type: "GerSub"}, "Show - S02E01 - GerSub.mkv", false},
+		{FilmFolderTemplate, Fields{Series: "Show", Episode: 2, Type: "GerDub", Unknown: []string{"title"}}, "Show - Film 2 (The Film) - GerDub.mp4", true},
+		{"{series} - {absolute:03}", Fields{Series: "Show", Season: 2, Episode: 3, Absolute: 27}, "Show - 027.mkv", true},
+		{"{series} - {absolute:03}", Fields{Series: "Show", Season: 2, Episode: 3, Absolute: 27}, "Show - 028.mkv", false},
+		{"{series} - {absolute:03}", Fields{Series: "Show", Episode: 1}, "Show - 001.mkv", false},
+		{"{series}[ - {absolute:03}][ - {type}]", Fields{Series: "Show", Episode: 1, Type: "GerDub"}, "Show - 001 - GerDub.mkv", false},
+		{"{series}[ - {absolute:03}][ - {type}]", Fields{Series: "Show", Episode: 1, Type: "GerDub"}, "Show - GerDub.mkv", true},
+		{FilmFolderTemplate, Fields{Series: "Show", Episode: 2, Type: "GerDub"}, "Show - Film 2 - GerDub.mp4", true},
+		{FilmFolderTemplate, Fields{Series: "Show", Episode: 2, Type: "GerDub"}, "Show - Film 12 - GerDub.mp4", false},
+	}
+	for _, tt := range tests {
+		template, err := Parse(tt.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := template.Pattern(tt.fields, exts).MatchString(tt.name); got != tt.want {
+			t.Errorf("%s %q: got %v, want %v", tt.template, tt.name, got, tt.want)
+		}
+	}
+}
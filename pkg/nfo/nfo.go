@@ -0,0 +1,74 @@
+// Package nfo writes the .nfo files Kodi and Jellyfin read the series and episode details from,
+// so they match the library without online scrapers.
+package nfo
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/bugmaschine/gad/internal/downloaders"
+)
+
+// TVShowFile is the name of the series .nfo file in the series folder.
+const TVShowFile = "tvshow.nfo"
+
+type tvShow struct {
+	XMLName xml.Name `xml:"tvshow"`
+	Title   string   `xml:"title"`
+	Plot    string   `xml:"plot,omitempty"`
+	Genres  []string `xml:"genre"`
+	Year    uint32   `xml:"year,omitempty"`
+}
+
+type episodeDetails struct {
+	XMLName   xml.Name `xml:"episodedetails"`
+	Title     string   `xml:"title"`
+	ShowTitle string   `xml:"showtitle"`
+	Season    uint32   `xml:"season"`
+	Episode   uint32   `xml:"episode"`
+}
+
+// WriteTVShow writes the tvshow.nfo of the series into dir.
+func WriteTVShow(dir string, info downloaders.SeriesInfo) error {
+	return writeFile(filepath.Join(dir, TVShowFile), tvShow{
+		Title:  info.Title,
+		Plot:   info.Description,
+		Genres: info.Genres,
+		Year:   info.Year,
+	})
+}
+
+// WriteEpisode writes the .nfo of an episode to path. Episodes without a scraped title are called by their number.
+func WriteEpisode(path, showTitle string, episode downloaders.EpisodeInfo) error {
+	title := episode.Title
+	if title == "" {
+		title = fmt.Sprintf("Episode %d", episode.Episode)
+	}
+	return writeFile(path, episodeDetails{
+		Title:     title,
+		ShowTitle: showTitle,
+		Season:    episode.Season,
+		Episode:   episode.Episode,
+	})
+}
+
+// writeFile writes the file next to its destination first, so media servers never read half of it.
+func writeFile(path string, v any) error {
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(xml.Header), append(data, '\n')...)
+
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
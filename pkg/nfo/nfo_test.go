@@ -0,0 +1,42 @@
+package nfo
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bugmaschine/gad/internal/downloaders"
+)
+
+func TestWriteFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	info := downloaders.SeriesInfo{Title: "Tom & Jerry", Description: "A cat <and> a mouse", Genres: []string{"Comedy", "Kids"}, Year: 1940}
+	if err := WriteTVShow(dir, info); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, TVShowFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"<title>Tom &amp; Jerry</title>", "<plot>A cat &lt;and&gt; a mouse</plot>", "<genre>Comedy</genre>", "<genre>Kids</genre>", "<year>1940</year>"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("tvshow.nfo is missing %s:\n%s", want, data)
+		}
+	}
+
+	path := filepath.Join(dir, "episode.nfo")
+	if err := WriteEpisode(path, "Tom & Jerry", downloaders.EpisodeInfo{Season: 2, Episode: 7}); err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"<episodedetails>", "<title>Episode 7</title>", "<season>2</season>", "<episode>7</episode>"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("episode .nfo is missing %s:\n%s", want, data)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultBaseDelay = 1 * time.Second
+	DefaultMaxDelay  = 30 * time.Second
+	// MaxRetryAfter caps how long a server can make us wait with a Retry-After header.
+	MaxRetryAfter = 5 * time.Minute
+)
+
+// Policy describes how often and how long to wait before an operation is tried again.
+// A nil *Policy runs every operation exactly once.
+type Policy struct {
+	Retries   int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+func NewPolicy(retries int) *Policy {
+	if retries < 0 {
+		retries = 0
+	}
+	return &Policy{
+		Retries:   retries,
+		BaseDelay: DefaultBaseDelay,
+		MaxDelay:  DefaultMaxDelay,
+	}
+}
+
+// Do runs fn until it succeeds, returns a fatal error, or the retries are used up.
+// The name is only used for logging.
+func (p *Policy) Do(ctx context.Context, name string, fn func() error) error {
+	retries := 0
+	if p != nil {
+		retries = p.Retries
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if !IsRetryable(err) {
+			slog.Debug("Not retrying fatal error", "operation", name, "error", err)
+			return err
+		}
+		if attempt >= retries {
+			break
+		}
+
+		delay := p.delay(attempt, err)
+		slog.Debug("Retrying after error", "operation", name, "attempt", attempt+1, "retries", retries, "delay", delay, "error", err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+
+	if retries > 0 {
+		return fmt.Errorf("giving up after %d retries: %w", retries, err)
+	}
+	return err
+}
+
+// delay returns the exponential backoff with jitter for the given attempt,
+// or the server's Retry-After if that is longer.
+func (p *Policy) delay(attempt int, err error) time.Duration {
+	base, max := p.BaseDelay, p.MaxDelay
+	if base <= 0 {
+		base = DefaultBaseDelay
+	}
+	if max <= 0 {
+		max = DefaultMaxDelay
+	}
+
+	backoff := base
+	for i := 0; i < attempt && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	// Full jitter on the upper half, so concurrent downloads don't retry in lockstep.
+	backoff = backoff/2 + rand.N(backoff/2+1)
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > backoff {
+		return min(statusErr.RetryAfter, MaxRetryAfter)
+	}
+	return backoff
+}
+
+// StatusError is returned for HTTP responses with an unexpected status code.
+type StatusError struct {
+	Url        string
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("bad status: %s", e.Status)
+}
+
+// CheckResponse returns a *StatusError if the response doesn't have one of the accepted status codes.
+// If no codes are given, only 200 OK is accepted.
+func CheckResponse(resp *http.Response, accepted ...int) error {
+	if len(accepted) == 0 {
+		accepted = []int{http.StatusOK}
+	}
+	for _, code := range accepted {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	return &StatusError{
+		Url:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := time.Until(date); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+type fatalError struct {
+	err error
+}
+
+func (e *fatalError) Error() string { return e.err.Error() }
+func (e *fatalError) Unwrap() error { return e.err }
+
+// Fatal marks an error as not worth retrying, e.g. an unsupported encryption method.
+func Fatal(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &fatalError{err: err}
+}
+
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// Retryable marks an error as transient, even if it would not be classified as such otherwise.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err: err}
+}
+
+// IsRetryable reports whether an error is transient. Timeouts, connection resets,
+// truncated bodies, 5xx, 408 and 429 are retryable; everything else is considered fatal.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var fatal *fatalError
+	if errors.As(err, &fatal) {
+		return false
+	}
+	var retryable *retryableError
+	if errors.As(err, &retryable) {
+		return true
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.StatusCode >= 500:
+			return true
+		case statusErr.StatusCode == http.StatusRequestTimeout, statusErr.StatusCode == http.StatusTooManyRequests:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsTemporary {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,98 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"nil", nil, false},
+		{"unknown", errors.New("failed to retrieve sources"), false},
+		{"canceled", context.Canceled, false},
+		{"deadline", fmt.Errorf("failed to load page: %w", context.DeadlineExceeded), true},
+		{"unexpected eof", io.ErrUnexpectedEOF, true},
+		{"connection reset", fmt.Errorf("read: %w", syscall.ECONNRESET), true},
+		{"404", &StatusError{StatusCode: http.StatusNotFound}, false},
+		{"403", &StatusError{StatusCode: http.StatusForbidden}, false},
+		{"429", &StatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{"503", fmt.Errorf("failed to fetch source: %w", &StatusError{StatusCode: http.StatusServiceUnavailable}), true},
+		{"fatal timeout", Fatal(context.DeadlineExceeded), false},
+		{"marked retryable", Retryable(errors.New("page load error")), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.expected {
+				t.Errorf("IsRetryable(%v) = %v, expected %v", tt.err, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPolicyDo(t *testing.T) {
+	policy := &Policy{Retries: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+
+	attempts := 0
+	err := policy.Do(context.Background(), "transient", func() error {
+		attempts++
+		if attempts < 3 {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("expected success after 3 attempts, got %d attempts and error %v", attempts, err)
+	}
+
+	attempts = 0
+	err = policy.Do(context.Background(), "fatal", func() error {
+		attempts++
+		return &StatusError{StatusCode: http.StatusNotFound, Status: "404 Not Found"}
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("expected a single attempt for a fatal error, got %d attempts and error %v", attempts, err)
+	}
+
+	attempts = 0
+	err = policy.Do(context.Background(), "exhausted", func() error {
+		attempts++
+		return io.ErrUnexpectedEOF
+	})
+	if !errors.Is(err, io.ErrUnexpectedEOF) || attempts != 4 {
+		t.Errorf("expected 4 attempts ending in the last error, got %d attempts and error %v", attempts, err)
+	}
+
+	var nilPolicy *Policy
+	attempts = 0
+	_ = nilPolicy.Do(context.Background(), "nil", func() error {
+		attempts++
+		return io.ErrUnexpectedEOF
+	})
+	if attempts != 1 {
+		t.Errorf("expected a nil policy to run once, got %d attempts", attempts)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("120"); got != 2*time.Minute {
+		t.Errorf("expected 2m, got %v", got)
+	}
+	if got := parseRetryAfter("soon"); got != 0 {
+		t.Errorf("expected 0 for garbage, got %v", got)
+	}
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(future); got < 59*time.Minute {
+		t.Errorf("expected about an hour for an HTTP date, got %v", got)
+	}
+}
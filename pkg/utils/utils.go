@@ -25,6 +25,7 @@ func RemoveDirAllIgnoreNotExists(path string) error {
 	return nil
 }
 
+// CleanFolderName is how series folders were named in queue mode before naming.Sanitize, it is only used to find them.
 func CleanFolderName(rawName string) string {
 	// i had a script that used sdl to download stuff (basically the queue feature, but more manual), and to make it backwards compatible to that script, i made it clean the titles in a similar way.
 	name := strings.TrimSpace(rawName)